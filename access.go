@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// AccessPolicy restricts which providers and models clients may use. An
+// empty list allows everything; a model ending in "*" matches any model with
+// that prefix, e.g. "gpt-4o*".
+type AccessPolicy struct {
+	Providers []ModelProvider `json:"providers,omitempty"`
+	Models    []string        `json:"models,omitempty"`
+}
+
+// allowsProvider reports whether p is permitted
+func (a AccessPolicy) allowsProvider(p ModelProvider) bool {
+	if len(a.Providers) == 0 {
+		return true
+	}
+	for _, allowed := range a.Providers {
+		if allowed == p {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsModel reports whether model is permitted. An empty model leaves the
+// choice to the provider's default and is always allowed.
+func (a AccessPolicy) allowsModel(model string) bool {
+	if len(a.Models) == 0 || model == "" {
+		return true
+	}
+	for _, allowed := range a.Models {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(model, prefix) {
+				return true
+			}
+		} else if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// accessPolicy returns the policy for the key that authenticated ctx, falling
+// back to the gateway-wide policy
+func (g *Gateway) accessPolicy(ctx context.Context) AccessPolicy {
+	if policy, ok := g.policies[APIKeyLabel(ctx)]; ok {
+		return policy
+	}
+	return g.config.Access
+}
+
+// checkAccess returns an error describing the first provider or model in req
+// that the caller may not use. Only the client's own choices are checked; the
+// gateway's default FallbackProviders are the operator's.
+func (g *Gateway) checkAccess(ctx context.Context, req LLMRequest) error {
+	policy := g.accessPolicy(ctx)
+	if !policy.allowsModel(req.Model) {
+		return fmt.Errorf("model %s is not allowed", req.Model)
+	}
+	for _, p := range append([]ModelProvider{req.Provider}, req.FallbackProviders...) {
+		if !policy.allowsProvider(p) {
+			return fmt.Errorf("provider %s is not allowed", p)
+		}
+	}
+	return nil
+}
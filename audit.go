@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// AuditConfig turns on audit logging of prompts and responses. Sink is
+// "stdout" or a file path to append to; empty disables auditing. Text is
+// passed through the redactor before it is written.
+type AuditConfig struct {
+	Sink string `json:"sink,omitempty"`
+
+	// SampleRate is the fraction of requests logged, e.g. 0.1 for one in ten;
+	// 0 logs every request
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// RedactPatterns are regular expressions masked in addition to emails and
+	// card numbers
+	RedactPatterns []string `json:"redact_patterns,omitempty"`
+}
+
+// Redactor masks sensitive text before it is written to the audit log
+type Redactor interface {
+	Redact(text string) string
+}
+
+// redactedText replaces whatever a Redactor masks
+const redactedText = "[REDACTED]"
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	cardPattern  = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+// PatternRedactor masks email addresses, card numbers that pass the Luhn
+// check, and anything matching its extra patterns
+type PatternRedactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewPatternRedactor compiles the extra patterns to mask
+func NewPatternRedactor(patterns ...string) (*PatternRedactor, error) {
+	r := &PatternRedactor{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func (r *PatternRedactor) Redact(text string) string {
+	text = emailPattern.ReplaceAllString(text, redactedText)
+	text = cardPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if luhnValid(match) {
+			return redactedText
+		}
+		return match
+	})
+	for _, re := range r.patterns {
+		text = re.ReplaceAllString(text, redactedText)
+	}
+	return text
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by
+// card numbers, so order numbers and the like are left alone
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id,omitempty"`
+	APIKey    string        `json:"api_key,omitempty"`
+	Provider  ModelProvider `json:"provider"`
+	Model     string        `json:"model"`
+	Messages  []Message     `json:"messages"`
+	Response  string        `json:"response,omitempty"`
+	Cached    bool          `json:"cached,omitempty"`
+	Tokens    int           `json:"tokens_used,omitempty"`
+	Error     string        `json:"error,omitempty"`
+
+	// Experiment and Variant name the A/B variant that served the request
+	Experiment string `json:"experiment,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+}
+
+// AuditLogger writes sampled, redacted AuditRecords as JSON lines
+type AuditLogger struct {
+	mu       sync.Mutex
+	w        io.Writer
+	closer   io.Closer
+	sample   float64
+	redactor Redactor
+}
+
+// NewAuditLogger opens the sink described by cfg. It returns nil when
+// auditing is off; a nil *AuditLogger logs nothing.
+func NewAuditLogger(cfg AuditConfig, redactor Redactor) (*AuditLogger, error) {
+	if cfg.Sink == "" {
+		return nil, nil
+	}
+	if redactor == nil {
+		r, err := NewPatternRedactor(cfg.RedactPatterns...)
+		if err != nil {
+			return nil, err
+		}
+		redactor = r
+	}
+
+	a := &AuditLogger{sample: cfg.SampleRate, redactor: redactor}
+	if cfg.Sink == "stdout" {
+		a.w = os.Stdout
+		return a, nil
+	}
+	f, err := os.OpenFile(cfg.Sink, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	a.w, a.closer = f, f
+	return a, nil
+}
+
+// Log records a finished request, subject to sampling
+func (a *AuditLogger) Log(ctx context.Context, req LLMRequest, response LLMResponse, err error) {
+	if a == nil || (a.sample > 0 && rand.Float64() >= a.sample) {
+		return
+	}
+
+	msgs := req.conversation()
+	redacted := make([]Message, len(msgs))
+	for i, m := range msgs {
+		redacted[i] = Message{Role: m.Role, Content: a.redactor.Redact(m.Content)}
+	}
+	record := AuditRecord{
+		Time:      time.Now().UTC(),
+		RequestID: RequestIDFrom(ctx),
+		APIKey:    APIKeyLabel(ctx),
+		Provider:  req.Provider,
+		Model:     req.Model,
+		Messages:  redacted,
+
+		Experiment: req.experiment,
+		Variant:    req.variant,
+	}
+	if err != nil {
+		record.Error = a.redactor.Redact(err.Error())
+	} else {
+		record.Provider = response.Provider
+		record.Response = a.redactor.Redact(response.Response)
+		record.Cached = response.Cached
+		record.Tokens = response.TokensUsed
+	}
+
+	line, _ := json.Marshal(record)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		slog.Error("audit log write failed", "err", err)
+	}
+}
+
+// Close closes the audit log file, if there is one
+func (a *AuditLogger) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
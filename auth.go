@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// APIKeyConfig is a client key accepted by the gateway. The label is used to
+// attribute usage to a client without logging the key itself.
+type APIKeyConfig struct {
+	Key   string `json:"key"`
+	Label string `json:"label,omitempty"`
+
+	// MonthlyBudget is the USD spend after which requests get 402; 0 is unlimited
+	MonthlyBudget float64 `json:"monthly_budget_usd,omitempty"`
+
+	// Access replaces the gateway-wide access policy for this key
+	Access *AccessPolicy `json:"access,omitempty"`
+
+	// Priority is the default priority of the key's requests and the
+	// highest they may ask for
+	Priority Priority `json:"priority,omitempty"`
+}
+
+type contextKey string
+
+const apiKeyLabelKey contextKey = "api_key_label"
+
+// APIKeyLabel returns the label of the key that authenticated the request, if any
+func APIKeyLabel(ctx context.Context) string {
+	label, _ := ctx.Value(apiKeyLabelKey).(string)
+	return label
+}
+
+// clientKey extracts the key sent via X-API-Key or an Authorization Bearer token
+func clientKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// RequireAuth rejects requests without a configured API key with 401. When no
+// keys are configured authentication is disabled and requests pass through.
+func (g *Gateway) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(g.apiKeys) == 0 {
+			next(w, r)
+			return
+		}
+
+		label, ok := g.apiKeys[clientKey(r)]
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ai-gateway"`)
+			g.writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+			g.metrics.RecordError()
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyLabelKey, label)
+		next(w, r.WithContext(ctx))
+	}
+}
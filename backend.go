@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// BackendConfig is one upstream endpoint/key for a provider. Several backends
+// let a provider spread traffic across API keys or regional endpoints.
+type BackendConfig struct {
+	Name    string `json:"name,omitempty"`
+	APIKey  string `json:"api_key,omitempty"`
+	BaseURL string `json:"base_url,omitempty"`
+	Weight  int    `json:"weight,omitempty"`
+}
+
+// Backend is a configured upstream with its selection state
+type Backend struct {
+	BackendConfig
+	current  int // smooth weighted round-robin state, guarded by the pool
+	requests atomic.Int64
+}
+
+// backendPool picks backends for one provider using smooth weighted
+// round-robin, which interleaves picks instead of sending bursts to the
+// heaviest backend
+type backendPool struct {
+	mu       sync.Mutex
+	backends []*Backend
+	total    int
+}
+
+// newBackendPool builds a pool from the provider config. Without explicit
+// backends the provider's own APIKey and BaseURL form a single backend.
+func newBackendPool(p ModelProvider, pc ProviderConfig) *backendPool {
+	configs := pc.Backends
+	if len(configs) == 0 {
+		configs = []BackendConfig{{APIKey: pc.APIKey, BaseURL: pc.BaseURL}}
+	}
+
+	pool := &backendPool{}
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("%s-%d", p, i)
+		}
+		if cfg.BaseURL == "" {
+			cfg.BaseURL = pc.BaseURL
+		}
+		if cfg.Weight <= 0 {
+			cfg.Weight = 1
+		}
+		pool.backends = append(pool.backends, &Backend{BackendConfig: cfg})
+		pool.total += cfg.Weight
+	}
+	return pool
+}
+
+// next returns the backend to use for the next request
+func (pool *backendPool) next() *Backend {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var best *Backend
+	for _, b := range pool.backends {
+		b.current += b.Weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= pool.total
+	best.requests.Add(1)
+	return best
+}
+
+// counts returns how many requests each backend has been picked for
+func (pool *backendPool) counts() map[string]int64 {
+	counts := make(map[string]int64, len(pool.backends))
+	for _, b := range pool.backends {
+		counts[b.Name] = b.requests.Load()
+	}
+	return counts
+}
+
+// backend picks the next upstream backend for a provider
+func (g *Gateway) backend(p ModelProvider) (*Backend, error) {
+	pool, exists := g.backends[p]
+	if !exists {
+		return nil, fmt.Errorf("no backend configured for %s", p)
+	}
+	return pool.next(), nil
+}
+
+// backendCounts returns per-backend request counts keyed by provider
+func (g *Gateway) backendCounts() map[ModelProvider]map[string]int64 {
+	counts := make(map[ModelProvider]map[string]int64, len(g.backends))
+	for p, pool := range g.backends {
+		counts[p] = pool.counts()
+	}
+	return counts
+}
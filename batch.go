@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// BatchResult is the outcome of one request in a batch. Exactly one of
+// Response and Error is set; Status is the HTTP status the request would have
+// got on its own.
+type BatchResult struct {
+	Index    int          `json:"index"`
+	Status   int          `json:"status"`
+	Response *LLMResponse `json:"response,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// HandleBatch serves POST /api/llm/batch, which takes a JSON array of
+// LLMRequests and answers with a BatchResult for each, in the same order.
+// Items are processed concurrently by up to Config.BatchConcurrency workers,
+// each is cache-checked and rate limited on its own, and a failed item does
+// not fail the batch.
+func (g *Gateway) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	g.inFlight.Add(1)
+	defer g.inFlight.Add(-1)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		g.writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var reqs []LLMRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		g.invalidBody(w, r, err)
+		g.metrics.RecordError()
+		return
+	}
+	if len(reqs) == 0 {
+		g.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Batch must not be empty")
+		g.metrics.RecordError()
+		return
+	}
+	if max := g.config.BatchMaxSize; max > 0 && len(reqs) > max {
+		g.writeError(w, r, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, fmt.Sprintf("Batch of %d requests exceeds the limit of %d", len(reqs), max))
+		g.metrics.RecordError()
+		return
+	}
+	noCache := noCacheRequested(r)
+
+	workers := g.config.BatchConcurrency
+	if workers <= 0 || workers > len(reqs) {
+		workers = len(reqs)
+	}
+	results := make([]BatchResult, len(reqs))
+	indexes := make(chan int)
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			for i := range indexes {
+				results[i] = g.batchItem(r, i, reqs[i], noCache)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := range reqs {
+		indexes <- i
+	}
+	close(indexes)
+	for i := 0; i < workers; i++ {
+		<-done
+	}
+	if g.clientCancelled(w, r.Context()) {
+		return
+	}
+
+	g.writeJSON(w, r, http.StatusOK, results)
+}
+
+// batchItem runs one request of a batch through the same checks as
+// HandleLLMRequest. Streaming and callbacks aren't available in a batch.
+func (g *Gateway) batchItem(r *http.Request, index int, req LLMRequest, noCache bool) BatchResult {
+	fail := func(status int, msg string) BatchResult {
+		// The whole batch is counted once if the client went away
+		if !clientGone(r.Context()) {
+			g.metrics.RecordError()
+		}
+		return BatchResult{Index: index, Status: status, Error: msg}
+	}
+
+	if !g.allowBatchItem(r) {
+		return fail(http.StatusTooManyRequests, "Rate limit exceeded")
+	}
+	if noCache {
+		req.NoCache = true
+	}
+	// Batches are background work, so they yield to interactive requests
+	if req.Priority == "" {
+		req.Priority = PriorityLow
+	}
+	g.applyDefaults(&req)
+	g.assignVariant(r.Context(), &req)
+
+	invalid := g.renderTemplate(&req)
+	if invalid == nil {
+		invalid = g.validate(req)
+	}
+	if invalid != nil {
+		return fail(http.StatusBadRequest, invalid.Error())
+	}
+	if req.Stream || req.CallbackURL != "" {
+		return fail(http.StatusBadRequest, "stream and callback_url are not supported in a batch")
+	}
+	if err := g.checkAccess(r.Context(), req); err != nil {
+		return fail(http.StatusForbidden, err.Error())
+	}
+	if g.overBudget(r.Context()) {
+		return fail(http.StatusPaymentRequired, "Monthly budget exceeded")
+	}
+	if reason, err := g.moderate(r.Context(), req); err != nil {
+		return fail(http.StatusBadGateway, err.Error())
+	} else if reason != "" {
+		return BatchResult{Index: index, Status: http.StatusUnprocessableEntity, Error: "Content blocked by moderation: " + reason}
+	}
+
+	ctx, cancel := g.withRequestTimeout(r.Context(), req)
+	defer cancel()
+	response, err := g.completeLLMRequest(ctx, req)
+	if err != nil {
+		status, _ := errorStatus(ctx, err)
+		return fail(status, err.Error())
+	}
+	return BatchResult{Index: index, Status: http.StatusOK, Response: &response}
+}
+
+// allowBatchItem takes a rate limit token for one batch item from the
+// client's bucket, waiting in the rate queue when one is configured
+func (g *Gateway) allowBatchItem(r *http.Request) bool {
+	if g.rateLimiter == nil {
+		return true
+	}
+	keyFunc := g.KeyFunc
+	if keyFunc == nil {
+		keyFunc = DefaultKeyFunc
+	}
+	key := keyFunc(r)
+	if g.config.RateQueue > 0 {
+		return g.rateLimiter.Wait(r.Context(), key, g.config.RateQueue) == nil
+	}
+	return g.rateLimiter.Allow(key)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// bedrockAdapter translates between the gateway and one Bedrock model
+// family, since InvokeModel takes each vendor's native payload
+type bedrockAdapter struct {
+	encode func(req LLMRequest) interface{}
+	decode func(body []byte) (text string, promptTokens, completionTokens int, err error)
+}
+
+// bedrockAdapterFor picks the adapter from the model ID, which may carry a
+// cross-region inference profile prefix such as "us."
+func bedrockAdapterFor(modelID string) (bedrockAdapter, error) {
+	switch {
+	case strings.Contains(modelID, "anthropic."):
+		return bedrockAnthropic, nil
+	case strings.Contains(modelID, "amazon.titan-text"):
+		return bedrockTitan, nil
+	case strings.Contains(modelID, "meta.llama"):
+		return bedrockLlama, nil
+	default:
+		return bedrockAdapter{}, fmt.Errorf("bedrock: unsupported model family for %q", modelID)
+	}
+}
+
+// bedrockAnthropic speaks the Anthropic Messages API as hosted on Bedrock
+var bedrockAnthropic = bedrockAdapter{
+	encode: func(req LLMRequest) interface{} {
+		maxTokens := req.MaxTokens
+		if maxTokens == 0 {
+			maxTokens = 1024 // required by the Messages API
+		}
+		payload := map[string]interface{}{
+			"anthropic_version": "bedrock-2023-05-31",
+			"max_tokens":        maxTokens,
+		}
+		var system []string
+		messages := make([]Message, 0, len(req.conversation()))
+		for _, m := range req.conversation() {
+			if m.Role == "system" {
+				system = append(system, m.Content)
+			} else {
+				messages = append(messages, m)
+			}
+		}
+		payload["messages"] = messages
+		if len(system) > 0 {
+			payload["system"] = strings.Join(system, "\n\n")
+		}
+		if req.Temperature != nil {
+			payload["temperature"] = *req.Temperature
+		}
+		if req.TopP != nil {
+			payload["top_p"] = *req.TopP
+		}
+		if len(req.Stop) > 0 {
+			payload["stop_sequences"] = req.Stop
+		}
+		return payload
+	},
+	decode: func(body []byte) (string, int, int, error) {
+		var result struct {
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+			Usage struct {
+				InputTokens  int `json:"input_tokens"`
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return "", 0, 0, err
+		}
+		var text strings.Builder
+		for _, c := range result.Content {
+			if c.Type == "text" {
+				text.WriteString(c.Text)
+			}
+		}
+		return text.String(), result.Usage.InputTokens, result.Usage.OutputTokens, nil
+	},
+}
+
+// bedrockTitan speaks the Amazon Titan Text format
+var bedrockTitan = bedrockAdapter{
+	encode: func(req LLMRequest) interface{} {
+		prompt, _ := flattenConversation(req.conversation())
+		config := map[string]interface{}{}
+		if req.MaxTokens > 0 {
+			config["maxTokenCount"] = req.MaxTokens
+		}
+		if req.Temperature != nil {
+			config["temperature"] = *req.Temperature
+		}
+		if req.TopP != nil {
+			config["topP"] = *req.TopP
+		}
+		if len(req.Stop) > 0 {
+			config["stopSequences"] = req.Stop
+		}
+		return map[string]interface{}{
+			"inputText":            prompt,
+			"textGenerationConfig": config,
+		}
+	},
+	decode: func(body []byte) (string, int, int, error) {
+		var result struct {
+			InputTextTokenCount int `json:"inputTextTokenCount"`
+			Results             []struct {
+				TokenCount int    `json:"tokenCount"`
+				OutputText string `json:"outputText"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return "", 0, 0, err
+		}
+		if len(result.Results) == 0 {
+			return "", 0, 0, fmt.Errorf("bedrock: titan returned no results")
+		}
+		return result.Results[0].OutputText, result.InputTextTokenCount, result.Results[0].TokenCount, nil
+	},
+}
+
+// bedrockLlama speaks the Meta Llama format
+var bedrockLlama = bedrockAdapter{
+	encode: func(req LLMRequest) interface{} {
+		prompt, system := flattenConversation(req.conversation())
+		if system != "" {
+			prompt = system + "\n\n" + prompt
+		}
+		payload := map[string]interface{}{"prompt": prompt}
+		if req.MaxTokens > 0 {
+			payload["max_gen_len"] = req.MaxTokens
+		}
+		if req.Temperature != nil {
+			payload["temperature"] = *req.Temperature
+		}
+		if req.TopP != nil {
+			payload["top_p"] = *req.TopP
+		}
+		return payload
+	},
+	decode: func(body []byte) (string, int, int, error) {
+		var result struct {
+			Generation           string `json:"generation"`
+			PromptTokenCount     int    `json:"prompt_token_count"`
+			GenerationTokenCount int    `json:"generation_token_count"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return "", 0, 0, err
+		}
+		return result.Generation, result.PromptTokenCount, result.GenerationTokenCount, nil
+	},
+}
+
+// callBedrock invokes a model through the Bedrock runtime InvokeModel API,
+// signing the request with SigV4
+func (g *Gateway) callBedrock(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	if req.Model == "" {
+		return LLMResponse{}, fmt.Errorf("bedrock: a model ID is required")
+	}
+	adapter, err := bedrockAdapterFor(req.Model)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+
+	pc := g.config.Providers[Bedrock]
+	if pc.Region == "" || pc.AWS.AccessKeyID == "" || pc.AWS.SecretAccessKey == "" {
+		return LLMResponse{}, fmt.Errorf("bedrock: region and AWS credentials must be configured")
+	}
+	baseURL := pc.BaseURL
+	if baseURL == "" {
+		baseURL = "https://bedrock-runtime." + pc.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return LLMResponse{}, fmt.Errorf("bedrock: invalid base URL: %w", err)
+	}
+	// Model IDs contain ':', which must reach Bedrock escaped
+	endpoint.RawPath = endpoint.EscapedPath() + "/model/" + awsURIEncode(req.Model) + "/invoke"
+	endpoint.Path += "/model/" + req.Model + "/invoke"
+
+	body, err := json.Marshal(adapter.encode(req))
+	if err != nil {
+		return LLMResponse{}, fmt.Errorf("encoding bedrock request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return LLMResponse{}, fmt.Errorf("building bedrock request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+	signV4(httpReq, body, pc.AWS, pc.Region, "bedrock", time.Now())
+
+	resp, err := g.doUpstream(Bedrock, httpReq)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return LLMResponse{}, fmt.Errorf("reading bedrock response: %w", err)
+	}
+	text, promptTokens, completionTokens, err := adapter.decode(data)
+	if err != nil {
+		return LLMResponse{}, fmt.Errorf("decoding bedrock response: %w", err)
+	}
+
+	return LLMResponse{
+		Provider:   Bedrock,
+		Model:      req.Model,
+		Response:   text,
+		TokensUsed: promptTokens + completionTokens,
+
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+	}, nil
+}
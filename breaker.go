@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerPolicy controls when a provider's circuit breaker trips
+type BreakerPolicy struct {
+	FailureThreshold int           // consecutive failures before opening
+	Cooldown         time.Duration // how long to stay open before a trial request
+}
+
+// DefaultBreakerPolicy is used by NewGateway
+var DefaultBreakerPolicy = BreakerPolicy{
+	FailureThreshold: 5,
+	Cooldown:         30 * time.Second,
+}
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// ErrCircuitOpen is returned without calling the provider while its breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreaker tracks consecutive failures for one provider. Once the
+// threshold is reached it opens and rejects calls for the cooldown, then lets
+// a single trial call through (half-open) to decide whether to close again.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	policy   BreakerPolicy
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool // a half-open trial call is in flight
+}
+
+// NewCircuitBreaker creates a closed breaker
+func NewCircuitBreaker(policy BreakerPolicy) *CircuitBreaker {
+	return &CircuitBreaker{policy: policy}
+}
+
+// Allow reports whether a call may proceed, moving an open breaker to
+// half-open once the cooldown has passed
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) < cb.policy.Cooldown {
+			return ErrCircuitOpen
+		}
+		cb.state = BreakerHalfOpen
+		cb.trial = true
+		return nil
+	case BreakerHalfOpen:
+		if cb.trial {
+			return ErrCircuitOpen
+		}
+		cb.trial = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Record updates the breaker with the outcome of an allowed call
+func (cb *CircuitBreaker) Record(ctx context.Context, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	wasTrial := cb.trial
+	cb.trial = false
+
+	switch {
+	case err == nil:
+		cb.state = BreakerClosed
+		cb.failures = 0
+	case ctx.Err() != nil || !isOutage(err):
+		// The caller gave up or the request itself was bad; neither says
+		// anything about the provider's health
+	case wasTrial:
+		cb.state = BreakerOpen
+		cb.openedAt = time.Now()
+	default:
+		cb.failures++
+		if cb.failures >= cb.policy.FailureThreshold {
+			cb.state = BreakerOpen
+			cb.openedAt = time.Now()
+		}
+	}
+}
+
+// State returns the current breaker state
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// isOutage reports whether err reflects a provider problem rather than a
+// rejected request; 4xx responses other than 429 do not count
+func isOutage(err error) bool {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return upstream.StatusCode >= http.StatusInternalServerError ||
+			upstream.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// breaker returns the circuit breaker for a provider, creating it on first use
+func (g *Gateway) breaker(p ModelProvider) *CircuitBreaker {
+	g.breakersMu.Lock()
+	defer g.breakersMu.Unlock()
+
+	if g.breakers == nil {
+		g.breakers = make(map[ModelProvider]*CircuitBreaker)
+	}
+	cb, exists := g.breakers[p]
+	if !exists {
+		cb = NewCircuitBreaker(g.Breaker)
+		g.breakers[p] = cb
+	}
+	return cb
+}
+
+// breakerStates returns a snapshot of every known breaker's state
+func (g *Gateway) breakerStates() map[ModelProvider]BreakerState {
+	g.breakersMu.Lock()
+	defer g.breakersMu.Unlock()
+
+	states := make(map[ModelProvider]BreakerState, len(g.breakers))
+	for p, cb := range g.breakers {
+		states[p] = cb.State()
+	}
+	return states
+}
+
+// guardedCall runs call for a provider behind its circuit breaker, its
+// concurrency limit and its timeout, retrying transient failures according to
+// the gateway's retry policy. Time spent queued for a slot, behind any calls
+// of a higher priority, is bounded by ctx alone and never counts against the
+// provider. call must use the context it
+// is given.
+//
+// The slot is taken before asking the breaker, so a half-open trial it
+// grants is always settled by Record and can't be lost to a caller that
+// gave up while queued.
+func (g *Gateway) guardedCall(ctx context.Context, provider ModelProvider, priority Priority, call func(context.Context) error) error {
+	release, err := g.acquireSlot(ctx, provider, priority)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cb := g.breaker(provider)
+	if err := cb.Allow(); err != nil {
+		return fmt.Errorf("%s: %w", provider, err)
+	}
+
+	timeout := g.providerTimeout(provider)
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = g.withRetry(callCtx, provider, func() error {
+		return call(callCtx)
+	})
+	// Our own deadline expiring is a provider timeout; the caller's is not
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%s: %w after %v", provider, ErrProviderTimeout, timeout)
+	}
+	cb.Record(ctx, err)
+	return err
+}
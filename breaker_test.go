@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A caller that gives up while queued for a slot must not take the
+// half-open trial with it, or the breaker would stay open for good
+func TestGuardedCallQueuedCallerKeepsTrial(t *testing.T) {
+	g := NewGateway(WithoutRateLimit())
+	g.slots = map[ModelProvider]*providerSlots{OpenAI: newProviderSlots(1)}
+
+	cb := g.breaker(OpenAI)
+	cb.state, cb.openedAt = BreakerOpen, time.Now().Add(-time.Hour)
+
+	// Hold the only slot so the next call has to queue
+	release, err := g.acquireSlot(context.Background(), OpenAI, PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = g.guardedCall(ctx, OpenAI, PriorityNormal, func(context.Context) error {
+		t.Error("call ran without a slot")
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want a deadline while queued", err)
+	}
+	release()
+
+	var called bool
+	err = g.guardedCall(context.Background(), OpenAI, PriorityNormal, func(context.Context) error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Fatalf("trial call not let through: err = %v", err)
+	}
+	if s := cb.State(); s != BreakerClosed {
+		t.Errorf("state %v after a successful trial, want closed", s)
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores LLM responses keyed by cacheKeyFor. Implementations must be
+// safe for concurrent use.
+type Cache interface {
+	Get(key string) (LLMResponse, bool)
+	Set(key string, response LLMResponse, ttl time.Duration)
+	Close() error
+
+	// Len reports the number of stored entries
+	Len() int
+	// Clear removes every entry
+	Clear()
+	// DeleteByPrefix removes the entries whose key starts with prefix and
+	// reports how many were removed
+	DeleteByPrefix(prefix string) int
+}
+
+// StaleCache is implemented by caches that can keep entries past their TTL,
+// so an expired answer can stand in when every provider is failing
+type StaleCache interface {
+	Cache
+	// GetStale retrieves an entry even if it has expired
+	GetStale(key string) (LLMResponse, bool)
+}
+
+// SizedCache is implemented by caches that track how many bytes their
+// entries take up
+type SizedCache interface {
+	Cache
+	// Bytes reports the approximate size of the stored entries and MaxBytes
+	// the budget for them, 0 when there is none
+	Bytes() int
+	MaxBytes() int
+}
+
+// nopCache never stores anything; it stands in when caching is disabled
+type nopCache struct{}
+
+func (nopCache) Get(string) (LLMResponse, bool)         { return LLMResponse{}, false }
+func (nopCache) Set(string, LLMResponse, time.Duration) {}
+func (nopCache) Close() error                           { return nil }
+func (nopCache) Len() int                               { return 0 }
+func (nopCache) Clear()                                 {}
+func (nopCache) DeleteByPrefix(string) int              { return 0 }
+
+// KeyNormalization makes near-identical prompts share a cache entry.
+// Whitespace trims the text and collapses internal runs of whitespace to a
+// single space; Lowercase also folds case, which suits prompts where casing
+// doesn't change the answer.
+//
+// IgnoreProvider keys entries on the model family and prompt alone, so the
+// same model reached through different providers shares one entry. A model's
+// family is its entry in ModelFamilies, or the lowercased model name, e.g.
+// map both "anthropic.claude-3-haiku-20240307-v1:0" and
+// "claude-3-haiku-20240307" to "claude-3-haiku" to share Bedrock and
+// Anthropic answers.
+type KeyNormalization struct {
+	Whitespace bool `json:"whitespace"`
+	Lowercase  bool `json:"lowercase"`
+
+	IgnoreProvider bool              `json:"ignore_provider"`
+	ModelFamilies  map[string]string `json:"model_families,omitempty"`
+}
+
+// sharedKeyPrefix starts the keys of entries shared across providers
+const sharedKeyPrefix = "shared:"
+
+// family returns the name model is cached under when IgnoreProvider is set
+func (n KeyNormalization) family(model string) string {
+	if family, ok := n.ModelFamilies[model]; ok {
+		return family
+	}
+	return strings.ToLower(model)
+}
+
+// apply normalizes text for use in a cache key
+func (n KeyNormalization) apply(text string) string {
+	if n.Whitespace {
+		text = strings.Join(strings.Fields(text), " ")
+	}
+	if n.Lowercase {
+		text = strings.ToLower(text)
+	}
+	return text
+}
+
+// MemoryCache is an in-process LRU response cache. Entries live in a map for O(1) lookup and in
+// a doubly-linked list ordered from most to least recently used, so eviction
+// is O(1) as well.
+//
+// The entries are split by key hash across shards, each with its own lock,
+// map and list, so requests for different keys rarely wait on each other.
+// Each shard holds an equal part of the maximum size and evicts its own least
+// recently used entry, so with more than one shard eviction is LRU per shard
+// rather than across the whole cache.
+//
+// The cache keeps a running total of the approximate size of its entries,
+// see Bytes, and SetByteLimits can bound it by that as well as by count.
+// SetEviction switches eviction from LRU to LFU.
+type MemoryCache struct {
+	shards []*cacheShard
+
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	// snapshotPath is where Close saves the entries, if set
+	snapshotPath string
+}
+
+// cacheShard is one lock's worth of a MemoryCache
+type cacheShard struct {
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	order   *list.List
+	maxSize int
+
+	// bytes is the size of the entries held, maxBytes the shard's part of
+	// the byte budget and maxEntryBytes the largest entry stored; zero
+	// limits are off
+	bytes         int
+	maxBytes      int
+	maxEntryBytes int
+
+	// staleFor is how long expired entries are kept for GetStale
+	staleFor time.Duration
+
+	// lfu orders the entries for LFU eviction; nil under LRU, which
+	// evicts from the back of order
+	lfu *lfuIndex
+}
+
+type CacheEntry struct {
+	Response  LLMResponse
+	Timestamp time.Time
+	TTL       time.Duration
+}
+
+// cacheItem is the value stored in each list element
+type cacheItem struct {
+	key   string
+	entry CacheEntry
+	size  int
+
+	// hits and lfuElem are the entry's read count and place in the
+	// shard's lfuIndex, under LFU
+	hits    int
+	lfuElem *list.Element
+}
+
+// entryOverhead approximates the fixed cost of an entry: its struct, list
+// element, map slot and the JSON field names it would be written with
+const entryOverhead = 256
+
+// entrySize approximates what an entry takes up, close to the size of its
+// JSON encoding, from the lengths of its text without encoding it
+func entrySize(key string, response LLMResponse) int {
+	size := entryOverhead + len(key) + len(response.Provider) + len(response.Model) + len(response.Response)
+	for _, r := range response.Responses {
+		size += len(r)
+	}
+	for _, call := range response.ToolCalls {
+		size += len(call.ID) + len(call.Function.Name) + len(call.Function.Arguments)
+	}
+	return size
+}
+
+// NewCache creates a new cache instance with a single shard
+func NewCache(maxSize int) *MemoryCache {
+	return NewShardedCache(maxSize, 1)
+}
+
+// NewShardedCache creates a cache split into the given number of shards.
+// There are never more shards than entries, nor fewer than one.
+func NewShardedCache(maxSize, shards int) *MemoryCache {
+	if shards > maxSize {
+		shards = maxSize
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	c := &MemoryCache{shards: make([]*cacheShard, shards)}
+	for i := range c.shards {
+		// Spread the remainder so the shard sizes add up to maxSize
+		size := maxSize / shards
+		if i < maxSize%shards {
+			size++
+		}
+		c.shards[i] = &cacheShard{
+			items:   make(map[string]*list.Element),
+			order:   list.New(),
+			maxSize: size,
+		}
+	}
+	return c
+}
+
+// NewCacheWithJanitor creates a sharded cache that also purges expired
+// entries every sweepInterval in a background goroutine. Call Close to stop
+// it.
+func NewCacheWithJanitor(maxSize, shards int, sweepInterval time.Duration) *MemoryCache {
+	c := NewShardedCache(maxSize, shards)
+	c.stop = make(chan struct{})
+	go c.janitor(sweepInterval)
+	return c
+}
+
+// NewPersistentCache creates a cache with a janitor that is restored from the
+// snapshot at path and saved back there on Close. A missing or unreadable
+// snapshot is logged and the cache starts empty.
+func NewPersistentCache(maxSize, shards int, sweepInterval time.Duration, path string) *MemoryCache {
+	c := NewCacheWithJanitor(maxSize, shards, sweepInterval)
+	c.snapshotPath = path
+	if err := c.load(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("cache snapshot not restored", "err", err)
+	}
+	return c
+}
+
+// shard returns the shard that holds key, chosen by its FNV-1a hash
+func (c *MemoryCache) shard(key string) *cacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// snapshotEntry is one cache entry as stored in a snapshot file
+type snapshotEntry struct {
+	Key   string     `json:"key"`
+	Entry CacheEntry `json:"entry"`
+}
+
+// load restores entries from a snapshot, skipping any that have expired.
+// Entries are stored least recently used first, so replaying them in order
+// rebuilds the LRU order.
+func (c *MemoryCache) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries []snapshotEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	for _, e := range entries {
+		if time.Since(e.Entry.Timestamp) > e.Entry.TTL {
+			continue
+		}
+		c.shard(e.Key).put(e.Key, e.Entry, entrySize(e.Key, e.Entry.Response))
+	}
+	return nil
+}
+
+// save writes the entries still worth keeping to path, via a temporary file
+// so a crash mid-write never leaves a truncated snapshot. Each shard's entries
+// are written least recently used first.
+func (c *MemoryCache) save(path string) error {
+	var entries []snapshotEntry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for elem := s.order.Back(); elem != nil; elem = elem.Prev() {
+			item := elem.Value.(*cacheItem)
+			if !s.discardable(item.entry) {
+				entries = append(entries, snapshotEntry{Key: item.key, Entry: item.entry})
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// janitor periodically deletes expired entries until Close is called
+func (c *MemoryCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.purgeExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// purgeExpired removes every entry whose TTL, and stale window if one is
+// kept, has elapsed. Shards are swept one at a time, so requests only wait
+// for the shard being swept.
+func (c *MemoryCache) purgeExpired() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for elem := s.order.Front(); elem != nil; {
+			next := elem.Next()
+			if s.discardable(elem.Value.(*cacheItem).entry) {
+				s.removeElement(elem)
+			}
+			elem = next
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close stops the janitor goroutine, if one was started, and saves a snapshot
+// for persistent caches. It is safe to call more than once.
+func (c *MemoryCache) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+		}
+		if c.snapshotPath != "" {
+			if err = c.save(c.snapshotPath); err != nil {
+				err = fmt.Errorf("saving cache snapshot: %w", err)
+			}
+		}
+	})
+	return err
+}
+
+// Get retrieves from cache and marks the entry as recently used
+func (c *MemoryCache) Get(key string) (LLMResponse, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, exists := s.items[key]
+	if !exists {
+		return LLMResponse{}, false
+	}
+
+	// Drop expired entries as we find them, unless GetStale may want them
+	item := elem.Value.(*cacheItem)
+	if time.Since(item.entry.Timestamp) > item.entry.TTL {
+		if s.discardable(item.entry) {
+			s.removeElement(elem)
+		}
+		return LLMResponse{}, false
+	}
+
+	s.order.MoveToFront(elem)
+	if s.lfu != nil {
+		s.lfu.touch(elem)
+	}
+	return item.entry.Response, true
+}
+
+// KeepStale keeps entries for d after they expire so GetStale can still
+// return them. Get treats them as misses all the same.
+func (c *MemoryCache) KeepStale(d time.Duration) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.staleFor = d
+		s.mu.Unlock()
+	}
+}
+
+// SetByteLimits skips responses larger than maxEntry bytes and, with
+// maxTotal set, evicts least recently used entries to keep the cache within
+// that many bytes. Zero turns either limit off. Entries already stored are
+// not checked again.
+//
+// The budget is split evenly between the shards, rounding up so every shard
+// keeps a budget of at least a byte; a small maxTotal would otherwise leave
+// shards with none, which means no limit. Since an entry has to fit in its
+// shard's part, responses larger than maxTotal divided by the shard count
+// aren't cached.
+func (c *MemoryCache) SetByteLimits(maxEntry, maxTotal int) {
+	perShard := 0
+	if maxTotal > 0 {
+		perShard = (maxTotal + len(c.shards) - 1) / len(c.shards)
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.maxEntryBytes = maxEntry
+		s.maxBytes = perShard
+		s.mu.Unlock()
+	}
+}
+
+// SetEviction chooses how full shards make room. Switching to LFU counts
+// the entries already stored as read once.
+func (c *MemoryCache) SetEviction(policy EvictionPolicy) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		switch {
+		case policy == EvictLFU && s.lfu == nil:
+			s.lfu = newLFUIndex()
+			for elem := s.order.Back(); elem != nil; elem = elem.Prev() {
+				s.lfu.add(elem, 1)
+			}
+		case policy != EvictLFU:
+			s.lfu = nil
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Bytes reports the approximate size of the stored entries, including
+// expired ones not yet purged; see entrySize
+func (c *MemoryCache) Bytes() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.bytes
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// MaxBytes reports the byte budget set by SetByteLimits, 0 when there is
+// none. It is rounded up to a multiple of the shard count.
+func (c *MemoryCache) MaxBytes() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.maxBytes
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// GetStale retrieves an entry that may have expired, as long as it is within
+// the window set by KeepStale. It doesn't count as a use for the LRU order.
+func (c *MemoryCache) GetStale(key string) (LLMResponse, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, exists := s.items[key]
+	if !exists {
+		return LLMResponse{}, false
+	}
+	item := elem.Value.(*cacheItem)
+	if s.discardable(item.entry) {
+		return LLMResponse{}, false
+	}
+	return item.entry.Response, true
+}
+
+// Set stores in cache, evicting the least recently used entries of the key's
+// shard when it is full. Responses over the byte limits aren't stored.
+func (c *MemoryCache) Set(key string, response LLMResponse, ttl time.Duration) {
+	c.shard(key).put(key, CacheEntry{
+		Response:  response,
+		Timestamp: time.Now(),
+		TTL:       ttl,
+	}, entrySize(key, response))
+}
+
+// Len reports the number of entries, including expired ones not yet purged
+func (c *MemoryCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.order.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Clear removes every entry
+func (c *MemoryCache) Clear() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = make(map[string]*list.Element)
+		s.order.Init()
+		s.bytes = 0
+		if s.lfu != nil {
+			s.lfu = newLFUIndex()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// DeleteByPrefix removes every entry whose key starts with prefix
+func (c *MemoryCache) DeleteByPrefix(prefix string) int {
+	removed := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, elem := range s.items {
+			if strings.HasPrefix(key, prefix) {
+				s.removeElement(elem)
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// put stores entry under key as the most recently used, first evicting
+// entries until it fits within the shard's count and byte limits. An entry
+// of size bytes that could never fit is dropped, along with any older entry
+// under its key, rather than emptying the shard for it. Replacing an entry
+// keeps its LFU read count.
+func (s *cacheShard) put(key string, entry CacheEntry, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hits := 1
+	if elem, exists := s.items[key]; exists {
+		hits = elem.Value.(*cacheItem).hits
+		s.removeElement(elem)
+	}
+	if (s.maxEntryBytes > 0 && size > s.maxEntryBytes) || (s.maxBytes > 0 && size > s.maxBytes) {
+		slog.Debug("response too large to cache", "key", key, "bytes", size)
+		return
+	}
+
+	for s.order.Len() > 0 && (s.order.Len() >= s.maxSize || (s.maxBytes > 0 && s.bytes+size > s.maxBytes)) {
+		s.removeElement(s.victim())
+	}
+
+	elem := s.order.PushFront(&cacheItem{key: key, entry: entry, size: size})
+	s.items[key] = elem
+	s.bytes += size
+	if s.lfu != nil {
+		s.lfu.add(elem, hits)
+	}
+}
+
+// victim returns the entry to evict next; the caller holds s.mu and the
+// shard isn't empty
+func (s *cacheShard) victim() *list.Element {
+	if s.lfu != nil {
+		return s.lfu.victim()
+	}
+	return s.order.Back()
+}
+
+// discardable reports whether entry is past its TTL and stale window. The
+// caller holds s.mu.
+func (s *cacheShard) discardable(entry CacheEntry) bool {
+	return time.Since(entry.Timestamp) > entry.TTL+s.staleFor
+}
+
+// removeElement unlinks an entry; the caller must hold s.mu
+func (s *cacheShard) removeElement(elem *list.Element) {
+	item := elem.Value.(*cacheItem)
+	s.order.Remove(elem)
+	delete(s.items, item.key)
+	s.bytes -= item.size
+	if s.lfu != nil {
+		s.lfu.remove(elem)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A byte budget smaller than the shard count must still limit every shard
+// rather than leave them with none, which would mean no limit at all
+func TestCacheSmallByteBudget(t *testing.T) {
+	c := NewShardedCache(1000, 16)
+	c.SetByteLimits(0, 10)
+	if n := c.MaxBytes(); n != 16 {
+		t.Errorf("MaxBytes() = %d, want 10 rounded up to 16", n)
+	}
+
+	c.Set("k", LLMResponse{Response: "longer than a byte"}, time.Minute)
+	if _, ok := c.Get("k"); ok {
+		t.Error("entry larger than the budget was cached")
+	}
+	if n := c.Bytes(); n != 0 {
+		t.Errorf("Bytes() = %d, want 0", n)
+	}
+}
+
+// benchCacheSize is the cache size the benchmarks run at
+const benchCacheSize = 10000
+
+// benchKeys returns n distinct keys
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkMemoryCacheGet(b *testing.B) {
+	c := NewCache(benchCacheSize)
+	keys := benchKeys(benchCacheSize)
+	for _, k := range keys {
+		c.Set(k, LLMResponse{Response: "cached"}, time.Hour)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Get(keys[i%len(keys)])
+	}
+}
+
+// Every Set past the first benchCacheSize evicts an entry
+func BenchmarkMemoryCacheSet(b *testing.B) {
+	c := NewCache(benchCacheSize)
+	keys := benchKeys(2 * benchCacheSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Set(keys[i%len(keys)], LLMResponse{Response: "cached"}, time.Hour)
+	}
+}
+
+func TestKeyNormalizationApply(t *testing.T) {
+	tests := []struct {
+		name string
+		norm KeyNormalization
+		in   string
+		want string
+	}{
+		{"off", KeyNormalization{}, "  Hello\n\tWorld ", "  Hello\n\tWorld "},
+		{"whitespace", KeyNormalization{Whitespace: true}, "  Hello\n\tWorld ", "Hello World"},
+		{"lowercase", KeyNormalization{Lowercase: true}, " Hello  World", " hello  world"},
+		{"both", KeyNormalization{Whitespace: true, Lowercase: true}, "\tHELLO   world\n", "hello world"},
+		{"only whitespace", KeyNormalization{Whitespace: true}, " \n\t ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.norm.apply(tt.in); got != tt.want {
+				t.Errorf("apply(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheKeyNormalization(t *testing.T) {
+	both := KeyNormalization{Whitespace: true, Lowercase: true}
+	tests := []struct {
+		name     string
+		norm     KeyNormalization
+		a, b     string
+		wantSame bool
+	}{
+		{"identical", KeyNormalization{}, "Hello world", "Hello world", true},
+		{"whitespace without normalization", KeyNormalization{}, "Hello world", " Hello  world\n", false},
+		{"whitespace", KeyNormalization{Whitespace: true}, "Hello world", " Hello  world\n", true},
+		{"case without lowercase", KeyNormalization{Whitespace: true}, "Hello world", "hello world", false},
+		{"case", KeyNormalization{Lowercase: true}, "Hello world", "HELLO WORLD", true},
+		{"both", both, "Hello world", "  HELLO\tWorld ", true},
+		{"different words", both, "Hello world", "Hello there", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := cacheKeyFor(LLMRequest{Provider: OpenAI, Model: "gpt-4o", Prompt: tt.a}, tt.norm, "")
+			b := cacheKeyFor(LLMRequest{Provider: OpenAI, Model: "gpt-4o", Prompt: tt.b}, tt.norm, "")
+			if (a == b) != tt.wantSame {
+				t.Errorf("keys for %q and %q: same = %v, want %v", tt.a, tt.b, a == b, tt.wantSame)
+			}
+		})
+	}
+}
+
+// Normalization only changes the key; the provider gets the prompt as sent
+func TestNormalizedPromptsShareCacheEntry(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CacheKeys = KeyNormalization{Whitespace: true, Lowercase: true}
+	var prompts []string
+	srv := newTestServer(t, WithConfig(cfg), WithoutRateLimit(), WithProviderFunc(func(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+		prompts = append(prompts, req.Prompt)
+		return LLMResponse{Provider: req.Provider, Model: req.Model, Response: "stubbed"}, nil
+	}))
+
+	for _, prompt := range []string{`"  Hello\n World"`, `"hello world"`} {
+		resp := postJSON(t, srv, "/api/llm", `{"provider":"openai","model":"gpt-4o","prompt":`+prompt+`}`)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200", resp.StatusCode)
+		}
+	}
+	if len(prompts) != 1 || prompts[0] != "  Hello\n World" {
+		t.Errorf("provider got %q, want only the first prompt unchanged", prompts)
+	}
+}
+
+// BenchmarkMemoryCacheParallel compares a single lock with the default
+// sharding under many goroutines, reading mostly and writing one time in ten
+func BenchmarkMemoryCacheParallel(b *testing.B) {
+	keys := benchKeys(benchCacheSize)
+	for _, shards := range []int{1, DefaultConfig().CacheShards} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			c := NewShardedCache(benchCacheSize, shards)
+			for _, k := range keys {
+				c.Set(k, LLMResponse{Response: "cached"}, time.Hour)
+			}
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Intn(len(keys))
+				for pb.Next() {
+					k := keys[i%len(keys)]
+					if i%10 == 0 {
+						c.Set(k, LLMResponse{Response: "cached"}, time.Hour)
+					} else {
+						c.Get(k)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkEvictionHitRate replays a Zipf-distributed stream of lookups,
+// filling the cache on each miss, and reports the share of hits under each
+// eviction policy. The key space is ten times the cache size, so a policy
+// that keeps the few hot keys does best.
+func BenchmarkEvictionHitRate(b *testing.B) {
+	const size = 1000
+	keys := benchKeys(10 * size)
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictLFU} {
+		b.Run(string(policy), func(b *testing.B) {
+			c := NewCache(size)
+			c.SetEviction(policy)
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, uint64(len(keys)-1))
+			hits := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				k := keys[zipf.Uint64()]
+				if _, ok := c.Get(k); ok {
+					hits++
+				} else {
+					c.Set(k, LLMResponse{Response: "cached"}, time.Hour)
+				}
+			}
+			b.ReportMetric(float64(hits)/float64(b.N), "hit-rate")
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errCallbackTarget is returned for a callback that would reach an internal
+// address
+var errCallbackTarget = errors.New("callback_url must not point at a loopback, private or link-local address")
+
+// nonPublicPrefixes are ranges that aren't reachable on the internet but
+// aren't covered by the netip.Addr predicates
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+}
+
+// publicAddr reports whether addr may be the target of a job callback
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	return !containsAddr(nonPublicPrefixes, addr)
+}
+
+// checkCallbackURL rejects callback URLs that are not absolute http or https
+// URLs, and, unless allowPrivate, those whose host is an internal address or
+// localhost. Names are only resolved when the callback is made, where
+// newCallbackClient checks the address actually dialled.
+func checkCallbackURL(raw string, allowPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an absolute http or https URL")
+	}
+	if allowPrivate {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errCallbackTarget
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !publicAddr(addr) {
+		return errCallbackTarget
+	}
+	return nil
+}
+
+// newCallbackClient builds the client that delivers job callbacks. Unless
+// allowPrivate, every address it dials is checked, so a callback can't reach
+// internal services through a name that resolves to one or a redirect. It
+// dials directly, without the proxy settings of the upstream client, since
+// the check would otherwise see the proxy's address.
+func newCallbackClient(cfg HTTPClientConfig, allowPrivate bool) *http.Client {
+	def := DefaultHTTPClientConfig()
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = def.DialTimeout
+	}
+	if cfg.TLSHandshakeTimeout <= 0 {
+		cfg.TLSHandshakeTimeout = def.TLSHandshakeTimeout
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(cfg.DialTimeout)}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(addr) {
+				return fmt.Errorf("dialing %s: %w", addr, errCallbackTarget)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: time.Duration(cfg.TLSHandshakeTimeout),
+			IdleConnTimeout:     time.Duration(def.IdleConnTimeout),
+		},
+	}
+}
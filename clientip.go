@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const clientAddrKey contextKey = "client_addr"
+
+// clientAddrs resolves the address of the client behind a request from the
+// connection and, for connections from trusted proxies, the forwarding
+// headers
+type clientAddrs struct {
+	trusted []netip.Prefix
+}
+
+// resolve returns the client address for r. It reports false when a trusted
+// proxy forwarded an address that doesn't parse.
+//
+// A peer outside the trusted proxies is the client, whatever headers it
+// sends. Otherwise X-Forwarded-For is read from the right, since each proxy
+// appends the address it got the request from, and the first entry that
+// isn't a trusted proxy is the client. X-Real-IP is used when a trusted
+// proxy sends no X-Forwarded-For.
+func (c clientAddrs) resolve(r *http.Request) (netip.Addr, bool) {
+	addr, ok := peerAddr(r)
+	if !ok || !containsAddr(c.trusted, addr) {
+		return addr, ok
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) == 0 {
+		if real := r.Header.Get("X-Real-IP"); real != "" {
+			hops = []string{real}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = hop.Unmap()
+		if !containsAddr(c.trusted, addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// peerAddr returns the address of the immediate peer, without the port
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// ResolveClientIP records the client address of each request for ClientIP,
+// trusting forwarding headers only from Config.TrustedProxies. Wrap it
+// around everything that logs or limits by address.
+func (g *Gateway) ResolveClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An address that couldn't be resolved is stored as the zero Addr
+		addr, _ := g.clientAddrs.resolve(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientAddrKey, addr)))
+	})
+}
+
+// clientAddr returns the client address found by ResolveClientIP, or the
+// peer's when the request didn't pass through it. It reports false when the
+// address couldn't be determined.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	if addr, ok := r.Context().Value(clientAddrKey).(netip.Addr); ok {
+		return addr, addr.IsValid()
+	}
+	return peerAddr(r)
+}
+
+// ClientIP returns the IP address of the client behind r, without a port.
+// Behind trusted proxies it is the address they forwarded, see
+// ResolveClientIP. When no valid address can be found it falls back to
+// r.RemoteAddr.
+func ClientIP(r *http.Request) string {
+	if addr, ok := clientAddr(r); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientAddrsResolve(t *testing.T) {
+	resolver := clientAddrs{trusted: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		realIP     string
+		want       string
+		wantOK     bool
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.7:51234",
+			want:       "203.0.113.7", wantOK: true,
+		},
+		{
+			name:       "untrusted peer spoofing X-Forwarded-For",
+			remoteAddr: "203.0.113.7:51234",
+			xff:        []string{"1.2.3.4"},
+			want:       "203.0.113.7", wantOK: true,
+		},
+		{
+			name:       "untrusted peer spoofing X-Real-IP",
+			remoteAddr: "203.0.113.7:51234",
+			realIP:     "1.2.3.4",
+			want:       "203.0.113.7", wantOK: true,
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:443",
+			xff:        []string{"198.51.100.9"},
+			want:       "198.51.100.9", wantOK: true,
+		},
+		{
+			// The client prepended a fake hop; the proxy appended the
+			// address it really saw
+			name:       "client spoofing a hop behind a trusted proxy",
+			remoteAddr: "10.0.0.1:443",
+			xff:        []string{"1.2.3.4, 198.51.100.9"},
+			want:       "198.51.100.9", wantOK: true,
+		},
+		{
+			name:       "client claiming to be a trusted proxy",
+			remoteAddr: "10.0.0.1:443",
+			xff:        []string{"10.9.9.9, 198.51.100.9"},
+			want:       "198.51.100.9", wantOK: true,
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.0.0.1:443",
+			xff:        []string{"198.51.100.9, 10.0.0.2", "10.0.0.3"},
+			want:       "198.51.100.9", wantOK: true,
+		},
+		{
+			name:       "every hop trusted",
+			remoteAddr: "10.0.0.1:443",
+			xff:        []string{"10.0.0.2"},
+			want:       "10.0.0.2", wantOK: true,
+		},
+		{
+			name:       "X-Real-IP from a trusted proxy",
+			remoteAddr: "10.0.0.1:443",
+			realIP:     "198.51.100.9",
+			want:       "198.51.100.9", wantOK: true,
+		},
+		{
+			name:       "X-Forwarded-For wins over X-Real-IP",
+			remoteAddr: "10.0.0.1:443",
+			xff:        []string{"198.51.100.9"},
+			realIP:     "1.2.3.4",
+			want:       "198.51.100.9", wantOK: true,
+		},
+		{
+			name:       "garbage forwarded by a trusted proxy",
+			remoteAddr: "10.0.0.1:443",
+			xff:        []string{"not-an-ip"},
+			wantOK:     false,
+		},
+		{
+			name:       "IPv4-mapped and IPv6 hops",
+			remoteAddr: "[fd00::1]:443",
+			xff:        []string{"::ffff:198.51.100.9"},
+			want:       "198.51.100.9", wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/llm", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			addr, ok := resolver.resolve(r)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && addr.String() != tt.want {
+				t.Errorf("client %s, want %s", addr, tt.want)
+			}
+		})
+	}
+}
+
+// A client that changes its X-Forwarded-For on every request must still
+// share one rate limit bucket when it connects directly
+func TestSpoofedForwardedForSharesRateLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	var calls atomic.Int64
+	g := NewGateway(WithConfig(cfg), WithRateLimit(1, time.Hour), WithProviderFunc(stubProvider(&calls)))
+	defer g.Close()
+	h := g.Handler()
+
+	for i, spoofed := range []string{"1.1.1.1", "2.2.2.2"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/llm", strings.NewReader(testLLMRequest))
+		r.RemoteAddr = "203.0.113.7:51234"
+		r.Header.Set("X-Forwarded-For", spoofed)
+		r.Header.Set("X-Real-IP", spoofed)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if i == 0 && rec.Code != http.StatusOK {
+			t.Fatalf("first request got %d, want 200", rec.Code)
+		}
+		if i == 1 && rec.Code != http.StatusTooManyRequests {
+			t.Errorf("second request with a new spoofed address got %d, want 429", rec.Code)
+		}
+	}
+}
+
+// Unverified key headers don't pick the bucket, so rotating them doesn't get
+// around the limit; verified keys each get their own
+func TestRateLimitKeyedOnVerifiedKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []APIKeyConfig
+		headers  []string
+		wantLast int
+	}{
+		{"rotated keys without auth", nil, []string{"one", "two"}, http.StatusTooManyRequests},
+		{"two verified keys", []APIKeyConfig{{Key: "one"}, {Key: "two"}}, []string{"one", "two"}, http.StatusOK},
+		{"one verified key twice", []APIKeyConfig{{Key: "one"}}, []string{"one", "one"}, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.APIKeys = tt.keys
+			var calls atomic.Int64
+			g := NewGateway(WithConfig(cfg), WithRateLimit(1, time.Hour), WithProviderFunc(stubProvider(&calls)))
+			defer g.Close()
+			h := g.Handler()
+
+			var code int
+			for _, key := range tt.headers {
+				r := httptest.NewRequest(http.MethodPost, "/api/llm", strings.NewReader(testLLMRequest))
+				r.Header.Set("X-API-Key", key)
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+				code = rec.Code
+			}
+			if code != tt.wantLast {
+				t.Errorf("last request got %d, want %d", code, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestClientIPStripsPort(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "[2001:db8::1]:8080"
+	if ip := ClientIP(r); ip != "2001:db8::1" {
+		t.Errorf("ClientIP = %q, want the address without its port", ip)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest body worth compressing; below it the gzip
+// framing costs more than it saves
+const gzipMinSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// Gzip compresses responses for clients that accept gzip. Bodies are buffered
+// until they reach gzipMinSize, so small responses go out as is, and
+// server-sent event streams are never compressed so each event still reaches
+// the client as soon as it is flushed.
+func Gzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.finish()
+		next(gw, r)
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds the body back until it knows whether compressing
+// is worthwhile, then either starts a gzip stream or writes it through
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.gz != nil || w.passthrough {
+		return
+	}
+	w.status = status
+
+	// Streams and bodiless responses are sent uncompressed right away
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") ||
+		status == http.StatusNoContent || status == http.StatusNotModified {
+		w.startPassthrough()
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	switch {
+	case w.passthrough:
+		return w.ResponseWriter.Write(p)
+	case w.gz != nil:
+		return w.gz.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= gzipMinSize {
+		if err := w.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends whatever has been written so far. A body that is still being
+// buffered is sent uncompressed, since the handler wants it out now.
+func (w *gzipResponseWriter) Flush() {
+	switch {
+	case w.gz != nil:
+		w.gz.Flush()
+	case !w.passthrough:
+		w.startPassthrough()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) startGzip() error {
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	_, err := w.gz.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *gzipResponseWriter) startPassthrough() {
+	w.passthrough = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) > 0 {
+		w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+	}
+}
+
+// finish completes the response once the handler returns
+func (w *gzipResponseWriter) finish() {
+	switch {
+	case w.gz != nil:
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+	case !w.passthrough:
+		w.startPassthrough()
+	}
+}
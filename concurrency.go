@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Priority decides the order in which calls waiting for an upstream slot get
+// one: when a provider is saturated, the next free slot goes to the oldest
+// high priority call, then normal, then low. Calls already running are never
+// interrupted.
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// priorities lists every Priority from highest to lowest
+var priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// rank returns p's index in priorities, treating empty as normal, or -1 for
+// an unknown priority
+func (p Priority) rank() int {
+	if p == "" {
+		p = PriorityNormal
+	}
+	for i, q := range priorities {
+		if p == q {
+			return i
+		}
+	}
+	return -1
+}
+
+// requestPriority returns the priority req's upstream calls wait with. A
+// priority set on the API key is the default for its requests and the
+// highest they may ask for.
+func (g *Gateway) requestPriority(ctx context.Context, req LLMRequest) Priority {
+	p := req.Priority
+	if max, ok := g.priorities[APIKeyLabel(ctx)]; ok && (p == "" || p.rank() < max.rank()) {
+		p = max
+	}
+	if p == "" {
+		return PriorityNormal
+	}
+	return p
+}
+
+// providerSlots caps concurrent upstream calls to one provider. A limit of 0
+// means unlimited; active is tracked either way for metrics.
+type providerSlots struct {
+	limit  int
+	active atomic.Int64
+
+	mu   sync.Mutex
+	used int
+	// queues holds the calls waiting for a slot per priority rank, oldest
+	// first; a slot is handed over by closing the channel
+	queues [][]chan struct{}
+}
+
+// newProviderSlots creates slots for up to max concurrent calls; max <= 0 is unlimited
+func newProviderSlots(max int) *providerSlots {
+	if max < 0 {
+		max = 0
+	}
+	return &providerSlots{limit: max, queues: make([][]chan struct{}, len(priorities))}
+}
+
+// acquire waits for a free slot, queueing behind earlier calls of the same
+// or a higher priority
+func (s *providerSlots) acquire(ctx context.Context, priority Priority) error {
+	if s.limit == 0 {
+		s.active.Add(1)
+		return nil
+	}
+
+	rank := priority.rank()
+	if rank < 0 {
+		rank = PriorityNormal.rank()
+	}
+	s.mu.Lock()
+	if s.used < s.limit && s.waitingLocked() == 0 {
+		s.used++
+		s.mu.Unlock()
+		s.active.Add(1)
+		return nil
+	}
+	ready := make(chan struct{})
+	s.queues[rank] = append(s.queues[rank], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		s.active.Add(1)
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, c := range s.queues[rank] {
+			if c == ready {
+				s.queues[rank] = append(s.queues[rank][:i], s.queues[rank][i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// The slot was handed over just as ctx ended, so pass it on
+		s.handOffLocked()
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire
+func (s *providerSlots) release() {
+	s.active.Add(-1)
+	if s.limit == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.handOffLocked()
+	s.mu.Unlock()
+}
+
+// handOffLocked gives a freed slot to the highest priority waiting call, or
+// returns it to the pool when none is waiting
+func (s *providerSlots) handOffLocked() {
+	for rank, queue := range s.queues {
+		if len(queue) > 0 {
+			close(queue[0])
+			s.queues[rank] = queue[1:]
+			return
+		}
+	}
+	s.used--
+}
+
+func (s *providerSlots) waitingLocked() int {
+	n := 0
+	for _, queue := range s.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// waiting returns the number of calls queued for a slot per priority
+func (s *providerSlots) waiting() map[Priority]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[Priority]int64, len(priorities))
+	for rank, p := range priorities {
+		counts[p] = int64(len(s.queues[rank]))
+	}
+	return counts
+}
+
+// acquireSlot waits for a free slot to call provider, giving up when ctx is
+// done. The returned release must be called once the call finishes.
+func (g *Gateway) acquireSlot(ctx context.Context, provider ModelProvider, priority Priority) (release func(), err error) {
+	s := g.slots[provider]
+	if s == nil {
+		return func() {}, nil
+	}
+	if err := s.acquire(ctx, priority); err != nil {
+		return nil, fmt.Errorf("%s: waiting for a free upstream slot: %w", provider, err)
+	}
+	return s.release, nil
+}
+
+// upstreamInFlight reports the active and queued upstream calls per provider,
+// with the queued ones also broken down by priority
+func (g *Gateway) upstreamInFlight() map[ModelProvider]map[string]int64 {
+	counts := make(map[ModelProvider]map[string]int64, len(g.slots))
+	for p, s := range g.slots {
+		c := map[string]int64{
+			"active": s.active.Load(),
+			"limit":  int64(s.limit),
+		}
+		for priority, n := range s.waiting() {
+			c["waiting"] += n
+			c["waiting_"+string(priority)] = n
+		}
+		counts[p] = c
+	}
+	return counts
+}
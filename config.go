@@ -0,0 +1,607 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the gateway settings. It is loaded from an optional JSON file
+// and then overridden by environment variables, see LoadConfig.
+type Config struct {
+	Port string `json:"port"`
+
+	// AdminPort, when set, moves the metrics and cache admin endpoints off
+	// Port onto a listener of their own, e.g. "127.0.0.1:9090", so they can
+	// be kept off the internet. /health and /ready are served on both.
+	AdminPort string `json:"admin_port,omitempty"`
+
+	CacheMaxSize int      `json:"cache_max_size"`
+	CacheTTL     Duration `json:"cache_ttl"`
+
+	// CacheMaxEntryBytes skips caching responses larger than this, measured
+	// roughly as their JSON size, so one huge answer can't push out many
+	// small ones.
+	// CacheMaxBytes bounds the in-memory cache's total size as well as its
+	// entry count. It is split between the CacheShards, so responses larger
+	// than its share per shard aren't cached either. Zero turns either off.
+	CacheMaxEntryBytes int `json:"cache_max_entry_bytes,omitempty"`
+	CacheMaxBytes      int `json:"cache_max_bytes,omitempty"`
+
+	// CacheEviction is how the in-memory cache makes room: "lru", the
+	// default, or "lfu"; see EvictionPolicy
+	CacheEviction EvictionPolicy `json:"cache_eviction,omitempty"`
+
+	// CacheShards splits the in-memory cache into this many independently
+	// locked parts to cut contention under load; see MemoryCache
+	CacheShards int `json:"cache_shards"`
+
+	// CacheKeys controls how prompts are normalized for cache lookups
+	CacheKeys KeyNormalization `json:"cache_keys"`
+
+	// CacheVersion is mixed into every cache key. Bump it (in the config file
+	// or GATEWAY_CACHE_VERSION) after changing prompts to stop serving answers
+	// cached under the old ones, here and on any instance sharing the cache.
+	CacheVersion string `json:"cache_version,omitempty"`
+
+	// CacheMaxTemperature is the highest temperature whose responses are
+	// cached. Above it a request neither reads nor fills the cache, since
+	// replaying an answer would defeat asking for variety.
+	CacheMaxTemperature float64 `json:"cache_max_temperature"`
+
+	// StaleIfError keeps cached answers this long past their TTL and serves
+	// one, marked stale, when every provider fails for a request whose fresh
+	// entry has expired. Zero, the default, turns this off.
+	StaleIfError Duration `json:"stale_if_error,omitempty"`
+
+	// SemanticCache also serves cached answers to paraphrased prompts
+	SemanticCache SemanticCacheConfig `json:"semantic_cache"`
+
+	// Warmup lists requests sent on startup to fill the cache; see Warm
+	Warmup WarmupConfig `json:"warmup,omitempty"`
+
+	// CacheFile, when set, is where the in-memory cache is saved on shutdown
+	// and restored from on startup
+	CacheFile string `json:"cache_file,omitempty"`
+
+	RateLimit  int      `json:"rate_limit"`
+	RateWindow Duration `json:"rate_window"`
+
+	// RateQueue is how many requests per client may wait for the rate limit
+	// to free up before further ones get 429; 0 rejects immediately
+	RateQueue int `json:"rate_queue,omitempty"`
+
+	// MaxBodyBytes caps the size of a request body; larger ones get 413.
+	// 0 is unlimited.
+	MaxBodyBytes int `json:"max_body_bytes"`
+
+	// BatchMaxSize caps the requests in one /api/llm/batch call and
+	// BatchConcurrency how many of them run at once
+	BatchMaxSize     int `json:"batch_max_size"`
+	BatchConcurrency int `json:"batch_concurrency"`
+
+	// JobTTL is how long the result of an asynchronous request can be
+	// polled after it finishes
+	JobTTL Duration `json:"job_ttl"`
+
+	// CallbackAllowPrivate lets job callbacks reach loopback, private and
+	// link-local addresses. It is off by default so clients can't use the
+	// gateway to reach internal services or cloud metadata endpoints.
+	CallbackAllowPrivate bool `json:"callback_allow_private,omitempty"`
+
+	// IdempotencyTTL is how long the successful response to a request sent
+	// with an Idempotency-Key is replayed to retries; 0 ignores the header
+	IdempotencyTTL Duration `json:"idempotency_ttl"`
+
+	// RequestTimeout is how long a request may take when the client doesn't
+	// set its own timeout; 0 disables it
+	RequestTimeout Duration `json:"request_timeout"`
+
+	// TokenizerDir holds .tiktoken rank files for exact token counts; see
+	// Gateway.CountTokens. Without it every count is an estimate.
+	TokenizerDir string `json:"tokenizer_dir,omitempty"`
+
+	// RedisAddr switches the cache to a shared RedisCache when set
+	RedisAddr     string `json:"redis_addr,omitempty"`
+	RedisPassword string `json:"redis_password,omitempty"`
+
+	Providers map[ModelProvider]ProviderConfig `json:"providers"`
+
+	// DefaultProvider and DefaultModel are used for requests that leave
+	// them empty, so a bare prompt is enough. DefaultModel only applies to
+	// requests for DefaultProvider.
+	DefaultProvider ModelProvider `json:"default_provider,omitempty"`
+	DefaultModel    string        `json:"default_model,omitempty"`
+
+	// Templates are named prompt templates in text/template syntax, and
+	// TemplateDir a directory of more as <name>.tmpl files; see TemplateStore
+	Templates   map[string]string `json:"templates,omitempty"`
+	TemplateDir string            `json:"template_dir,omitempty"`
+
+	// APIKeys are the client keys accepted by RequireAuth; empty disables auth
+	APIKeys []APIKeyConfig `json:"api_keys,omitempty"`
+
+	// Pricing adds to or overrides the built-in per-model price table
+	Pricing map[string]ModelPrice `json:"pricing,omitempty"`
+
+	// ModelDefaults fill in parameters a request leaves unset, keyed by
+	// model name or prefix
+	ModelDefaults map[string]ModelDefaults `json:"model_defaults,omitempty"`
+
+	// Experiments route part of the traffic for a model to other models;
+	// see Experiment
+	Experiments []Experiment `json:"experiments,omitempty"`
+
+	// SystemPrompt is put first in every conversation sent upstream, ahead of
+	// anything the client sends. Clients may only add system messages of
+	// their own with AllowClientSystemPrompt. ModelDefaults can set a
+	// different one per model.
+	SystemPrompt            string `json:"system_prompt,omitempty"`
+	AllowClientSystemPrompt bool   `json:"allow_client_system_prompt,omitempty"`
+
+	// ContextWindows adds to or overrides the built-in table of how many
+	// tokens each model accepts; 0 disables the check for a model. Unlike
+	// the built-in names, these also cover models they are a prefix of.
+	ContextWindows map[string]int `json:"context_windows,omitempty"`
+
+	CORS CORSConfig `json:"cors"`
+
+	// HTTPClient tunes the connection pool used for upstream calls
+	HTTPClient HTTPClientConfig `json:"http_client"`
+
+	// Moderation checks prompts before they are sent upstream
+	Moderation ModerationConfig `json:"moderation,omitempty"`
+
+	// OutputModeration checks responses before they are returned and cached
+	OutputModeration OutputModerationConfig `json:"output_moderation,omitempty"`
+
+	// Audit logs redacted prompts and responses; see AuditConfig
+	Audit AuditConfig `json:"audit"`
+
+	// TrustedProxies are the load balancers and proxies, as CIDR ranges or
+	// single addresses, whose X-Forwarded-For and X-Real-IP headers are
+	// believed when working out a client's address; see ClientIP
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// IPFilter limits the client addresses served; see IPFilterConfig
+	IPFilter IPFilterConfig `json:"ip_filter,omitempty"`
+
+	// Shadow mirrors a sample of requests to another provider for
+	// comparison; see ShadowConfig
+	Shadow ShadowConfig `json:"shadow,omitempty"`
+
+	// TLS serves the public port over HTTPS; see TLSConfig
+	TLS TLSConfig `json:"tls,omitempty"`
+
+	// Tracing exports OpenTelemetry spans over OTLP; see TracingConfig
+	Tracing TracingConfig `json:"tracing,omitempty"`
+
+	// LogLevel is debug, info, warn or error; info when empty
+	LogLevel string `json:"log_level,omitempty"`
+
+	// AccessLog writes a line per HTTP request to stdout, whatever LogLevel is
+	AccessLog bool `json:"access_log,omitempty"`
+
+	// Access limits the providers and models clients may request; keys can
+	// override it with their own policy
+	Access AccessPolicy `json:"access,omitempty"`
+}
+
+// ProviderConfig holds the credentials and endpoint for one provider.
+// Backends, when set, replace APIKey and spread load across several keys
+// or endpoints; BaseURL is the default for backends that leave it empty.
+type ProviderConfig struct {
+	APIKey   string          `json:"api_key,omitempty"`
+	BaseURL  string          `json:"base_url,omitempty"`
+	Backends []BackendConfig `json:"backends,omitempty"`
+
+	// Timeout bounds each call to the provider, retries included
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// MaxConcurrent caps simultaneous calls to the provider; further calls
+	// wait for a slot for as long as their request allows. 0 is unlimited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// Models are listed by /api/providers; a built-in list is used when empty
+	Models []ModelConfig `json:"models,omitempty"`
+
+	// Deployment and APIVersion apply to Azure OpenAI only. Without a
+	// Deployment the request's model is used as the deployment name.
+	Deployment string `json:"deployment,omitempty"`
+	APIVersion string `json:"api_version,omitempty"`
+
+	// Region and AWS apply to Bedrock only
+	Region string         `json:"region,omitempty"`
+	AWS    AWSCredentials `json:"aws,omitempty"`
+
+	// Mock scripts the mock provider
+	Mock MockConfig `json:"mock,omitempty"`
+}
+
+// Duration is a time.Duration that reads from JSON as a string like "1h30m"
+// or as a number of seconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string or number of seconds: %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		Port:                ":8080",
+		CacheMaxSize:        1000,
+		CacheShards:         16,
+		CacheTTL:            Duration(time.Hour),
+		CacheMaxTemperature: 1,
+		RateLimit:           100,
+		RateWindow:          Duration(time.Minute),
+		RequestTimeout:      Duration(2 * time.Minute),
+		JobTTL:              Duration(time.Hour),
+		IdempotencyTTL:      Duration(24 * time.Hour),
+		MaxBodyBytes:        4 << 20,
+		BatchMaxSize:        100,
+		BatchConcurrency:    4,
+		CORS:                DefaultCORSConfig(),
+		HTTPClient:          DefaultHTTPClientConfig(),
+		Providers: map[ModelProvider]ProviderConfig{
+			OpenAI: {BaseURL: defaultOpenAIBaseURL},
+		},
+	}
+}
+
+// LoadConfig builds a Config from the defaults, then the JSON file at path
+// (skipped when path is empty), then environment variables:
+//
+//	GATEWAY_PORT, GATEWAY_ADMIN_PORT, GATEWAY_TLS_CERT_FILE, GATEWAY_TLS_KEY_FILE,
+//	GATEWAY_AUTOCERT_HOSTS (comma-separated), GATEWAY_TLS_REDIRECT_PORT,
+//	GATEWAY_IP_ALLOW, GATEWAY_IP_DENY, GATEWAY_TRUSTED_PROXIES (comma-separated), GATEWAY_CACHE_MAX_SIZE, GATEWAY_CACHE_TTL, GATEWAY_CACHE_VERSION,
+//	GATEWAY_CACHE_SHARDS, GATEWAY_CACHE_EVICTION, GATEWAY_CACHE_MAX_ENTRY_BYTES, GATEWAY_CACHE_MAX_BYTES,
+//	GATEWAY_CACHE_MAX_TEMPERATURE, GATEWAY_STALE_IF_ERROR,
+//	GATEWAY_CACHE_FILE, GATEWAY_TOKENIZER_DIR, GATEWAY_TEMPLATE_DIR, GATEWAY_AUDIT_SINK,
+//	GATEWAY_LOG_LEVEL, GATEWAY_ACCESS_LOG (true or false),
+//	GATEWAY_DEFAULT_PROVIDER, GATEWAY_DEFAULT_MODEL,
+//	GATEWAY_RATE_LIMIT, GATEWAY_RATE_WINDOW, GATEWAY_RATE_QUEUE, GATEWAY_REQUEST_TIMEOUT,
+//	GATEWAY_MAX_BODY_BYTES, GATEWAY_IDEMPOTENCY_TTL, GATEWAY_MAX_IDLE_CONNS_PER_HOST,
+//	GATEWAY_CALLBACK_ALLOW_PRIVATE (true or false),
+//	REDIS_ADDR, REDIS_PASSWORD, OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_SERVICE_NAME,
+//	GATEWAY_CORS_ORIGINS (comma-separated, replaces the configured list),
+//	GATEWAY_API_KEYS (comma-separated key or key:label entries, added to
+//	any keys from the file), <PROVIDER>_API_KEY / <PROVIDER>_BASE_URL,
+//	e.g. OPENAI_API_KEY or AZURE_BASE_URL, and for Bedrock AWS_REGION (or
+//	AWS_DEFAULT_REGION), AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+//	AWS_SESSION_TOKEN
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	if cfg.AdminPort != "" && cfg.AdminPort == cfg.Port {
+		return cfg, fmt.Errorf("admin_port %s is the same as port", cfg.AdminPort)
+	}
+	if cfg.RateLimit <= 0 || cfg.RateWindow <= 0 {
+		return cfg, fmt.Errorf("rate_limit and rate_window must be positive, got %d per %s", cfg.RateLimit, time.Duration(cfg.RateWindow))
+	}
+	if cfg.CacheMaxSize <= 0 || cfg.CacheShards <= 0 {
+		return cfg, fmt.Errorf("cache_max_size and cache_shards must be positive, got %d and %d", cfg.CacheMaxSize, cfg.CacheShards)
+	}
+	if err := cfg.CacheEviction.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Shadow.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.TLS.validate(); err != nil {
+		return cfg, err
+	}
+	if _, err := parsePrefixes("trusted_proxies", cfg.TrustedProxies); err != nil {
+		return cfg, err
+	}
+	if _, err := newIPFilter(cfg.IPFilter); err != nil {
+		return cfg, err
+	}
+	for _, k := range cfg.APIKeys {
+		if k.Priority.rank() < 0 {
+			return cfg, fmt.Errorf("api key %s: unknown priority %q", k.Label, k.Priority)
+		}
+	}
+	names := make(map[string]bool)
+	models := make(map[string]bool)
+	for _, e := range cfg.Experiments {
+		if err := e.validate(); err != nil {
+			return cfg, err
+		}
+		if names[e.Name] {
+			return cfg, fmt.Errorf("duplicate experiment %q", e.Name)
+		}
+		if models[e.Model] {
+			return cfg, fmt.Errorf("experiment %s: another experiment already runs on %q", e.Name, e.Model)
+		}
+		names[e.Name], models[e.Model] = true, true
+	}
+	if err := cfg.Moderation.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.OutputModeration.validate(); err != nil {
+		return cfg, fmt.Errorf("output moderation: %w", err)
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides cfg with any environment variables that are set
+func (cfg *Config) applyEnv() error {
+	if v := os.Getenv("GATEWAY_PORT"); v != "" {
+		if !strings.Contains(v, ":") {
+			v = ":" + v
+		}
+		cfg.Port = v
+	}
+	if v := os.Getenv("GATEWAY_ADMIN_PORT"); v != "" {
+		if !strings.Contains(v, ":") {
+			v = ":" + v
+		}
+		cfg.AdminPort = v
+	}
+	if v := os.Getenv("GATEWAY_TLS_CERT_FILE"); v != "" {
+		cfg.TLS.CertFile = v
+	}
+	if v := os.Getenv("GATEWAY_TLS_KEY_FILE"); v != "" {
+		cfg.TLS.KeyFile = v
+	}
+	envList("GATEWAY_AUTOCERT_HOSTS", &cfg.TLS.AutocertHosts)
+	envList("GATEWAY_IP_ALLOW", &cfg.IPFilter.Allow)
+	envList("GATEWAY_IP_DENY", &cfg.IPFilter.Deny)
+	envList("GATEWAY_TRUSTED_PROXIES", &cfg.TrustedProxies)
+	if v := os.Getenv("GATEWAY_TLS_REDIRECT_PORT"); v != "" {
+		if !strings.Contains(v, ":") {
+			v = ":" + v
+		}
+		cfg.TLS.RedirectPort = v
+	}
+	if err := envInt("GATEWAY_CACHE_MAX_SIZE", &cfg.CacheMaxSize); err != nil {
+		return err
+	}
+	if err := envDuration("GATEWAY_CACHE_TTL", &cfg.CacheTTL); err != nil {
+		return err
+	}
+	if err := envInt("GATEWAY_CACHE_SHARDS", &cfg.CacheShards); err != nil {
+		return err
+	}
+	if v := os.Getenv("GATEWAY_CACHE_EVICTION"); v != "" {
+		cfg.CacheEviction = EvictionPolicy(strings.ToLower(v))
+	}
+	if err := envInt("GATEWAY_CACHE_MAX_ENTRY_BYTES", &cfg.CacheMaxEntryBytes); err != nil {
+		return err
+	}
+	if err := envInt("GATEWAY_CACHE_MAX_BYTES", &cfg.CacheMaxBytes); err != nil {
+		return err
+	}
+	if v := os.Getenv("GATEWAY_CACHE_VERSION"); v != "" {
+		cfg.CacheVersion = v
+	}
+	if err := envFloat("GATEWAY_CACHE_MAX_TEMPERATURE", &cfg.CacheMaxTemperature); err != nil {
+		return err
+	}
+	if err := envDuration("GATEWAY_STALE_IF_ERROR", &cfg.StaleIfError); err != nil {
+		return err
+	}
+	if v := os.Getenv("GATEWAY_CACHE_FILE"); v != "" {
+		cfg.CacheFile = v
+	}
+	if err := envInt("GATEWAY_MAX_BODY_BYTES", &cfg.MaxBodyBytes); err != nil {
+		return err
+	}
+	if err := envInt("GATEWAY_MAX_IDLE_CONNS_PER_HOST", &cfg.HTTPClient.MaxIdleConnsPerHost); err != nil {
+		return err
+	}
+	if err := envDuration("GATEWAY_IDEMPOTENCY_TTL", &cfg.IdempotencyTTL); err != nil {
+		return err
+	}
+	if err := envBool("GATEWAY_CALLBACK_ALLOW_PRIVATE", &cfg.CallbackAllowPrivate); err != nil {
+		return err
+	}
+	if err := envInt("GATEWAY_RATE_LIMIT", &cfg.RateLimit); err != nil {
+		return err
+	}
+	if err := envDuration("GATEWAY_RATE_WINDOW", &cfg.RateWindow); err != nil {
+		return err
+	}
+	if err := envInt("GATEWAY_RATE_QUEUE", &cfg.RateQueue); err != nil {
+		return err
+	}
+	if err := envDuration("GATEWAY_REQUEST_TIMEOUT", &cfg.RequestTimeout); err != nil {
+		return err
+	}
+	if v := os.Getenv("GATEWAY_TOKENIZER_DIR"); v != "" {
+		cfg.TokenizerDir = v
+	}
+	if v := os.Getenv("GATEWAY_TEMPLATE_DIR"); v != "" {
+		cfg.TemplateDir = v
+	}
+	if v := os.Getenv("GATEWAY_AUDIT_SINK"); v != "" {
+		cfg.Audit.Sink = v
+	}
+	if v := os.Getenv("GATEWAY_DEFAULT_PROVIDER"); v != "" {
+		cfg.DefaultProvider = ModelProvider(v)
+	}
+	if v := os.Getenv("GATEWAY_DEFAULT_MODEL"); v != "" {
+		cfg.DefaultModel = v
+	}
+	if v := os.Getenv("GATEWAY_LOG_LEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+	if err := envBool("GATEWAY_ACCESS_LOG", &cfg.AccessLog); err != nil {
+		return err
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		cfg.Tracing.Endpoint = v
+	}
+	if v := os.Getenv("OTEL_SERVICE_NAME"); v != "" {
+		cfg.Tracing.ServiceName = v
+	}
+	if v := os.Getenv("REDIS_ADDR"); v != "" {
+		cfg.RedisAddr = v
+	}
+	if v := os.Getenv("REDIS_PASSWORD"); v != "" {
+		cfg.RedisPassword = v
+	}
+
+	if v := os.Getenv("GATEWAY_CORS_ORIGINS"); v != "" {
+		cfg.CORS.AllowedOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cfg.CORS.AllowedOrigins = append(cfg.CORS.AllowedOrigins, origin)
+			}
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("GATEWAY_API_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, label, _ := strings.Cut(entry, ":")
+		cfg.APIKeys = append(cfg.APIKeys, APIKeyConfig{Key: key, Label: label})
+	}
+
+	if cfg.Providers == nil {
+		cfg.Providers = make(map[ModelProvider]ProviderConfig)
+	}
+	// A provider only gets an entry when the file or the environment
+	// configures it, since an entry is what marks it as configured
+	for _, p := range []ModelProvider{OpenAI, Anthropic, Google, DeepSeek, AzureOpenAI, Ollama, Bedrock} {
+		prefix := strings.ToUpper(string(p))
+		pc, set := cfg.Providers[p]
+		if v := os.Getenv(prefix + "_API_KEY"); v != "" {
+			pc.APIKey, set = v, true
+		}
+		if v := os.Getenv(prefix + "_BASE_URL"); v != "" {
+			pc.BaseURL, set = v, true
+		}
+		if set {
+			cfg.Providers[p] = pc
+		}
+	}
+
+	// Bedrock uses the standard AWS variables
+	pc, set := cfg.Providers[Bedrock]
+	if v := os.Getenv("AWS_REGION"); v != "" {
+		pc.Region, set = v, true
+	} else if v := os.Getenv("AWS_DEFAULT_REGION"); v != "" && pc.Region == "" {
+		pc.Region, set = v, true
+	}
+	if v := os.Getenv("AWS_ACCESS_KEY_ID"); v != "" {
+		pc.AWS = AWSCredentials{
+			AccessKeyID:     v,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		set = true
+	}
+	if set {
+		cfg.Providers[Bedrock] = pc
+	}
+	return nil
+}
+
+func envInt(key string, dst *int) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = n
+	return nil
+}
+
+// envList replaces *dst with the comma-separated entries of key, if set
+func envList(key string, dst *[]string) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	*dst = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+}
+
+func envBool(key string, dst *bool) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = b
+	return nil
+}
+
+func envFloat(key string, dst *float64) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = f
+	return nil
+}
+
+func envDuration(key string, dst *Duration) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = Duration(d)
+	return nil
+}
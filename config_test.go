@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigRejectsNonPositiveCacheSizes(t *testing.T) {
+	for _, env := range []string{"GATEWAY_CACHE_MAX_SIZE", "GATEWAY_CACHE_SHARDS"} {
+		for _, v := range []string{"0", "-1"} {
+			t.Run(env+"="+v, func(t *testing.T) {
+				t.Setenv(env, v)
+				if _, err := LoadConfig(""); err == nil {
+					t.Errorf("LoadConfig accepted %s=%s", env, v)
+				}
+			})
+		}
+	}
+}
+
+// Providers without any settings must not appear configured
+func TestLoadConfigOnlyConfiguredProviders(t *testing.T) {
+	for _, p := range []ModelProvider{OpenAI, Anthropic, Google, DeepSeek, AzureOpenAI, Ollama, Bedrock} {
+		t.Setenv(strings.ToUpper(string(p))+"_API_KEY", "")
+		t.Setenv(strings.ToUpper(string(p))+"_BASE_URL", "")
+	}
+	for _, v := range []string{"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID"} {
+		t.Setenv(v, "")
+	}
+	t.Setenv("ANTHROPIC_API_KEY", "sk-test")
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Providers[Anthropic].APIKey; got != "sk-test" {
+		t.Errorf("anthropic API key %q, want it from the environment", got)
+	}
+	for _, p := range []ModelProvider{Google, DeepSeek, AzureOpenAI, Ollama, Bedrock} {
+		if _, ok := cfg.Providers[p]; ok {
+			t.Errorf("%s has an entry without any settings", p)
+		}
+	}
+}
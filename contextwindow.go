@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultContextWindows is the number of tokens common models accept, prompt
+// and completion together. Config.ContextWindows entries override it. Names
+// match exactly: a variant such as gpt-4-32k may accept far more than its
+// family, so it is only checked once listed.
+var defaultContextWindows = map[string]int{
+	"gpt-4o":                     128000,
+	"gpt-4o-mini":                128000,
+	"gpt-4.1":                    1047576,
+	"gpt-4-turbo":                128000,
+	"gpt-4":                      8192,
+	"gpt-4-32k":                  32768,
+	"gpt-3.5-turbo":              16385,
+	"claude-3-5-sonnet-20241022": 200000,
+	"claude-3-5-haiku-20241022":  200000,
+	"claude-3-opus-20240229":     200000,
+	"claude-sonnet-4-5":          200000,
+	"gemini-2.0-flash":           1048576,
+	"deepseek-chat":              128000,
+}
+
+// contextWindow returns a model's context window, or 0 when it is unknown. A
+// context_window set on the provider's model config wins; otherwise the table
+// is matched by exact name and then by the longest prefix among the
+// Config.ContextWindows entries, never the built-in ones.
+func (g *Gateway) contextWindow(p ModelProvider, model string) int {
+	if m, ok := g.modelConfig(p, model); ok && m.ContextWindow > 0 {
+		return m.ContextWindow
+	}
+
+	if window, ok := g.contextWindows[model]; ok {
+		return window
+	}
+	var best string
+	for name := range g.config.ContextWindows {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	return g.config.ContextWindows[best]
+}
+
+// checkTokenLimit rejects a request whose prompt and max_tokens together
+// exceed its model's context window, before any upstream call is made
+func (g *Gateway) checkTokenLimit(req LLMRequest) *ValidationError {
+	limit := g.contextWindow(req.Provider, req.Model)
+	if limit == 0 {
+		return nil
+	}
+	if prompt := g.promptTokens(req); prompt+req.MaxTokens > limit {
+		return &ValidationError{
+			Field:   "max_tokens",
+			Message: fmt.Sprintf("prompt of %d tokens plus max_tokens of %d exceeds the %d token context window of %s", prompt, req.MaxTokens, limit, req.Model),
+		}
+	}
+	return nil
+}
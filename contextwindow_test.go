@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContextWindow(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ContextWindows = map[string]int{"ft:gpt-4o": 1000}
+	g := NewGateway(WithConfig(cfg), WithoutRateLimit())
+	defer g.Close()
+
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{"gpt-4", 8192},
+		{"gpt-4-32k", 32768},
+		// An unlisted variant mustn't inherit its family's smaller window
+		{"gpt-4-32k-0613", 0},
+		{"gpt-4o-2024-08-06", 0},
+		{"ft:gpt-4o:acme::abc123", 1000},
+		{"unknown", 0},
+	}
+	for _, tt := range tests {
+		if got := g.contextWindow(OpenAI, tt.model); got != tt.want {
+			t.Errorf("contextWindow(%q) = %d, want %d", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTokenLimitUnlistedVariant(t *testing.T) {
+	g := NewGateway(WithoutRateLimit())
+	defer g.Close()
+
+	req := LLMRequest{Provider: OpenAI, Model: "gpt-4-32k-0613", Prompt: strings.Repeat("word ", 10000)}
+	if err := g.checkTokenLimit(req); err != nil {
+		t.Errorf("unlisted variant rejected: %s", err.Message)
+	}
+	req.Model = "gpt-4"
+	if err := g.checkTokenLimit(req); err == nil {
+		t.Error("prompt over gpt-4's window accepted")
+	}
+}
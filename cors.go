@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig controls which browser origins may call the gateway. An origin
+// of "*" allows any origin.
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+
+	// MaxAge is how long browsers may cache a preflight result
+	MaxAge Duration `json:"max_age,omitempty"`
+}
+
+// DefaultCORSConfig allows any origin to call the API with the headers the
+// gateway understands
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key", "Cache-Control", "Idempotency-Key", "X-Timeout-Ms", "X-Request-ID", "traceparent"},
+		MaxAge:         Duration(10 * time.Minute),
+	}
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" when the origin is not allowed
+func (c CORSConfig) allowedOrigin(origin string) string {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// CORS adds CORS headers for allowed origins. Requests from other origins get
+// no CORS headers, so browsers refuse to expose the response. Every OPTIONS
+// request is answered here with 204, before auth, rate limiting or body
+// parsing; wrap it outside RequireAuth because browsers never send
+// credentials on a preflight.
+func (g *Gateway) CORS(next http.HandlerFunc) http.HandlerFunc {
+	cors := g.config.CORS
+	methods := strings.Join(cors.AllowedMethods, ", ")
+	headers := strings.Join(cors.AllowedHeaders, ", ")
+	maxAge := strconv.Itoa(int(time.Duration(cors.MaxAge).Seconds()))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		allowOrigin := ""
+		if origin != "" {
+			allowOrigin = cors.allowedOrigin(origin)
+		}
+		if allowOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			w.Header().Set("Access-Control-Expose-Headers", "X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After, X-Request-ID, Idempotent-Replayed")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", methods)
+			if allowOrigin != "" {
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Browsers must be able to send and read every header the gateway acts on
+func TestCORSPreflightAllowsGatewayHeaders(t *testing.T) {
+	h := NewGateway(WithoutRateLimit()).Handler()
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/llm", nil)
+	req.Header.Set("Origin", "https://app.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	allowed := strings.ToLower(rec.Header().Get("Access-Control-Allow-Headers"))
+	for _, header := range []string{"Idempotency-Key", "X-Timeout-Ms", "X-Request-ID", "traceparent"} {
+		if !strings.Contains(allowed, strings.ToLower(header)) {
+			t.Errorf("preflight doesn't allow %s: %q", header, allowed)
+		}
+	}
+	if exposed := rec.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "X-Request-ID") {
+		t.Errorf("X-Request-ID not exposed: %q", exposed)
+	}
+}
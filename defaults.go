@@ -0,0 +1,77 @@
+package main
+
+import "strings"
+
+// ModelDefaults are the parameters used for a model when a request leaves
+// them unset. MaxTokens counts as unset when zero.
+type ModelDefaults struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+
+	// SystemPrompt replaces Config.SystemPrompt for the model
+	SystemPrompt string `json:"system_prompt,omitempty"`
+}
+
+// modelDefaults returns the configured defaults for a model, matching the
+// longest prefix like priceFor so dated variants share their family's entry
+func (g *Gateway) modelDefaults(model string) (ModelDefaults, bool) {
+	if d, ok := g.config.ModelDefaults[model]; ok {
+		return d, true
+	}
+	var best string
+	for name := range g.config.ModelDefaults {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelDefaults{}, false
+	}
+	return g.config.ModelDefaults[best], true
+}
+
+// applyDefaults fills in the fields of req the client left unset: the
+// provider and model from Config.DefaultProvider and DefaultModel, then the
+// parameters from the defaults for the model, and max_tokens failing those
+// from the provider's model config. The default model is only used with the
+// default provider. Values the client sent always win, except for the system
+// prompt, which clients can't change.
+func (g *Gateway) applyDefaults(req *LLMRequest) {
+	if req.Provider == "" {
+		req.Provider = g.config.DefaultProvider
+	}
+	if req.Model == "" && req.Provider == g.config.DefaultProvider {
+		req.Model = g.config.DefaultModel
+	}
+
+	req.system = g.config.SystemPrompt
+	if d, ok := g.modelDefaults(req.Model); ok {
+		applyModelDefaults(req, d)
+	}
+	if m, ok := g.modelConfig(req.Provider, req.Model); ok && req.MaxTokens == 0 {
+		req.MaxTokens = m.MaxTokens
+	}
+}
+
+// applyModelDefaults fills in the parameters of req left unset from d
+func applyModelDefaults(req *LLMRequest, d ModelDefaults) {
+	if d.SystemPrompt != "" {
+		req.system = d.SystemPrompt
+	}
+	if req.Temperature == nil && d.Temperature != nil {
+		temperature := *d.Temperature
+		req.Temperature = &temperature
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = d.MaxTokens
+	}
+	if req.TopP == nil && d.TopP != nil {
+		topP := *d.TopP
+		req.TopP = &topP
+	}
+	if len(req.Stop) == 0 && len(d.Stop) > 0 {
+		req.Stop = append([]string(nil), d.Stop...)
+	}
+}
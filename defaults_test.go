@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyDefaults(t *testing.T) {
+	topP := 0.9
+	temperature := 0.7
+	cfg := DefaultConfig()
+	cfg.DefaultProvider, cfg.DefaultModel = OpenAI, "gpt-4o"
+	cfg.ModelDefaults = map[string]ModelDefaults{
+		"gpt-4o": {Temperature: &temperature, MaxTokens: 256, TopP: &topP, Stop: []string{"END"}},
+	}
+	g := NewGateway(WithConfig(cfg), WithoutRateLimit())
+
+	tests := []struct {
+		name string
+		body string
+		want LLMRequest
+	}{
+		{
+			name: "unset fields take the defaults",
+			body: `{"prompt":"hi"}`,
+			want: LLMRequest{Prompt: "hi", Provider: OpenAI, Model: "gpt-4o", Temperature: &temperature, MaxTokens: 256, TopP: &topP, Stop: []string{"END"}},
+		},
+		{
+			name: "an explicit zero temperature wins",
+			body: `{"prompt":"hi","temperature":0}`,
+			want: LLMRequest{Prompt: "hi", Provider: OpenAI, Model: "gpt-4o", Temperature: ptr(0.0), MaxTokens: 256, TopP: &topP, Stop: []string{"END"}},
+		},
+		{
+			name: "explicit values win",
+			body: `{"prompt":"hi","temperature":1.5,"max_tokens":10,"top_p":0.5,"stop":["x"]}`,
+			want: LLMRequest{Prompt: "hi", Provider: OpenAI, Model: "gpt-4o", Temperature: ptr(1.5), MaxTokens: 10, TopP: ptr(0.5), Stop: []string{"x"}},
+		},
+		{
+			name: "dated variants share their family's defaults",
+			body: `{"prompt":"hi","model":"gpt-4o-2024-08-06"}`,
+			want: LLMRequest{Prompt: "hi", Provider: OpenAI, Model: "gpt-4o-2024-08-06", Temperature: &temperature, MaxTokens: 256, TopP: &topP, Stop: []string{"END"}},
+		},
+		{
+			name: "other providers don't get the default model",
+			body: `{"prompt":"hi","provider":"anthropic"}`,
+			want: LLMRequest{Prompt: "hi", Provider: Anthropic},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req LLMRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatal(err)
+			}
+			g.applyDefaults(&req)
+			req.system = ""
+			if !reflect.DeepEqual(req, tt.want) {
+				got, _ := json.Marshal(req)
+				want, _ := json.Marshal(tt.want)
+				t.Errorf("got  %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+// Defaults are copied, so changing a request's parameters leaves them alone
+func TestApplyDefaultsCopies(t *testing.T) {
+	temperature := 0.7
+	cfg := DefaultConfig()
+	cfg.ModelDefaults = map[string]ModelDefaults{"m": {Temperature: &temperature, Stop: []string{"END"}}}
+	g := NewGateway(WithConfig(cfg), WithoutRateLimit())
+
+	req := LLMRequest{Provider: OpenAI, Model: "m"}
+	g.applyDefaults(&req)
+	*req.Temperature = 2
+	req.Stop[0] = "changed"
+	if d := cfg.ModelDefaults["m"]; *d.Temperature != 0.7 || d.Stop[0] != "END" {
+		t.Errorf("defaults changed through a request: %+v", d)
+	}
+}
+
+// A provider's model config supplies max_tokens when neither the request nor
+// ModelDefaults does, and it is not mistaken for the context window
+func TestModelConfigMaxTokens(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Providers = map[ModelProvider]ProviderConfig{OpenAI: {Models: []ModelConfig{
+		{Name: "gpt-4o", MaxTokens: 16},
+		{Name: "small", ContextWindow: 10},
+	}}}
+	g := NewGateway(WithConfig(cfg), WithoutRateLimit())
+	defer g.Close()
+
+	req := LLMRequest{Provider: OpenAI, Model: "gpt-4o", Prompt: "hi"}
+	g.applyDefaults(&req)
+	if req.MaxTokens != 16 {
+		t.Errorf("max_tokens %d, want 16 from the model config", req.MaxTokens)
+	}
+	long := LLMRequest{Provider: OpenAI, Model: "gpt-4o", Prompt: strings.Repeat("word ", 100), MaxTokens: 16}
+	if err := g.checkTokenLimit(long); err != nil {
+		t.Errorf("prompt longer than max_tokens rejected: %s", err.Message)
+	}
+	long.Model = "small"
+	if err := g.checkTokenLimit(long); err == nil {
+		t.Error("prompt over the configured context_window accepted")
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxEmbeddingInputs caps the texts in one embeddings request, matching
+// OpenAI's own limit
+const maxEmbeddingInputs = 2048
+
+// EmbeddingInput is the text or texts to embed. It decodes from a single
+// JSON string as well as an array of strings.
+type EmbeddingInput []string
+
+// UnmarshalJSON accepts "text" and ["text", ...]
+func (in *EmbeddingInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = EmbeddingInput{text}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return errors.New("input must be a string or an array of strings")
+	}
+	*in = texts
+	return nil
+}
+
+// EmbeddingRequest is the body of POST /api/embeddings
+type EmbeddingRequest struct {
+	Provider ModelProvider  `json:"provider"`
+	Model    string         `json:"model,omitempty"`
+	Input    EmbeddingInput `json:"input"`
+	NoCache  bool           `json:"no_cache,omitempty"`
+}
+
+// EmbeddingResponse holds one embedding per input, in the same order.
+// TokensUsed counts the input tokens of every text, cached ones included,
+// and Cached is set when none of them needed an upstream call.
+type EmbeddingResponse struct {
+	Provider     ModelProvider `json:"provider"`
+	Model        string        `json:"model"`
+	Embeddings   [][]float32   `json:"embeddings"`
+	TokensUsed   int           `json:"tokens_used"`
+	ResponseTime float64       `json:"response_time_ms"`
+	Cached       bool          `json:"cached"`
+
+	// EstimatedCost is the USD cost of the upstream call from the pricing table
+	EstimatedCost float64 `json:"estimated_cost_usd,omitempty"`
+}
+
+// embeddingResult is what a provider returned for a list of texts
+type embeddingResult struct {
+	Model   string
+	Vectors [][]float32
+	// PromptTokens is the provider's count, or an estimate when it gives none
+	PromptTokens int
+}
+
+// OpenAI /embeddings wire format, also served by Azure OpenAI
+type openAIEmbeddingRequest struct {
+	Model string   `json:"model,omitempty"`
+	Input []string `json:"input"`
+}
+
+type openAIEmbeddingResponse struct {
+	Model string `json:"model"`
+	Data  []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+}
+
+// Ollama /api/embeddings wire format
+type ollamaEmbeddingRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+type ollamaEmbeddingResponse struct {
+	Embedding []float32 `json:"embedding"`
+}
+
+// supportsEmbeddings reports whether the gateway can get embeddings from p
+func supportsEmbeddings(p ModelProvider) bool {
+	switch p {
+	case Mock, OpenAI, AzureOpenAI, Ollama:
+		return true
+	}
+	return false
+}
+
+// defaultEmbeddingModel is the model used when a request names none. Azure
+// has no default, as the model is the deployment name.
+func defaultEmbeddingModel(p ModelProvider) string {
+	switch p {
+	case Mock:
+		return "mock-embedding"
+	case OpenAI:
+		return "text-embedding-3-small"
+	case Ollama:
+		return "nomic-embed-text"
+	}
+	return ""
+}
+
+// createEmbeddings embeds texts with a provider's embedding endpoint,
+// returning one vector per text in the same order. The call is made as is;
+// callers that want retries and the circuit breaker wrap it in guardedCall.
+func (g *Gateway) createEmbeddings(ctx context.Context, provider ModelProvider, model string, texts []string) (embeddingResult, error) {
+	if model == "" {
+		model = defaultEmbeddingModel(provider)
+	}
+	result := embeddingResult{Model: model}
+
+	switch provider {
+	case Mock:
+		for _, text := range texts {
+			vec := mockEmbedding(text)
+			normalize(vec)
+			result.Vectors = append(result.Vectors, vec)
+		}
+
+	case OpenAI, AzureOpenAI:
+		b, err := g.backend(provider)
+		if err != nil {
+			return embeddingResult{}, err
+		}
+		if b.APIKey == "" {
+			return embeddingResult{}, fmt.Errorf("no API key configured for %s backend %s", provider, b.Name)
+		}
+
+		var endpoint string
+		var headers map[string]string
+		payload := openAIEmbeddingRequest{Model: model, Input: texts}
+		if provider == OpenAI {
+			baseURL := b.BaseURL
+			if baseURL == "" {
+				baseURL = defaultOpenAIBaseURL
+			}
+			endpoint = baseURL + "/embeddings"
+			headers = map[string]string{"Authorization": "Bearer " + b.APIKey}
+		} else {
+			if model == "" || b.BaseURL == "" {
+				return embeddingResult{}, fmt.Errorf("azure embeddings need a base URL and the deployment as the model")
+			}
+			version := g.config.Providers[AzureOpenAI].APIVersion
+			if version == "" {
+				version = defaultAzureAPIVersion
+			}
+			endpoint = fmt.Sprintf("%s/openai/deployments/%s/embeddings?api-version=%s",
+				strings.TrimSuffix(b.BaseURL, "/"), url.PathEscape(model), url.QueryEscape(version))
+			headers = map[string]string{"api-key": b.APIKey}
+			payload.Model = ""
+		}
+
+		var resp openAIEmbeddingResponse
+		if err := g.postJSON(ctx, provider, endpoint, headers, payload, &resp); err != nil {
+			return embeddingResult{}, err
+		}
+		if len(resp.Data) != len(texts) {
+			return embeddingResult{}, fmt.Errorf("%s returned %d embeddings for %d inputs", provider, len(resp.Data), len(texts))
+		}
+		sort.Slice(resp.Data, func(i, j int) bool { return resp.Data[i].Index < resp.Data[j].Index })
+		for _, d := range resp.Data {
+			result.Vectors = append(result.Vectors, d.Embedding)
+		}
+		if resp.Model != "" {
+			result.Model = resp.Model
+		}
+		result.PromptTokens = resp.Usage.PromptTokens
+
+	case Ollama:
+		b, err := g.backend(Ollama)
+		if err != nil {
+			return embeddingResult{}, err
+		}
+		baseURL := b.BaseURL
+		if baseURL == "" {
+			baseURL = defaultOllamaBaseURL
+		}
+
+		// The endpoint takes one prompt at a time
+		for _, text := range texts {
+			var resp ollamaEmbeddingResponse
+			if err := g.postJSON(ctx, Ollama, baseURL+"/api/embeddings", nil, ollamaEmbeddingRequest{Model: model, Prompt: text}, &resp); err != nil {
+				return embeddingResult{}, err
+			}
+			result.Vectors = append(result.Vectors, resp.Embedding)
+		}
+
+	default:
+		return embeddingResult{}, fmt.Errorf("provider %s does not support embeddings", provider)
+	}
+
+	for i, vec := range result.Vectors {
+		if len(vec) == 0 {
+			return embeddingResult{}, fmt.Errorf("%s returned an empty embedding for input %d", provider, i)
+		}
+	}
+	if result.PromptTokens == 0 {
+		for _, text := range texts {
+			result.PromptTokens += g.estimateTokens(result.Model, text)
+		}
+	}
+	return result, nil
+}
+
+// embeddingCacheKey is the response cache key of one embedded text. It
+// starts with the provider like completion keys, so flushing a provider's
+// entries drops its embeddings too.
+func embeddingCacheKey(provider ModelProvider, model, input, version string) string {
+	return string(provider) + ":embedding:" + version + ":" + model + ":" + input
+}
+
+// Embeddings share the response cache with completions: each vector is
+// stored as the JSON text of a response, with its input tokens, so the size
+// limits, Redis and the cache endpoints all cover them.
+func embeddingEntry(provider ModelProvider, model string, vec []float32, tokens int) LLMResponse {
+	encoded, _ := json.Marshal(vec)
+	return LLMResponse{Provider: provider, Model: model, Response: string(encoded), TokensUsed: tokens, PromptTokens: tokens}
+}
+
+// cachedEmbedding decodes a vector stored by embeddingEntry
+func cachedEmbedding(entry LLMResponse) ([]float32, bool) {
+	var vec []float32
+	if err := json.Unmarshal([]byte(entry.Response), &vec); err != nil || len(vec) == 0 {
+		return nil, false
+	}
+	return vec, true
+}
+
+// completeEmbeddings serves a validated request, taking each text's vector
+// from the cache when it is there and embedding the rest in a single
+// upstream call, which is then cached text by text
+func (g *Gateway) completeEmbeddings(ctx context.Context, req EmbeddingRequest) (EmbeddingResponse, error) {
+	response := EmbeddingResponse{
+		Provider:   req.Provider,
+		Model:      req.Model,
+		Embeddings: make([][]float32, len(req.Input)),
+	}
+	ttl := time.Duration(g.config.CacheTTL)
+	cache := g.responseCache()
+
+	var missing []int
+	for i, text := range req.Input {
+		if !req.NoCache {
+			entry, found := cache.Get(embeddingCacheKey(req.Provider, req.Model, text, g.config.CacheVersion))
+			if vec, ok := cachedEmbedding(entry); found && ok {
+				response.Embeddings[i] = vec
+				response.TokensUsed += entry.TokensUsed
+				continue
+			}
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		g.metrics.RecordCacheHit()
+		response.Cached = true
+		return response, nil
+	}
+	g.metrics.RecordCacheMiss()
+
+	texts := make([]string, len(missing))
+	for j, i := range missing {
+		texts[j] = req.Input[i]
+	}
+
+	priority := g.requestPriority(ctx, LLMRequest{})
+	var result embeddingResult
+	start := time.Now()
+	err := g.guardedCall(ctx, req.Provider, priority, func(ctx context.Context) error {
+		ctx, span := g.tracer.Start(ctx, "gateway.embeddings", spanKindClient)
+		defer span.End()
+		span.SetAttr("gen_ai.system", string(req.Provider))
+		span.SetAttr("gen_ai.request.model", req.Model)
+
+		var err error
+		result, err = g.createEmbeddings(ctx, req.Provider, req.Model, texts)
+		span.RecordError(err)
+		return err
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		g.recordProviderFailure(req.Provider, err)
+		return EmbeddingResponse{}, err
+	}
+
+	for j, i := range missing {
+		response.Embeddings[i] = result.Vectors[j]
+		// The usage covers the whole call, so each text's share is estimated
+		tokens := g.estimateTokens(result.Model, texts[j])
+		cache.Set(embeddingCacheKey(req.Provider, req.Model, texts[j], g.config.CacheVersion),
+			embeddingEntry(req.Provider, result.Model, result.Vectors[j], tokens), ttl)
+	}
+	response.Model = result.Model
+	response.TokensUsed += result.PromptTokens
+	response.ResponseTime = float64(elapsed.Milliseconds())
+	response.EstimatedCost = g.estimateCost(LLMResponse{Model: result.Model, TokensUsed: result.PromptTokens, PromptTokens: result.PromptTokens})
+
+	g.metrics.RecordRequestForProvider(req.Provider)
+	g.metrics.RecordLatency(req.Provider, elapsed)
+	g.recordSpend(ctx, LLMResponse{EstimatedCost: response.EstimatedCost})
+	g.metrics.RecordRequest()
+	return response, nil
+}
+
+// validateEmbeddings checks an embeddings request after defaults are applied
+func (g *Gateway) validateEmbeddings(req EmbeddingRequest) *ValidationError {
+	if req.Provider == "" {
+		return &ValidationError{Field: "provider", Message: "must be set, as no default provider is configured"}
+	}
+	if _, ok := g.lookupProvider(req.Provider); !ok {
+		return &ValidationError{Field: "provider", Message: fmt.Sprintf("unknown provider %q", req.Provider)}
+	}
+	if !supportsEmbeddings(req.Provider) {
+		return &ValidationError{Field: "provider", Message: fmt.Sprintf("provider %s does not support embeddings", req.Provider)}
+	}
+	if req.Model == "" {
+		return &ValidationError{Field: "model", Message: fmt.Sprintf("must be set for provider %s", req.Provider)}
+	}
+	if len(req.Input) == 0 {
+		return &ValidationError{Field: "input", Message: "must not be empty"}
+	}
+	if len(req.Input) > maxEmbeddingInputs {
+		return &ValidationError{Field: "input", Message: fmt.Sprintf("at most %d texts can be embedded at once", maxEmbeddingInputs)}
+	}
+	for i, text := range req.Input {
+		if strings.TrimSpace(text) == "" {
+			return &ValidationError{Field: fmt.Sprintf("input[%d]", i), Message: "must not be empty"}
+		}
+	}
+	return nil
+}
+
+// HandleEmbeddings serves POST /api/embeddings, which embeds one text or a
+// list of them with a provider's embedding model. Requests go through the
+// same rate limits, access policies and budgets as completions, and each
+// text's vector is cached under its provider, model and input.
+func (g *Gateway) HandleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	g.inFlight.Add(1)
+	defer g.inFlight.Add(-1)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		g.writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !g.allowRequest(w, r) {
+		g.writeError(w, r, http.StatusTooManyRequests, CodeRateLimited, "Rate limit exceeded")
+		g.metrics.RecordError()
+		return
+	}
+
+	var req EmbeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		g.invalidBody(w, r, err)
+		g.metrics.RecordError()
+		return
+	}
+	if noCacheRequested(r) {
+		req.NoCache = true
+	}
+	if req.Provider == "" {
+		req.Provider = g.config.DefaultProvider
+	}
+	if req.Model == "" {
+		req.Model = defaultEmbeddingModel(req.Provider)
+	}
+
+	if invalid := g.validateEmbeddings(req); invalid != nil {
+		g.writeErrorResponse(w, r, http.StatusBadRequest, ErrorResponse{
+			Code:    CodeInvalidRequest,
+			Message: invalid.Error(),
+			Field:   invalid.Field,
+		})
+		g.metrics.RecordError()
+		return
+	}
+
+	if err := g.checkAccess(r.Context(), LLMRequest{Provider: req.Provider, Model: req.Model}); err != nil {
+		g.writeError(w, r, http.StatusForbidden, CodeForbidden, err.Error())
+		g.metrics.RecordError()
+		return
+	}
+
+	if g.overBudget(r.Context()) {
+		g.budgetExceeded(w, r)
+		g.metrics.RecordError()
+		return
+	}
+
+	ctx, cancel := g.withRequestTimeout(r.Context(), LLMRequest{})
+	defer cancel()
+
+	response, err := g.completeEmbeddings(ctx, req)
+	if err != nil {
+		if g.clientCancelled(w, ctx) {
+			return
+		}
+		status, code := errorStatus(ctx, err)
+		g.writeError(w, r, status, code, err.Error())
+		g.metrics.RecordError()
+		return
+	}
+
+	w.Header().Set("X-Provider", string(response.Provider))
+	w.Header().Set("X-Model", response.Model)
+	if response.Cached {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	g.writeJSON(w, r, http.StatusOK, response)
+}
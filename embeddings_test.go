@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newEmbeddingsServer serves a gateway whose OpenAI provider is a fake
+// /embeddings endpoint, counting its calls. The fake returns its data out
+// of order, as the API allows, with the input's length as each vector.
+func newEmbeddingsServer(t *testing.T, calls *atomic.Int64) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req openAIEmbeddingRequest
+		if r.URL.Path != "/embeddings" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var resp openAIEmbeddingResponse
+		resp.Model = req.Model
+		resp.Usage.PromptTokens = 5
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			resp.Data = append(resp.Data, struct {
+				Index     int       `json:"index"`
+				Embedding []float32 `json:"embedding"`
+			}{i, []float32{float32(len(req.Input[i])), 1}})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := DefaultConfig()
+	cfg.Providers = map[ModelProvider]ProviderConfig{OpenAI: {APIKey: "test", BaseURL: upstream.URL}}
+	return newTestServer(t, WithConfig(cfg), WithoutRateLimit())
+}
+
+func TestEmbeddings(t *testing.T) {
+	var calls atomic.Int64
+	srv := newEmbeddingsServer(t, &calls)
+	const body = `{"provider":"openai","input":["a","bbb"]}`
+
+	resp := postJSON(t, srv, "/api/embeddings", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("X-Cache %q, want MISS", resp.Header.Get("X-Cache"))
+	}
+	var first EmbeddingResponse
+	decode(t, resp, &first)
+	if first.Model != "text-embedding-3-small" || first.TokensUsed != 5 || first.Cached {
+		t.Errorf("response %+v, want the default model, 5 tokens and no cache", first)
+	}
+	if len(first.Embeddings) != 2 || first.Embeddings[0][0] != 1 || first.Embeddings[1][0] != 3 {
+		t.Fatalf("embeddings %v, want one per input in input order", first.Embeddings)
+	}
+
+	resp = postJSON(t, srv, "/api/embeddings", body)
+	var second EmbeddingResponse
+	decode(t, resp, &second)
+	if !second.Cached || resp.Header.Get("X-Cache") != "HIT" {
+		t.Errorf("second response not served from the cache")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+
+	// Like completions, total_requests counts only upstream calls
+	resp, err := http.Get(srv.URL + "/api/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var metrics map[string]any
+	decode(t, resp, &metrics)
+	want := map[string]float64{"total_requests": 1, "cache_hits": 1, "cache_misses": 1}
+	for key, v := range want {
+		if got, _ := metrics[key].(float64); got != v {
+			t.Errorf("%s = %v, want %v", key, metrics[key], v)
+		}
+	}
+}
+
+func TestEmbeddingsInvalidRequests(t *testing.T) {
+	var calls atomic.Int64
+	srv := newEmbeddingsServer(t, &calls)
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"provider without embeddings", `{"provider":"anthropic","input":"hi"}`, "provider"},
+		{"unknown provider", `{"provider":"nope","input":"hi"}`, "provider"},
+		{"missing input", `{"provider":"openai"}`, "input"},
+		{"empty input list", `{"provider":"openai","input":[]}`, "input"},
+		{"blank text", `{"provider":"openai","input":["hi","  "]}`, "input[1]"},
+		{"input of the wrong type", `{"provider":"openai","input":42}`, ""},
+		{"malformed JSON", `{"provider":`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := postJSON(t, srv, "/api/embeddings", tt.body)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400", resp.StatusCode)
+			}
+			var body ErrorResponse
+			decode(t, resp, &body)
+			if body.Code != CodeInvalidRequest || body.Field != tt.field {
+				t.Errorf("error %+v, want %s on field %q", body, CodeInvalidRequest, tt.field)
+			}
+		})
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("upstream called %d times for invalid requests", n)
+	}
+}
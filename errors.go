@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorCode identifies the kind of failure in an ErrorResponse. Codes are
+// stable, unlike messages, so clients can branch on them.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest   ErrorCode = "INVALID_REQUEST"
+	CodeRequestTooLarge  ErrorCode = "REQUEST_TOO_LARGE"
+	CodeUnauthorized     ErrorCode = "UNAUTHORIZED"
+	CodeForbidden        ErrorCode = "FORBIDDEN"
+	CodeNotFound         ErrorCode = "NOT_FOUND"
+	CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeRateLimited      ErrorCode = "RATE_LIMITED"
+	CodeBudgetExceeded   ErrorCode = "BUDGET_EXCEEDED"
+	CodeContentBlocked   ErrorCode = "CONTENT_BLOCKED"
+	CodeProviderError    ErrorCode = "PROVIDER_ERROR"
+	CodeTimeout          ErrorCode = "TIMEOUT"
+	CodeInternal         ErrorCode = "INTERNAL_ERROR"
+)
+
+// ErrorResponse is the body of every error from the gateway's own API. The
+// OpenAI-compatible endpoint uses OpenAI's error format instead.
+type ErrorResponse struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
+
+	// Field names the offending field of an INVALID_REQUEST and Reason says
+	// why moderation blocked a CONTENT_BLOCKED request
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// writeError writes an ErrorResponse with the request's ID. The body is
+// always encoded, never formatted, so any message makes valid JSON.
+func (g *Gateway) writeError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	g.writeErrorResponse(w, r, status, ErrorResponse{Code: code, Message: message})
+}
+
+// writeErrorResponse writes resp, filling in the request's ID
+func (g *Gateway) writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, resp ErrorResponse) {
+	resp.RequestID = RequestIDFrom(r.Context())
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	g.writeJSON(w, r, status, resp)
+}
+
+// encodeJSON writes v as the JSON body of a response with the given status.
+// v is encoded before anything is sent, so a value that can't be encoded
+// still gets a clean 500. A failed write, usually a client that went away
+// mid-response, can't be reported to the client and is only logged. Either
+// failure is returned.
+func encodeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("encoding response", "request_id", RequestIDFrom(r.Context()), "path", r.URL.Path, "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		encodeJSON(w, r, http.StatusInternalServerError, ErrorResponse{
+			Code:      CodeInternal,
+			Message:   "Internal server error",
+			RequestID: RequestIDFrom(r.Context()),
+		})
+		return err
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		slog.Warn("writing response", "request_id", RequestIDFrom(r.Context()), "path", r.URL.Path, "err", err)
+		return err
+	}
+	return nil
+}
+
+// writeJSON is encodeJSON for handlers, counting failed responses in the
+// gateway's metrics. Every response body written by the gateway, errors
+// included, goes through it.
+func (g *Gateway) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if err := encodeJSON(w, r, status, v); err != nil {
+		g.metrics.RecordWriteFailure()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// CostEstimate is the projected cost of a request, worked out without calling
+// a provider. The output cost is a range: nothing if the model stops at once,
+// up to MaxOutputTokens if it uses the whole allowance. MaxOutputTokens is
+// max_tokens, or what is left of the model's context window when that is
+// unset; with neither known the upper bound is omitted. Both are per
+// completion; the costs cover all n of them, including the repeated prompt
+// for providers that are called once per completion.
+type CostEstimate struct {
+	Model           string   `json:"model"`
+	Priced          bool     `json:"priced"`
+	PromptTokens    int      `json:"prompt_tokens"`
+	MaxOutputTokens int      `json:"max_output_tokens,omitempty"`
+	InputCost       float64  `json:"input_cost_usd"`
+	OutputCostMin   float64  `json:"output_cost_min_usd"`
+	OutputCostMax   *float64 `json:"output_cost_max_usd,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// estimateRequest prices a single request from the token counter and the
+// pricing table
+func (g *Gateway) estimateRequest(req LLMRequest) CostEstimate {
+	g.applyDefaults(&req)
+	invalid := g.renderTemplate(&req)
+	if invalid == nil {
+		invalid = g.validate(req)
+	}
+	if invalid != nil {
+		return CostEstimate{Model: req.Model, Error: invalid.Error()}
+	}
+
+	est := CostEstimate{Model: req.Model, PromptTokens: g.promptTokens(req)}
+	est.MaxOutputTokens = req.MaxTokens
+	if est.MaxOutputTokens == 0 {
+		if window := g.contextWindow(req.Provider, req.Model); window > est.PromptTokens {
+			est.MaxOutputTokens = window - est.PromptTokens
+		}
+	}
+
+	price, ok := g.priceFor(req.Model)
+	if !ok {
+		return est
+	}
+	completions, calls := 1, 1
+	if req.N > 1 {
+		completions = req.N
+		if !supportsN(req.Provider) {
+			calls = req.N
+		}
+	}
+	est.Priced = true
+	est.InputCost = float64(est.PromptTokens*calls) * price.InputPerMillion / 1e6
+	if est.MaxOutputTokens > 0 {
+		max := float64(est.MaxOutputTokens*completions) * price.OutputPerMillion / 1e6
+		est.OutputCostMax = &max
+	}
+	return est
+}
+
+// HandleEstimate serves POST /api/llm/estimate. It takes an LLMRequest, or an
+// array of them as sent to /api/llm/batch, and returns the CostEstimate for
+// each along with the totals. Nothing is sent upstream, cached or counted
+// against rate limits or budgets.
+func (g *Gateway) HandleEstimate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		g.writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		g.invalidBody(w, r, err)
+		return
+	}
+	var reqs []LLMRequest
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &reqs)
+	} else {
+		var req LLMRequest
+		err = json.Unmarshal(body, &req)
+		reqs = []LLMRequest{req}
+	}
+	if err != nil || len(reqs) == 0 {
+		g.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Invalid request")
+		return
+	}
+
+	estimates := make([]CostEstimate, len(reqs))
+	var inputCost, outputMax float64
+	bounded := true
+	for i, req := range reqs {
+		estimates[i] = g.estimateRequest(req)
+		inputCost += estimates[i].InputCost
+		if estimates[i].OutputCostMax != nil {
+			outputMax += *estimates[i].OutputCostMax
+		} else if estimates[i].Priced {
+			bounded = false
+		}
+	}
+
+	total := map[string]interface{}{"input_cost_usd": inputCost, "output_cost_min_usd": 0}
+	if bounded {
+		total["output_cost_max_usd"] = outputMax
+	}
+	g.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"estimates": estimates,
+		"total":     total,
+	})
+}
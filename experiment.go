@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+)
+
+// Experiment splits the requests for one model between several variants,
+// e.g. to send 10% of the traffic for gpt-4o to a candidate model and compare
+// the answers. Weights are relative, so {90, 10} and {9, 1} split the same
+// way; list the original model as a variant too to keep part of the traffic
+// on it.
+//
+// With Sticky set a client keeps the variant picked for its API key, so its
+// answers don't flip between models. Requests without an API key are
+// assigned at random. Header adds an X-Experiment header naming the variant
+// to responses.
+type Experiment struct {
+	Name     string              `json:"name"`
+	Model    string              `json:"model"`
+	Variants []ExperimentVariant `json:"variants"`
+	Sticky   bool                `json:"sticky,omitempty"`
+	Header   bool                `json:"header,omitempty"`
+}
+
+// ExperimentVariant is one arm of an Experiment. Provider defaults to the
+// request's provider.
+type ExperimentVariant struct {
+	Name     string        `json:"name"`
+	Provider ModelProvider `json:"provider,omitempty"`
+	Model    string        `json:"model"`
+	Weight   float64       `json:"weight"`
+}
+
+// validate checks an experiment from the config
+func (e Experiment) validate() error {
+	if e.Name == "" {
+		return fmt.Errorf("experiment for %q: name must be set", e.Model)
+	}
+	if e.Model == "" {
+		return fmt.Errorf("experiment %s: model must be set", e.Name)
+	}
+	if len(e.Variants) == 0 {
+		return fmt.Errorf("experiment %s: no variants", e.Name)
+	}
+	seen := make(map[string]bool, len(e.Variants))
+	for _, v := range e.Variants {
+		switch {
+		case v.Name == "":
+			return fmt.Errorf("experiment %s: variant name must be set", e.Name)
+		case seen[v.Name]:
+			return fmt.Errorf("experiment %s: duplicate variant %q", e.Name, v.Name)
+		case v.Model == "":
+			return fmt.Errorf("experiment %s: variant %s: model must be set", e.Name, v.Name)
+		case v.Weight <= 0:
+			return fmt.Errorf("experiment %s: variant %s: weight must be positive", e.Name, v.Name)
+		}
+		seen[v.Name] = true
+	}
+	return nil
+}
+
+// pick chooses a variant. key, when set, always maps to the same variant.
+func (e Experiment) pick(key string) ExperimentVariant {
+	var total float64
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+
+	var x float64
+	if key != "" {
+		h := fnv.New64a()
+		h.Write([]byte(e.Name + "\x00" + key))
+		x = float64(h.Sum64()>>11) / (1 << 53)
+	} else {
+		x = rand.Float64()
+	}
+	x *= total
+	for _, v := range e.Variants {
+		if x < v.Weight {
+			return v
+		}
+		x -= v.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// experimentFor returns the experiment running on model, if any
+func (g *Gateway) experimentFor(model string) (Experiment, bool) {
+	for _, e := range g.config.Experiments {
+		if e.Model == model {
+			return e, true
+		}
+	}
+	return Experiment{}, false
+}
+
+// assignVariant moves req to a variant when an experiment runs on its model,
+// and returns the experiment and the variant's name. It runs after
+// applyDefaults: parameters filled in from the original model's defaults are
+// kept, so every variant sees the same request.
+//
+// The caller must be allowed the model it asked for, or the request is left
+// alone for checkAccess to reject; an experiment is no way round a policy.
+// Only the variants the caller's policy allows are picked from.
+func (g *Gateway) assignVariant(ctx context.Context, req *LLMRequest) (Experiment, string, bool) {
+	e, ok := g.experimentFor(req.Model)
+	if !ok || g.checkAccess(ctx, *req) != nil {
+		return Experiment{}, "", false
+	}
+	policy := g.accessPolicy(ctx)
+	var allowed []ExperimentVariant
+	for _, v := range e.Variants {
+		provider := v.Provider
+		if provider == "" {
+			provider = req.Provider
+		}
+		if policy.allowsProvider(provider) && policy.allowsModel(v.Model) {
+			allowed = append(allowed, v)
+		}
+	}
+	if len(allowed) == 0 {
+		return Experiment{}, "", false
+	}
+	e.Variants = allowed
+	var key string
+	if e.Sticky {
+		key = APIKeyLabel(ctx)
+	}
+	v := e.pick(key)
+	if v.Provider != "" {
+		req.Provider = v.Provider
+	}
+	req.Model = v.Model
+	req.experiment, req.variant = e.Name, v.Name
+	g.metrics.RecordExperimentVariant(e.Name, v.Name)
+	return e, v.Name, true
+}
+
+// routeExperiment is assignVariant for the HTTP handlers, adding the
+// X-Experiment header when the experiment asks for it
+func (g *Gateway) routeExperiment(w http.ResponseWriter, r *http.Request, req *LLMRequest) {
+	if e, variant, ok := g.assignVariant(r.Context(), req); ok && e.Header {
+		w.Header().Set("X-Experiment", e.Name+"="+variant)
+	}
+}
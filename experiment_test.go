@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// An experiment must not route a caller to a model its key may not use, nor
+// let it reach a variant by asking for a model it may not use
+func TestExperimentRespectsAccessPolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Experiments = []Experiment{{
+		Name:   "candidate",
+		Model:  "gpt-4o",
+		Header: true,
+		Variants: []ExperimentVariant{
+			{Name: "control", Model: "gpt-4o", Weight: 1},
+			{Name: "candidate", Model: "gpt-5", Weight: 1000},
+		},
+	}}
+	cfg.APIKeys = []APIKeyConfig{
+		{Key: "k-4o", Label: "4o", Access: &AccessPolicy{Models: []string{"gpt-4o*"}}},
+		{Key: "k-5", Label: "5", Access: &AccessPolicy{Models: []string{"gpt-5*"}}},
+	}
+	var calls atomic.Int64
+	srv := newTestServer(t, WithConfig(cfg), WithoutRateLimit(), WithoutCache(), WithProviderFunc(stubProvider(&calls)))
+
+	post := func(key string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/llm",
+			strings.NewReader(`{"provider":"openai","model":"gpt-4o","prompt":"hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for i := 0; i < 5; i++ {
+		resp := post("k-4o")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200", resp.StatusCode)
+		}
+		var body LLMResponse
+		decode(t, resp, &body)
+		if body.Model != "gpt-4o" || resp.Header.Get("X-Experiment") != "candidate=control" {
+			t.Errorf("routed to %s (%s), want only the allowed control", body.Model, resp.Header.Get("X-Experiment"))
+		}
+	}
+
+	if resp := post("k-5"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d for a model the key may not use, want 403", resp.StatusCode)
+	}
+	if n := calls.Load(); n != 5 {
+		t.Errorf("provider called %d times, want 5", n)
+	}
+}
@@ -9,12 +9,28 @@ LLM providers with load balancing, caching, and rate limiting.
 */
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -26,15 +42,399 @@ const (
 	Anthropic ModelProvider = "anthropic"
 	Google    ModelProvider = "google"
 	DeepSeek  ModelProvider = "deepseek"
+	
+	// AzureOpenAI serves OpenAI models from an Azure resource; the request's
+	// model names the deployment unless the provider config fixes one
+	AzureOpenAI ModelProvider = "azure"
+	
+	// Ollama runs models locally; it needs a base URL but no API key
+	Ollama ModelProvider = "ollama"
+	
+	// Bedrock is AWS Bedrock; the request's model is the Bedrock model ID
+	Bedrock ModelProvider = "bedrock"
+	
+	// Mock returns scripted responses and failures; see MockConfig
+	Mock ModelProvider = "mock"
+)
+
+const (
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+	
+	// defaultAzureAPIVersion is the Azure OpenAI api-version used when none is configured
+	defaultAzureAPIVersion = "2024-10-21"
+
+	// defaultProviderTimeout bounds a provider call when none is configured
+	defaultProviderTimeout = 60 * time.Second
+	
+	// maxUpstreamErrorBody caps how much of a failed upstream response we keep
+	maxUpstreamErrorBody = 4096
 )
 
 // LLMRequest represents an incoming request
 type LLMRequest struct {
-	Prompt   string        `json:"prompt"`
-	Model    string        `json:"model"`
-	Provider ModelProvider `json:"provider"`
-	MaxTokens int          `json:"max_tokens,omitempty"`
-	Temperature float64    `json:"temperature,omitempty"`
+	Prompt      string        `json:"prompt"`
+	Model       string        `json:"model"`
+	Provider    ModelProvider `json:"provider"`
+	MaxTokens   int           `json:"max_tokens,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+	
+	// Temperature is left to the provider, or the model's defaults, when
+	// unset; an explicit 0 is sent as is
+	Temperature *float64 `json:"temperature,omitempty"`
+	
+	// Messages is the conversation history. When present it takes precedence
+	// over Prompt, which is otherwise treated as a single user message.
+	Messages []Message `json:"messages,omitempty"`
+	
+	// FallbackProviders are tried in order if Provider fails
+	FallbackProviders []ModelProvider `json:"fallback_providers,omitempty"`
+	
+	// CacheTTLSeconds overrides how long the response is cached; see cacheTTL
+	CacheTTLSeconds int `json:"cache_ttl_seconds,omitempty"`
+	
+	// NoCache forces a fresh upstream call. The result is still cached for
+	// later requests. A Cache-Control: no-cache header has the same effect.
+	NoCache bool `json:"no_cache,omitempty"`
+	
+	// TimeoutMs caps how long the client will wait for the response. The
+	// X-Timeout-Ms header sets it too; 0 uses the configured RequestTimeout.
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+	
+	// Mock scripts the mock provider for this request
+	Mock *MockConfig `json:"mock,omitempty"`
+	
+	// Stop ends generation at any of these sequences; TopP is the nucleus
+	// sampling probability mass. Both are left to the provider when unset.
+	Stop []string `json:"stop,omitempty"`
+	TopP *float64 `json:"top_p,omitempty"`
+	
+	// ResponseFormat is "text" (the default) or "json_object" to make the
+	// model answer in JSON. Providers without a JSON mode ignore it.
+	ResponseFormat string `json:"response_format,omitempty"`
+	
+	// CallbackURL makes the request asynchronous: it is answered with 202
+	// and a job ID, and the finished job is POSTed to this URL
+	CallbackURL string `json:"callback_url,omitempty"`
+	
+	// N asks for several completions of the prompt to choose from; 0 and 1
+	// both mean one. See LLMResponse.Responses.
+	N int `json:"n,omitempty"`
+	
+	// Tools are functions the model may call, and ToolChoice, in the OpenAI
+	// format, whether and which it must call. Only providers for which
+	// supportsTools is true accept them.
+	Tools      []Tool          `json:"tools,omitempty"`
+	ToolChoice json.RawMessage `json:"tool_choice,omitempty"`
+	
+	// Template names a prompt template to render with Variables in place of
+	// Prompt; see TemplateStore
+	Template  string                 `json:"template,omitempty"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+	
+	// Priority is "high", "normal" (the default) or "low" and orders calls
+	// waiting for a saturated provider; see Priority
+	Priority Priority `json:"priority,omitempty"`
+	
+	// system is the configured system prompt, set by applyDefaults; clients
+	// can't set it
+	system string
+	
+	// experiment and variant record the A/B variant assignVariant routed the
+	// request to, for the audit log
+	experiment, variant string
+}
+
+// timeoutHeader applies an X-Timeout-Ms header, if present, to req
+func timeoutHeader(r *http.Request, req *LLMRequest) error {
+	v := r.Header.Get("X-Timeout-Ms")
+	if v == "" {
+		return nil
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms <= 0 {
+		return errors.New("X-Timeout-Ms must be a positive integer")
+	}
+	req.TimeoutMs = ms
+	return nil
+}
+
+// withRequestTimeout bounds ctx by the time the client is willing to wait.
+// Provider calls run under the derived context, so they are abandoned too.
+func (g *Gateway) withRequestTimeout(ctx context.Context, req LLMRequest) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(g.config.RequestTimeout)
+	if req.TimeoutMs > 0 {
+		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// errorStatus picks the status and code for a failed completion: 504 once
+// the client's deadline has passed, 422 when the output filter blocked the
+// response, otherwise 500
+func errorStatus(ctx context.Context, err error) (int, ErrorCode) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, CodeTimeout
+	}
+	var blocked *OutputBlockedError
+	if errors.As(err, &blocked) {
+		return http.StatusUnprocessableEntity, CodeContentBlocked
+	}
+	return http.StatusInternalServerError, CodeProviderError
+}
+
+// statusClientClosedRequest is nginx's status for a request the client
+// abandoned. It never reaches the client but shows up in the access log.
+const statusClientClosedRequest = 499
+
+// clientGone reports whether the request was abandoned by its client rather
+// than failing or timing out
+func clientGone(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
+// clientCancelled handles a request whose client has disconnected: nothing
+// is written back and it is counted as cancelled, not as an error. It
+// reports false, doing nothing, while the client is still there.
+func (g *Gateway) clientCancelled(w http.ResponseWriter, ctx context.Context) bool {
+	if !clientGone(ctx) {
+		return false
+	}
+	g.metrics.RecordClientCancelled()
+	w.WriteHeader(statusClientClosedRequest)
+	return true
+}
+
+// noCacheRequested reports whether the client sent Cache-Control: no-cache
+func noCacheRequested(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheTTL resolves how long this request's response may be cached. The
+// precedence is:
+//
+//   - CacheTTLSeconds < 0: the response is never cached and the cache is not
+//     consulted, for prompts that are only valid right now
+//   - CacheTTLSeconds > 0: that many seconds
+//   - CacheTTLSeconds == 0 (the default): the gateway's configured CacheTTL
+//
+// ok is false when caching is skipped.
+func (req LLMRequest) cacheTTL(defaultTTL time.Duration) (ttl time.Duration, ok bool) {
+	switch {
+	case req.CacheTTLSeconds < 0:
+		return 0, false
+	case req.CacheTTLSeconds > 0:
+		return time.Duration(req.CacheTTLSeconds) * time.Second, true
+	default:
+		return defaultTTL, true
+	}
+}
+
+// cacheTTL is req.cacheTTL with the configured CacheTTL as the default. A
+// request hotter than CacheMaxTemperature is never cached, whatever its
+// CacheTTLSeconds. An unset temperature counts as 0.
+func (g *Gateway) cacheTTL(req LLMRequest) (time.Duration, bool) {
+	if req.Temperature != nil && *req.Temperature > g.config.CacheMaxTemperature {
+		return 0, false
+	}
+	return req.cacheTTL(time.Duration(g.config.CacheTTL))
+}
+
+// Message is a single turn in a conversation
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	
+	// ToolCalls are the calls an assistant turn made, and ToolCallID which
+	// call a "tool" message answers; see Tool
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// conversation returns the messages to send upstream, wrapping a plain Prompt
+// as a single user message, after the configured system prompt if any
+func (req LLMRequest) conversation() []Message {
+	msgs := req.Messages
+	if len(msgs) == 0 {
+		msgs = []Message{{Role: "user", Content: req.Prompt}}
+	}
+	if req.system == "" {
+		return msgs
+	}
+	return append([]Message{{Role: "system", Content: req.system}}, msgs...)
+}
+
+// lastUserMessage returns the most recent user turn of the conversation
+func (req LLMRequest) lastUserMessage() string {
+	msgs := req.conversation()
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			return msgs[i].Content
+		}
+	}
+	return ""
+}
+
+// ValidationError describes an invalid LLMRequest field
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+// validate rejects requests that could never succeed upstream
+func (req LLMRequest) validate() *ValidationError {
+	if len(req.Messages) == 0 && strings.TrimSpace(req.Prompt) == "" {
+		return &ValidationError{Field: "prompt", Message: "must not be empty"}
+	}
+	for i, m := range req.Messages {
+		switch m.Role {
+		case "system", "user", "assistant", "tool":
+		default:
+			return &ValidationError{Field: fmt.Sprintf("messages[%d].role", i), Message: fmt.Sprintf("unknown role %q", m.Role)}
+		}
+	}
+	if req.MaxTokens < 0 {
+		return &ValidationError{Field: "max_tokens", Message: "must not be negative"}
+	}
+	if req.Priority.rank() < 0 {
+		return &ValidationError{Field: "priority", Message: "must be high, normal or low"}
+	}
+	if req.TimeoutMs < 0 {
+		return &ValidationError{Field: "timeout_ms", Message: "must not be negative"}
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2) {
+		return &ValidationError{Field: "temperature", Message: "must be between 0 and 2"}
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		return &ValidationError{Field: "top_p", Message: "must be between 0 and 1"}
+	}
+	if len(req.Stop) > maxStopSequences {
+		return &ValidationError{Field: "stop", Message: fmt.Sprintf("at most %d sequences are allowed", maxStopSequences)}
+	}
+	for _, s := range req.Stop {
+		if s == "" {
+			return &ValidationError{Field: "stop", Message: "sequences must not be empty"}
+		}
+	}
+	switch req.ResponseFormat {
+	case "", ResponseFormatText:
+	case ResponseFormatJSON:
+		// OpenAI-style JSON mode is rejected upstream unless the
+		// conversation asks for JSON
+		if supportsResponseFormat(req.Provider) && !mentionsJSON(req.conversation()) {
+			return &ValidationError{Field: "response_format", Message: "json_object requires the messages to ask for JSON"}
+		}
+	default:
+		return &ValidationError{Field: "response_format", Message: fmt.Sprintf("must be %q or %q", ResponseFormatText, ResponseFormatJSON)}
+	}
+	if req.N < 0 || req.N > maxCompletions {
+		return &ValidationError{Field: "n", Message: fmt.Sprintf("must be between 1 and %d", maxCompletions)}
+	}
+	if req.N > 1 && req.Stream {
+		return &ValidationError{Field: "n", Message: "cannot be combined with stream"}
+	}
+	if req.CallbackURL != "" {
+		if err := checkCallbackURL(req.CallbackURL, true); err != nil {
+			return &ValidationError{Field: "callback_url", Message: err.Error()}
+		}
+		if req.Stream {
+			return &ValidationError{Field: "callback_url", Message: "cannot be combined with stream"}
+		}
+	}
+	return req.validateTools()
+}
+
+// maxStopSequences is the most stop sequences a request may set, the lowest
+// limit among the providers
+const maxStopSequences = 4
+
+// maxCompletions is the most completions a request may ask for. Providers
+// without n are called once per completion, so this also bounds the calls.
+const maxCompletions = 8
+
+// Response formats
+const (
+	ResponseFormatText = "text"
+	ResponseFormatJSON = "json_object"
+)
+
+// supportsResponseFormat reports whether p has a JSON mode that
+// ResponseFormat is passed through to
+func supportsResponseFormat(p ModelProvider) bool {
+	switch p {
+	case OpenAI, AzureOpenAI, DeepSeek, Ollama:
+		return true
+	default:
+		return false
+	}
+}
+
+// mentionsJSON reports whether any message mentions JSON
+func mentionsJSON(msgs []Message) bool {
+	for _, m := range msgs {
+		if strings.Contains(strings.ToLower(m.Content), "json") {
+			return true
+		}
+	}
+	return false
+}
+
+// warnIgnoredParams logs the request parameters that provider will not
+// honour, so the client's expectations aren't silently dropped
+func warnIgnoredParams(provider ModelProvider, req LLMRequest) {
+	if req.ResponseFormat == ResponseFormatJSON && !supportsResponseFormat(provider) {
+		slog.Warn("provider has no JSON mode, ignoring response_format", "provider", provider, "response_format", req.ResponseFormat)
+	}
+	if len(req.Stop) > 0 && provider == Bedrock && strings.Contains(req.Model, "meta.llama") {
+		slog.Warn("bedrock llama models take no stop sequences, ignoring stop", "model", req.Model)
+	}
+}
+
+// validate checks a request against what this gateway can serve: the
+// request itself, its providers, which must be registered, and its model's
+// context window
+func (g *Gateway) validate(req LLMRequest) *ValidationError {
+	if invalid := req.validate(); invalid != nil {
+		return invalid
+	}
+	if req.system != "" && !g.config.AllowClientSystemPrompt {
+		for i, m := range req.Messages {
+			if m.Role == "system" {
+				return &ValidationError{Field: fmt.Sprintf("messages[%d].role", i), Message: "system messages are set by the gateway"}
+			}
+		}
+	}
+	if req.Provider == "" {
+		return &ValidationError{Field: "provider", Message: "must be set, as no default provider is configured"}
+	}
+	if _, ok := g.lookupProvider(req.Provider); !ok {
+		return &ValidationError{Field: "provider", Message: fmt.Sprintf("unknown provider %q", req.Provider)}
+	}
+	if req.usesTools() && !supportsTools(req.Provider) {
+		return &ValidationError{Field: "tools", Message: fmt.Sprintf("provider %s does not support tool calling", req.Provider)}
+	}
+	for _, p := range req.FallbackProviders {
+		if _, ok := g.lookupProvider(p); !ok {
+			return &ValidationError{Field: "fallback_providers", Message: fmt.Sprintf("unknown provider %q", p)}
+		}
+	}
+	if req.CallbackURL != "" && !g.config.CallbackAllowPrivate {
+		if err := checkCallbackURL(req.CallbackURL, false); err != nil {
+			return &ValidationError{Field: "callback_url", Message: err.Error()}
+		}
+	}
+	return g.checkTokenLimit(req)
 }
 
 // LLMResponse represents the API response
@@ -45,354 +445,2006 @@ type LLMResponse struct {
 	TokensUsed   int           `json:"tokens_used"`
 	ResponseTime float64       `json:"response_time_ms"`
 	Cached       bool          `json:"cached"`
+	
+	// Stale marks a cached answer served past its TTL because every
+	// provider failed; see Config.StaleIfError
+	Stale bool `json:"stale,omitempty"`
+	
+	// Stopped marks the partial answer of a stream stopped early through
+	// /api/llm/stop; its token counts are estimates
+	Stopped bool `json:"stopped,omitempty"`
+	
+	// Usage split, when the provider reports it
+	PromptTokens     int `json:"prompt_tokens,omitempty"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+	
+	// EstimatedCost is the USD cost of the upstream call from the pricing table
+	EstimatedCost float64 `json:"estimated_cost_usd,omitempty"`
+	
+	// Responses holds every completion when the request set N above 1, in
+	// which case Response is the first of them. Token counts cover them all.
+	Responses []string `json:"responses,omitempty"`
+	
+	// ToolCalls are the calls the model made to the request's tools, if it
+	// chose to call any; Response is usually empty then
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// Gateway is the main API gateway
+type Gateway struct {
+	config      Config
+	cache       Cache
+	rateLimiter *RateLimiter
+	metrics     *Metrics
+	client      *http.Client
+	
+	// apiKeys maps accepted client keys to their labels
+	apiKeys map[string]string
+	
+	// pricing is the per-model price table and budgets the monthly USD
+	// budget per API key label
+	pricing map[string]ModelPrice
+	budgets map[string]float64
+	spend   *SpendTracker
+	
+	// shadowSlots bounds the shadow calls running at once and shadowSpend
+	// is their estimated cost; see ShadowConfig
+	shadowSlots chan struct{}
+	shadowSpend *SpendTracker
+	
+	// contextWindows is the per-model token limit table
+	contextWindows map[string]int
+	
+	tokenizer *tokenizer
+	
+	// policies holds per-key access overrides by label
+	policies map[string]AccessPolicy
+	
+	// priorities holds per-key request priorities by label
+	priorities map[string]Priority
+	
+	// slots caps concurrent upstream calls per provider
+	slots map[ModelProvider]*providerSlots
+	
+	// semantic indexes cached prompts by embedding; nil when disabled
+	semantic *semanticIndex
+	
+	// audit records prompts and responses; nil when disabled
+	audit *AuditLogger
+	
+	// tracer exports request spans; nil when tracing is off
+	tracer *Tracer
+	
+	// clientAddrs works out client addresses behind trusted proxies, and
+	// ipFilter screens them; nil when no lists are configured
+	clientAddrs clientAddrs
+	ipFilter    *ipFilter
+	
+	// streams are the streams in flight, for HandleStopStream
+	streams activeStreams
+	
+	// templates are the prompt templates requests can name
+	templates *TemplateStore
+	
+	// moderator screens prompts before any provider call and outputFilter
+	// responses before they are returned; nil when disabled
+	moderator    Moderator
+	outputFilter OutputFilter
+	
+	// jobs tracks requests answered through a callback, and callbackClient
+	// delivers their results
+	jobs           *JobStore
+	callbackClient *http.Client
+	
+	// idempotency replays responses to retried requests; nil when disabled
+	idempotency *IdempotencyStore
+	
+	// registry holds the providers requests can use; see RegisterProvider
+	registry map[ModelProvider]Provider
+	
+	// backends holds the upstream backends configured for each provider
+	backends map[ModelProvider]*backendPool
+	
+	breakersMu sync.Mutex
+	breakers   map[ModelProvider]*CircuitBreaker
+	
+	// inFlight counts LLM requests currently being handled
+	inFlight atomic.Int64
+	
+	// flights coalesces identical requests that miss the cache
+	flights flightGroup
+	
+	// noRateLimit is set by WithoutRateLimit; nilCacheWarning logs once when
+	// a Gateway built without NewGateway has no cache
+	noRateLimit     bool
+	nilCacheWarning sync.Once
+	
+	// FallbackProviders is the failover order used when a request sets none
+	FallbackProviders []ModelProvider
+	
+	// Retry is applied to each provider before failing over to the next
+	Retry RetryPolicy
+	
+	// Breaker configures the per-provider circuit breakers
+	Breaker BreakerPolicy
+	
+	// KeyFunc derives the rate limit bucket for a request. Defaults to DefaultKeyFunc.
+	KeyFunc func(r *http.Request) string
+	
+	// CallProvider makes the upstream call for each provider attempt, after
+	// failover, retries and the circuit breaker have picked it. Defaults to
+	// the built-in providers; tests can set it to answer without a network.
+	CallProvider ProviderFunc
+}
+
+// ProviderFunc answers an LLM request from a single provider
+type ProviderFunc func(ctx context.Context, req LLMRequest) (LLMResponse, error)
+
+// DefaultKeyFunc buckets requests by the label of the API key RequireAuth
+// verified, falling back to the client's IP address; see ClientIP. Key
+// headers that weren't verified are ignored, so a client can't get a fresh
+// bucket by sending a new one.
+func DefaultKeyFunc(r *http.Request) string {
+	if label := APIKeyLabel(r.Context()); label != "" {
+		return "key:" + label
+	}
+	return "ip:" + ClientIP(r)
 }
 
-// Cache struct for response caching
-type Cache struct {
-	mu    sync.RWMutex
-	data  map[string]CacheEntry
-	maxSize int
+// Metrics tracks API usage. The counters and histograms are atomics, so they
+// can be updated and read without a lock; mu only guards the providers map.
+// Read the counters through Snapshot.
+type Metrics struct {
+	totalRequests atomic.Int64
+	cacheHits     atomic.Int64
+	cacheMisses   atomic.Int64
+	errors        atomic.Int64
+	failovers     atomic.Int64
+	timeouts      atomic.Int64
+	coalesced     atomic.Int64
+	semanticHits  atomic.Int64
+	cancelled     atomic.Int64
+	moderated     atomic.Int64
+	outputBlocked atomic.Int64
+	staleServed   atomic.Int64
+	stopped       atomic.Int64
+	writeFailures atomic.Int64
+	latency       *Histogram
+	ttft          *Histogram
+	queueWait     *Histogram
+	
+	// shadow counts the calls mirrored to the shadow provider, those that
+	// failed and the sampled requests skipped for the shadow limits
+	shadowRequests atomic.Int64
+	shadowErrors   atomic.Int64
+	shadowSkipped  atomic.Int64
+	
+	mu        sync.RWMutex
+	providers map[ModelProvider]*providerMetrics
+	variants  map[experimentVariant]*atomic.Int64
+}
+
+// providerMetrics holds the per-provider breakdown
+type providerMetrics struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	timeouts atomic.Int64
+	limited  atomic.Int64
+	latency  *Histogram
+	ttft     *Histogram
+}
+
+// NewMetrics creates an empty metrics tracker
+func NewMetrics() *Metrics {
+	return &Metrics{
+		latency:   NewHistogram(),
+		ttft:      NewHistogram(),
+		queueWait: NewHistogram(),
+		providers: make(map[ModelProvider]*providerMetrics),
+		variants:  make(map[experimentVariant]*atomic.Int64),
+	}
+}
+
+// Option customizes a Gateway built by NewGateway
+type Option func(*Gateway)
+
+// WithCache selects the cache backend, e.g. a RedisCache shared between instances
+func WithCache(c Cache) Option {
+	return func(g *Gateway) {
+		g.cache = c
+	}
+}
+
+// WithoutCache disables response caching; every request goes upstream
+func WithoutCache() Option {
+	return func(g *Gateway) {
+		g.cache = nopCache{}
+	}
+}
+
+// WithoutRateLimit disables rate limiting
+func WithoutRateLimit() Option {
+	return func(g *Gateway) {
+		g.noRateLimit = true
+	}
+}
+
+// WithoutMetrics disables metrics collection; the metrics endpoints report zeros
+func WithoutMetrics() Option {
+	return func(g *Gateway) {
+		g.metrics = nil
+	}
+}
+
+// WithConfig applies settings loaded by LoadConfig. It replaces the whole
+// config, so put it before options that adjust individual settings.
+func WithConfig(cfg Config) Option {
+	return func(g *Gateway) {
+		g.config = cfg
+	}
+}
+
+// WithCacheSize sets how many responses the in-memory cache holds
+func WithCacheSize(n int) Option {
+	return func(g *Gateway) {
+		g.config.CacheMaxSize = n
+	}
+}
+
+// WithCacheTTL sets how long responses are cached by default
+func WithCacheTTL(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.config.CacheTTL = Duration(d)
+	}
+}
+
+// WithRateLimit allows limit requests per window for each client. A limit or
+// window of zero or less turns limiting off, like WithoutRateLimit.
+func WithRateLimit(limit int, window time.Duration) Option {
+	return func(g *Gateway) {
+		g.config.RateLimit = limit
+		g.config.RateWindow = Duration(window)
+	}
+}
+
+// WithAuditLogger replaces the audit logger built from the config, e.g. to
+// use a custom Redactor
+func WithAuditLogger(a *AuditLogger) Option {
+	return func(g *Gateway) {
+		g.audit = a
+	}
+}
+
+// WithHTTPClient replaces the upstream client built from Config.HTTPClient
+func WithHTTPClient(c *http.Client) Option {
+	return func(g *Gateway) {
+		g.client = c
+	}
+}
+
+// WithTracer replaces the tracer built from Config.Tracing
+func WithTracer(t *Tracer) Option {
+	return func(g *Gateway) {
+		g.tracer = t
+	}
+}
+
+// WithModerator replaces the moderator built from Config.Moderation, e.g.
+// to use a moderation backend of your own
+func WithModerator(m Moderator) Option {
+	return func(g *Gateway) {
+		g.moderator = m
+	}
+}
+
+// WithOutputFilter replaces the output filter built from
+// Config.OutputModeration
+func WithOutputFilter(f OutputFilter) Option {
+	return func(g *Gateway) {
+		g.outputFilter = f
+	}
+}
+
+// WithTemplates replaces the prompt templates loaded from the config
+func WithTemplates(t *TemplateStore) Option {
+	return func(g *Gateway) {
+		g.templates = t
+	}
+}
+
+// WithRateQueue lets up to depth requests per client wait for the rate limit
+// instead of being rejected straight away
+func WithRateQueue(depth int) Option {
+	return func(g *Gateway) {
+		g.config.RateQueue = depth
+	}
+}
+
+// WithProviderFunc routes every upstream call through f instead of the
+// built-in providers, e.g. to stub them out in tests
+func WithProviderFunc(f ProviderFunc) Option {
+	return func(g *Gateway) {
+		g.CallProvider = f
+	}
+}
+
+// WithProvider registers a custom provider, or replaces a built-in one; see
+// RegisterProvider
+func WithProvider(p Provider) Option {
+	return func(g *Gateway) {
+		g.RegisterProvider(p)
+	}
+}
+
+// WithProviders sets the credentials and endpoints of the given providers,
+// leaving any others as configured
+func WithProviders(providers map[ModelProvider]ProviderConfig) Option {
+	return func(g *Gateway) {
+		merged := make(map[ModelProvider]ProviderConfig, len(g.config.Providers)+len(providers))
+		for p, pc := range g.config.Providers {
+			merged[p] = pc
+		}
+		for p, pc := range providers {
+			merged[p] = pc
+		}
+		g.config.Providers = merged
+	}
+}
+
+// responseCache returns the gateway's cache, or a cache that stores nothing
+// when the Gateway was built without NewGateway and has none
+func (g *Gateway) responseCache() Cache {
+	if g.cache == nil {
+		g.nilCacheWarning.Do(func() {
+			slog.Warn("gateway has no cache configured; responses will not be cached")
+		})
+		return nopCache{}
+	}
+	return g.cache
+}
+
+// metricsOrEmpty returns the gateway's metrics, or an empty set to report
+// when metrics are disabled
+func (g *Gateway) metricsOrEmpty() *Metrics {
+	if g.metrics == nil {
+		return NewMetrics()
+	}
+	return g.metrics
+}
+
+// NewGateway creates a new gateway instance. Without options it uses
+// DefaultConfig; options are applied in order.
+func NewGateway(opts ...Option) *Gateway {
+	g := &Gateway{
+		config:  DefaultConfig(),
+		metrics: NewMetrics(),
+		KeyFunc: DefaultKeyFunc,
+		Retry:   DefaultRetryPolicy,
+		Breaker: DefaultBreakerPolicy,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.registry == nil {
+		g.registry = g.builtinProviders()
+	}
+	
+	cfg := g.config
+	if g.client == nil {
+		g.client = newHTTPClient(cfg.HTTPClient)
+	}
+	g.apiKeys = make(map[string]string, len(cfg.APIKeys))
+	g.budgets = make(map[string]float64, len(cfg.APIKeys))
+	g.policies = make(map[string]AccessPolicy)
+	g.priorities = make(map[string]Priority)
+	for _, k := range cfg.APIKeys {
+		label := k.Label
+		if label == "" {
+			// Attribute usage without exposing the key itself
+			sum := sha256.Sum256([]byte(k.Key))
+			label = "key-" + hex.EncodeToString(sum[:4])
+		}
+		g.apiKeys[k.Key] = label
+		g.budgets[label] = k.MonthlyBudget
+		if k.Access != nil {
+			g.policies[label] = *k.Access
+		}
+		if k.Priority != "" {
+			g.priorities[label] = k.Priority
+		}
+	}
+	g.pricing = make(map[string]ModelPrice, len(defaultPricing)+len(cfg.Pricing))
+	for model, price := range defaultPricing {
+		g.pricing[model] = price
+	}
+	for model, price := range cfg.Pricing {
+		g.pricing[model] = price
+	}
+	g.contextWindows = make(map[string]int, len(defaultContextWindows)+len(cfg.ContextWindows))
+	for model, window := range defaultContextWindows {
+		g.contextWindows[model] = window
+	}
+	for model, window := range cfg.ContextWindows {
+		g.contextWindows[model] = window
+	}
+	g.spend = NewSpendTracker()
+	g.shadowSpend = NewSpendTracker()
+	if cfg.Shadow.enabled() {
+		n := cfg.Shadow.MaxConcurrent
+		if n <= 0 {
+			n = defaultShadowConcurrency
+		}
+		g.shadowSlots = make(chan struct{}, n)
+	}
+	g.backends = make(map[ModelProvider]*backendPool, len(cfg.Providers))
+	g.slots = make(map[ModelProvider]*providerSlots, len(cfg.Providers))
+	for p, pc := range cfg.Providers {
+		g.backends[p] = newBackendPool(p, pc)
+		g.slots[p] = newProviderSlots(pc.MaxConcurrent)
+	}
+	g.tokenizer = newTokenizer(cfg.TokenizerDir)
+	if sc := cfg.SemanticCache; sc.Enabled {
+		max := sc.MaxEntries
+		if max <= 0 {
+			max = cfg.CacheMaxSize
+		}
+		g.semantic = newSemanticIndex(max, sc.Threshold)
+	}
+	if g.rateLimiter == nil && !g.noRateLimit && cfg.RateLimit > 0 && cfg.RateWindow > 0 {
+		window := time.Duration(cfg.RateWindow)
+		g.rateLimiter = NewRateLimiterWithSweeper(cfg.RateLimit, window, window)
+	}
+	g.jobs = NewJobStore(time.Duration(cfg.JobTTL), time.Minute)
+	g.callbackClient = newCallbackClient(cfg.HTTPClient, cfg.CallbackAllowPrivate)
+	if ttl := time.Duration(cfg.IdempotencyTTL); ttl > 0 {
+		g.idempotency = NewIdempotencyStore(ttl, time.Minute)
+	}
+	if g.audit == nil && cfg.Audit.Sink != "" {
+		audit, err := NewAuditLogger(cfg.Audit, nil)
+		if err != nil {
+			slog.Error("audit logging disabled", "err", err)
+		}
+		g.audit = audit
+	}
+	if g.tracer == nil {
+		g.tracer = NewTracer(cfg.Tracing)
+	}
+	trusted, err := parsePrefixes("trusted_proxies", cfg.TrustedProxies)
+	if err != nil {
+		slog.Error("invalid trusted proxies, ignoring forwarding headers", "err", err)
+	}
+	g.clientAddrs = clientAddrs{trusted: trusted}
+	if filter, err := newIPFilter(cfg.IPFilter); err != nil {
+		slog.Error("invalid ip filter, denying all requests", "err", err)
+		g.ipFilter = &ipFilter{denyAll: true}
+	} else {
+		g.ipFilter = filter
+	}
+	if g.moderator == nil {
+		g.moderator = g.newModerator(cfg.Moderation)
+	}
+	if g.outputFilter == nil {
+		filter, err := g.newOutputFilter(cfg.OutputModeration)
+		if err != nil {
+			slog.Error("output moderation disabled", "err", err)
+		}
+		g.outputFilter = filter
+	}
+	if g.templates == nil && (len(cfg.Templates) > 0 || cfg.TemplateDir != "") {
+		templates, err := LoadTemplates(cfg)
+		if err != nil {
+			slog.Error("prompt templates disabled", "err", err)
+		}
+		g.templates = templates
+	}
+	if g.cache == nil {
+		if cfg.RedisAddr != "" {
+			g.cache = NewRedisCache(RedisOptions{
+				Addr:     cfg.RedisAddr,
+				Password: cfg.RedisPassword,
+				StaleFor: time.Duration(cfg.StaleIfError),
+				
+				MaxEntryBytes: cfg.CacheMaxEntryBytes,
+			})
+		} else {
+			var c *MemoryCache
+			if cfg.CacheFile != "" {
+				c = NewPersistentCache(cfg.CacheMaxSize, cfg.CacheShards, 5*time.Minute, cfg.CacheFile)
+			} else {
+				c = NewCacheWithJanitor(cfg.CacheMaxSize, cfg.CacheShards, 5*time.Minute)
+			}
+			c.KeepStale(time.Duration(cfg.StaleIfError))
+			c.SetByteLimits(cfg.CacheMaxEntryBytes, cfg.CacheMaxBytes)
+			c.SetEviction(cfg.CacheEviction)
+			g.cache = c
+		}
+	}
+	return g
+}
+
+// InFlight returns the number of LLM requests currently being handled
+func (g *Gateway) InFlight() int64 {
+	return g.inFlight.Load()
+}
+
+// Close stops the background cache janitor and the rate limiter, job and
+// idempotency sweepers, flushes queued trace spans and releases cache
+// connections
+func (g *Gateway) Close() error {
+	if g.rateLimiter != nil {
+		g.rateLimiter.Close()
+	}
+	if g.jobs != nil {
+		g.jobs.Close()
+	}
+	if g.idempotency != nil {
+		g.idempotency.Close()
+	}
+	if err := g.audit.Close(); err != nil {
+		slog.Error("closing audit log", "err", err)
+	}
+	g.tracer.Close()
+	return g.responseCache().Close()
+}
+
+// Handler returns the gateway's routes on a mux of their own, so a Gateway
+// can be served, or tested with httptest, without touching
+// http.DefaultServeMux. Each call builds a new mux. With Config.AccessLog
+// every request is also logged to stdout; see AccessLog.
+//
+// When Config.AdminPort is set the admin routes are left out; serve
+// AdminHandler on that port instead.
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	g.publicRoutes(mux)
+	if g.config.AdminPort == "" {
+		g.adminRoutes(mux)
+	}
+	return g.ResolveClientIP(g.accessLog(g.IPFilter(mux)))
+}
+
+// AdminHandler returns the metrics and cache admin routes, with /health and
+// /ready for probes, for the listener on Config.AdminPort
+func (g *Gateway) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	g.adminRoutes(mux)
+	mux.HandleFunc("/health", g.HandleHealth)
+	mux.HandleFunc("/ready", g.HandleReady)
+	return g.ResolveClientIP(g.accessLog(g.IPFilter(mux)))
+}
+
+// publicRoutes registers the client-facing endpoints on mux
+func (g *Gateway) publicRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/llm", g.CORS(g.Traced(RequestID(Gzip(g.RequireAuth(g.limitBody(g.Idempotent(g.HandleLLMRequest))))))))
+	mux.HandleFunc("/api/llm/stop/", g.CORS(g.RequireAuth(g.HandleStopStream)))
+	mux.HandleFunc("/api/llm/estimate", g.CORS(g.RequireAuth(g.limitBody(g.HandleEstimate))))
+	mux.HandleFunc("/api/llm/batch", g.CORS(g.Traced(RequestID(Gzip(g.RequireAuth(g.limitBody(g.Idempotent(g.HandleBatch))))))))
+	mux.HandleFunc("/api/embeddings", g.CORS(g.Traced(RequestID(Gzip(g.RequireAuth(g.limitBody(g.HandleEmbeddings)))))))
+	mux.HandleFunc("/v1/chat/completions", g.CORS(g.Traced(RequestID(Gzip(g.RequireAuth(g.limitBody(g.Idempotent(g.HandleChatCompletions))))))))
+	mux.HandleFunc("/api/providers", g.CORS(g.RequireAuth(g.HandleProviders)))
+	mux.HandleFunc("/api/jobs/", g.CORS(g.RequireAuth(g.HandleJob)))
+	mux.HandleFunc("/health", g.HandleHealth)
+	mux.HandleFunc("/ready", g.HandleReady)
+
+	// Static file serving for frontend
+	mux.Handle("/", http.FileServer(http.Dir("./static")))
+}
+
+// adminRoutes registers the metrics and cache admin endpoints on mux
+func (g *Gateway) adminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/metrics", Gzip(g.HandleMetrics))
+	mux.HandleFunc("/api/cache", g.CORS(g.RequireAuth(g.HandleCache)))
+	mux.HandleFunc("/metrics", g.HandlePrometheusMetrics)
+}
+
+// accessLog wraps h in AccessLog when Config.AccessLog is set
+func (g *Gateway) accessLog(h http.Handler) http.Handler {
+	if g.config.AccessLog {
+		return AccessLog(h, os.Stdout)
+	}
+	return h
+}
+
+// limitBody caps the request body at Config.MaxBodyBytes, so an oversized
+// payload fails to decode instead of being read into memory whole
+func (g *Gateway) limitBody(next http.HandlerFunc) http.HandlerFunc {
+	max := int64(g.config.MaxBodyBytes)
+	if max <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		next(w, r)
+	}
+}
+
+// bodyTooLarge reports whether reading a request body failed because it went
+// over the limitBody cap
+func bodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// invalidBody writes the error for a request body that couldn't be decoded:
+// 413 when it was too large, otherwise 400
+func (g *Gateway) invalidBody(w http.ResponseWriter, r *http.Request, err error) {
+	if bodyTooLarge(err) {
+		g.writeError(w, r, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, "Request body too large")
+		return
+	}
+	g.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Invalid request")
+}
+
+// pathParam returns the single path segment following prefix, as in the
+// {id} of /api/jobs/{id}. It reports false when the segment is missing or
+// more of the path follows it.
+func pathParam(r *http.Request, prefix string) (string, bool) {
+	param, ok := strings.CutPrefix(r.URL.Path, prefix)
+	if !ok || param == "" || strings.Contains(param, "/") {
+		return "", false
+	}
+	return param, true
+}
+
+// cacheKeyFor builds the cache key from every field that affects the output.
+// The fields are hashed so keys stay small however long the conversation is;
+// the provider stays readable as a prefix so entries can be invalidated per
+// provider. Temperature is formatted in its shortest form so 0.7 and 0.70
+// share a key, and a Prompt shares its entry with the equivalent one message
+// conversation. Message text is normalized according to norm; the request
+// sent upstream is never changed. With norm.IgnoreProvider the key uses the
+// model family in place of the provider and model, under sharedKeyPrefix.
+// Changing version makes every existing entry unreachable, invalidating the
+// whole cache without a flush.
+func cacheKeyFor(req LLMRequest, norm KeyNormalization, version string) string {
+	// An unset temperature keeps the "0" it was keyed as before it could be
+	// told apart from an explicit 0, which gets a part of its own below
+	temperature := "0"
+	if req.Temperature != nil {
+		temperature = strconv.FormatFloat(*req.Temperature, 'f', -1, 64)
+	}
+	
+	msgs := req.conversation()
+	if norm.Whitespace || norm.Lowercase {
+		normalized := make([]Message, len(msgs))
+		for i, m := range msgs {
+			normalized[i] = m
+			normalized[i].Content = norm.apply(m.Content)
+		}
+		msgs = normalized
+	}
+	encoded, _ := json.Marshal(msgs)
+	
+	model, prefix := req.Model, string(req.Provider)+":"
+	if norm.IgnoreProvider {
+		model, prefix = norm.family(req.Model), sharedKeyPrefix
+	}
+	
+	parts := []string{version, model, strconv.Itoa(req.MaxTokens), temperature, string(encoded)}
+	// Optional parameters are kept out of the key when unset so existing
+	// entries stay valid
+	if req.ResponseFormat == ResponseFormatJSON {
+		parts = append(parts, "response_format="+req.ResponseFormat)
+	}
+	if req.Temperature != nil && *req.Temperature == 0 {
+		parts = append(parts, "temperature=0")
+	}
+	if req.TopP != nil {
+		parts = append(parts, "top_p="+strconv.FormatFloat(*req.TopP, 'f', -1, 64))
+	}
+	if len(req.Stop) > 0 {
+		stop, _ := json.Marshal(req.Stop)
+		parts = append(parts, "stop="+string(stop))
+	}
+	if req.N > 1 {
+		parts = append(parts, "n="+strconv.Itoa(req.N))
+	}
+	if tools := req.toolsKey(); tools != "" {
+		parts = append(parts, tools)
+	}
+	if req.Mock != nil {
+		// Scripted mock responses differ per script
+		script, _ := json.Marshal(req.Mock)
+		parts = append(parts, string(script))
+	}
+	return prefix + hashKey(parts...)
+}
+
+// hashKey returns the hex SHA-256 of parts. Each part is length-prefixed so
+// that ("ab", "c") and ("a", "bc") hash differently.
+func hashKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HandleLLMRequest processes incoming LLM requests
+func (g *Gateway) HandleLLMRequest(w http.ResponseWriter, r *http.Request) {
+	g.inFlight.Add(1)
+	defer g.inFlight.Add(-1)
+	
+	w.Header().Set("Content-Type", "application/json")
+	
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		g.writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	
+	if !g.allowRequest(w, r) {
+		g.writeError(w, r, http.StatusTooManyRequests, CodeRateLimited, "Rate limit exceeded")
+		g.metrics.RecordError()
+		return
+	}
+	
+	// Parse request
+	var req LLMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		g.invalidBody(w, r, err)
+		g.metrics.RecordError()
+		return
+	}
+	if noCacheRequested(r) {
+		req.NoCache = true
+	}
+	g.applyDefaults(&req)
+	g.routeExperiment(w, r, &req)
+	if err := timeoutHeader(r, &req); err != nil {
+		g.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		g.metrics.RecordError()
+		return
+	}
+	
+	invalid := g.renderTemplate(&req)
+	if invalid == nil {
+		invalid = g.validate(req)
+	}
+	if invalid != nil {
+		g.writeErrorResponse(w, r, http.StatusBadRequest, ErrorResponse{
+			Code:    CodeInvalidRequest,
+			Message: invalid.Error(),
+			Field:   invalid.Field,
+		})
+		g.metrics.RecordError()
+		return
+	}
+	
+	if err := g.checkAccess(r.Context(), req); err != nil {
+		g.writeError(w, r, http.StatusForbidden, CodeForbidden, err.Error())
+		g.metrics.RecordError()
+		return
+	}
+	
+	if g.overBudget(r.Context()) {
+		g.budgetExceeded(w, r)
+		g.metrics.RecordError()
+		return
+	}
+	
+	if reason, err := g.moderate(r.Context(), req); err != nil {
+		g.writeError(w, r, http.StatusBadGateway, CodeProviderError, err.Error())
+		g.metrics.RecordError()
+		return
+	} else if reason != "" {
+		g.moderationBlocked(w, r, reason)
+		return
+	}
+	
+	if req.CallbackURL != "" {
+		job := g.startJob(r, req)
+		w.Header().Set("Location", "/api/jobs/"+job.ID)
+		g.writeJSON(w, r, http.StatusAccepted, job)
+		return
+	}
+	
+	ctx, cancel := g.withRequestTimeout(r.Context(), req)
+	defer cancel()
+	
+	if req.Stream {
+		g.handleStream(w, r.WithContext(ctx), req, gatewayStream{})
+		return
+	}
+	
+	response, err := g.completeLLMRequest(ctx, req)
+	if err != nil {
+		if g.clientCancelled(w, ctx) {
+			return
+		}
+		status, code := errorStatus(ctx, err)
+		g.writeError(w, r, status, code, err.Error())
+		g.metrics.RecordError()
+		return
+	}
+	
+	// Send response
+	setResponseHeaders(w, response)
+	g.writeJSON(w, r, http.StatusOK, response)
+}
+
+// setResponseHeaders repeats the main fields of a response in headers, so
+// clients and proxies can act on them without parsing the body
+func setResponseHeaders(w http.ResponseWriter, response LLMResponse) {
+	h := w.Header()
+	h.Set("X-Provider", string(response.Provider))
+	h.Set("X-Model", response.Model)
+	if response.Cached {
+		h.Set("X-Cache", "HIT")
+	} else {
+		h.Set("X-Cache", "MISS")
+	}
+	if response.Stale {
+		h.Set("X-Cache-Stale", "true")
+	}
+	h.Set("X-Tokens-Used", strconv.Itoa(response.TokensUsed))
+	h.Set("X-Response-Time-Ms", strconv.FormatFloat(response.ResponseTime, 'f', -1, 64))
+}
+
+// allowRequest applies rate limiting and sets the X-RateLimit-* headers. With
+// a rate queue configured, requests over the limit wait their turn first. When
+// the request is rejected it also sets Retry-After and returns false; the
+// caller writes the 429 body in its own format.
+func (g *Gateway) allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	if g.rateLimiter == nil {
+		return true
+	}
+	keyFunc := g.KeyFunc
+	if keyFunc == nil {
+		keyFunc = DefaultKeyFunc
+	}
+	key := keyFunc(r)
+	allowed, remaining, reset := g.rateLimiter.AllowWithInfo(key)
+	if !allowed && g.config.RateQueue > 0 {
+		// Wait for the next free token instead of rejecting; a full queue or
+		// a client that goes away still ends in 429. The server only notices
+		// a disconnect once the body has been read, so buffer it first.
+		if body, err := io.ReadAll(r.Body); err == nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		start := time.Now()
+		if err := g.rateLimiter.Wait(r.Context(), key, g.config.RateQueue); err == nil {
+			g.metrics.RecordQueueWait(time.Since(start))
+			allowed, remaining = true, 0
+		}
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(g.rateLimiter.Limit()))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if !allowed {
+		retryAfter := int(math.Ceil(time.Until(reset).Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	return allowed
+}
+
+// rateQueueDepth returns how many requests are waiting for the rate limit
+func (g *Gateway) rateQueueDepth() int {
+	if g.rateLimiter == nil {
+		return 0
+	}
+	return g.rateLimiter.Queued()
+}
+
+// completeLLMRequest serves a validated request from the cache or, on a miss,
+// from the providers, caching the fresh response. The outcome is audited.
+func (g *Gateway) completeLLMRequest(ctx context.Context, req LLMRequest) (response LLMResponse, err error) {
+	defer func() { g.audit.Log(ctx, req, response, err) }()
+	ctx, span := g.tracer.Start(ctx, "gateway.complete", spanKindInternal)
+	defer func() {
+		span.SetAttr("gen_ai.system", string(response.Provider))
+		span.SetAttr("gen_ai.request.model", req.Model)
+		span.SetAttr("gateway.cache_hit", response.Cached)
+		span.SetAttr("gen_ai.usage.total_tokens", response.TokensUsed)
+		span.RecordError(err)
+		span.End()
+	}()
+	
+	// Check cache
+	cacheKey := cacheKeyFor(req, g.config.CacheKeys, g.config.CacheVersion)
+	ttl, cacheable := g.cacheTTL(req)
+	var embedding []float32
+	if cacheable && !req.NoCache {
+		cached, found := g.responseCache().Get(cacheKey)
+		if !found {
+			if cached, embedding, found = g.semanticLookup(ctx, req); found {
+				g.metrics.RecordSemanticHit()
+			}
+		}
+		if found {
+			g.metrics.RecordCacheHit()
+			cached.Cached = true
+			return cached, nil
+		}
+	}
+	
+	g.metrics.RecordCacheMiss()
+	
+	fetch := func() (LLMResponse, error) {
+		startTime := time.Now()
+		response, err := g.processLLMRequest(ctx, req)
+		elapsed := time.Since(startTime)
+		if err != nil {
+			return LLMResponse{}, err
+		}
+		
+		response.ResponseTime = float64(elapsed.Milliseconds())
+		response.EstimatedCost = g.estimateCost(response)
+		if err := g.filterOutput(ctx, &response); err != nil {
+			return LLMResponse{}, err
+		}
+		
+		// Cache response
+		if cacheable {
+			g.responseCache().Set(cacheKey, response, ttl)
+			g.semanticStore(req, cacheKey, embedding)
+		}
+		
+		g.metrics.RecordRequestForProvider(response.Provider)
+		g.metrics.RecordLatency(response.Provider, elapsed)
+		return response, nil
+	}
+	
+	// Identical requests already in flight share a single upstream call
+	var shared bool
+	for {
+		response, err, shared = g.flights.Do(ctx, cacheKey, fetch)
+		// The client whose call was shared went away; a client still
+		// waiting makes the call itself instead of failing with it
+		if shared && !clientGone(ctx) && errors.Is(err, context.Canceled) {
+			continue
+		}
+		break
+	}
+	if err != nil {
+		if cacheable {
+			if stale, ok := g.staleResponse(ctx, req, cacheKey, err); ok {
+				return stale, nil
+			}
+		}
+		return LLMResponse{}, err
+	}
+	if shared {
+		g.metrics.RecordCoalesced()
+	} else {
+		g.recordSpend(ctx, response)
+		g.shadow(ctx, req, response)
+	}
+	
+	g.metrics.RecordRequest()
+	return response, nil
+}
+
+// processLLMRequest handles the actual LLM API call, failing over to the next
+// provider in the chain whenever one returns an error
+func (g *Gateway) processLLMRequest(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	priority := g.requestPriority(ctx, req)
+	// failed is the provider lastErr came from, which is not req.Provider
+	// once a fallback has failed too
+	var lastErr error
+	var failed ModelProvider
+	for i, provider := range g.providerChain(req) {
+		if i > 0 {
+			g.metrics.RecordFailover()
+			slog.Warn("provider failed, failing over", "request_id", RequestIDFrom(ctx), "provider", failed, "fallback", provider, "err", lastErr)
+		}
+		
+		attempt := req
+		attempt.Provider = provider
+		warnIgnoredParams(provider, attempt)
+		var response LLMResponse
+		err := g.guardedCall(ctx, provider, priority, func(ctx context.Context) error {
+			ctx, span := g.tracer.Start(ctx, "gateway.provider_call", spanKindClient)
+			defer span.End()
+			span.SetAttr("gen_ai.system", string(provider))
+			span.SetAttr("gen_ai.request.model", attempt.Model)
+			var err error
+			response, err = g.callProvider(ctx, attempt)
+			span.SetAttr("gen_ai.usage.total_tokens", response.TokensUsed)
+			span.RecordError(err)
+			return err
+		})
+		if err == nil {
+			g.estimateUsage(attempt, &response)
+			slog.Debug("provider call succeeded", "request_id", RequestIDFrom(ctx), "provider", provider,
+				"model", response.Model, "tokens", response.TokensUsed)
+			return response, nil
+		}
+		
+		// No point trying other providers once the client has gone away,
+		// and a call it abandoned says nothing about the provider
+		if clientGone(ctx) {
+			return LLMResponse{}, err
+		}
+		g.recordProviderFailure(provider, err)
+		if ctx.Err() != nil {
+			return LLMResponse{}, err
+		}
+		lastErr, failed = err, provider
+	}
+	return LLMResponse{}, lastErr
+}
+
+// recordProviderFailure counts a failed provider call, keeping timeouts
+// separate from other errors
+func (g *Gateway) recordProviderFailure(p ModelProvider, err error) {
+	if errors.Is(err, ErrProviderTimeout) {
+		g.metrics.RecordTimeoutForProvider(p)
+		return
+	}
+	g.metrics.RecordErrorForProvider(p)
+}
+
+// providerTimeout returns how long a single provider call may take
+func (g *Gateway) providerTimeout(p ModelProvider) time.Duration {
+	if timeout := time.Duration(g.config.Providers[p].Timeout); timeout > 0 {
+		return timeout
+	}
+	return defaultProviderTimeout
+}
+
+// providerChain returns the requested provider followed by the fallbacks to try,
+// preferring the request's own list over the gateway-wide one. Fallbacks
+// that can't serve a request using tools are left out.
+func (g *Gateway) providerChain(req LLMRequest) []ModelProvider {
+	fallbacks := req.FallbackProviders
+	if len(fallbacks) == 0 {
+		fallbacks = g.FallbackProviders
+	}
+	
+	chain := []ModelProvider{req.Provider}
+	for _, p := range fallbacks {
+		if req.usesTools() && !supportsTools(p) {
+			continue
+		}
+		seen := false
+		for _, c := range chain {
+			if c == p {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			chain = append(chain, p)
+		}
+	}
+	return chain
+}
+
+// callProvider dispatches a request to a single provider
+func (g *Gateway) callProvider(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	if g.CallProvider != nil {
+		return g.CallProvider(ctx, req)
+	}
+	
+	p, ok := g.lookupProvider(req.Provider)
+	if !ok {
+		return LLMResponse{}, fmt.Errorf("unsupported provider: %s", req.Provider)
+	}
+	if req.N > 1 && !supportsN(req.Provider) {
+		return g.callEach(ctx, p, req)
+	}
+	return p.Call(ctx, req)
+}
+
+// supportsN reports whether a provider can return several completions from
+// one call
+func supportsN(p ModelProvider) bool {
+	return p == OpenAI || p == AzureOpenAI
+}
+
+// callEach gets req.N completions from a provider that only gives one per
+// call by calling it that many times. Usage is summed, since every call
+// reads the prompt again.
+func (g *Gateway) callEach(ctx context.Context, p Provider, req LLMRequest) (LLMResponse, error) {
+	n := req.N
+	req.N = 1
+	var merged LLMResponse
+	for i := 0; i < n; i++ {
+		response, err := p.Call(ctx, req)
+		if err != nil {
+			return LLMResponse{}, err
+		}
+		g.estimateUsage(req, &response)
+		if i == 0 {
+			merged = response
+		} else {
+			merged.TokensUsed += response.TokensUsed
+			merged.PromptTokens += response.PromptTokens
+			merged.CompletionTokens += response.CompletionTokens
+		}
+		merged.Responses = append(merged.Responses, response.Response)
+	}
+	return merged, nil
+}
+
+// ErrProviderTimeout is returned when a provider exceeds its configured timeout
+var ErrProviderTimeout = errors.New("provider timeout")
+
+// UpstreamError is returned when a provider responds with a non-200 status
+type UpstreamError struct {
+	Provider   ModelProvider
+	StatusCode int
+	Body       string
+	
+	// RetryAfter is how long the provider asked callers to wait, from its
+	// Retry-After header
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.Provider, e.StatusCode, e.Body)
+}
+
+// sendUpstream POSTs payload as JSON to an upstream provider and returns the
+// response once a 200 has been received. Callers must close the body.
+func (g *Gateway) sendUpstream(ctx context.Context, provider ModelProvider, url string, headers map[string]string, payload interface{}) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s request: %w", provider, err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("building %s request: %w", provider, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		httpReq.Header.Set(k, v)
+	}
+	return g.doUpstream(provider, httpReq)
+}
+
+// doUpstream sends a prepared request to a provider, turning any status
+// other than 200 into an UpstreamError. Callers must close the body.
+func (g *Gateway) doUpstream(provider ModelProvider, httpReq *http.Request) (*http.Response, error) {
+	client := g.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	injectTraceparent(httpReq)
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", provider, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBody))
+		return nil, &UpstreamError{
+			Provider:   provider,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(errBody)),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	return resp, nil
+}
+
+// postJSON sends payload as JSON to an upstream provider and decodes the reply into out
+func (g *Gateway) postJSON(ctx context.Context, provider ModelProvider, url string, headers map[string]string, payload, out interface{}) error {
+	resp, err := g.sendUpstream(ctx, provider, url, headers, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", provider, err)
+	}
+	return nil
 }
 
-type CacheEntry struct {
-	Response  LLMResponse
-	Timestamp time.Time
-	TTL       time.Duration
+// OpenAI chat completions wire format
+type openAIChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []Message             `json:"messages"`
+	MaxTokens      int                   `json:"max_tokens,omitempty"`
+	Temperature    *float64              `json:"temperature,omitempty"`
+	TopP           *float64              `json:"top_p,omitempty"`
+	Stop           []string              `json:"stop,omitempty"`
+	Stream         bool                  `json:"stream,omitempty"`
+	StreamOptions  *openAIStreamOptions  `json:"stream_options,omitempty"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+	N              int                   `json:"n,omitempty"`
+	Tools          []Tool                `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage       `json:"tool_choice,omitempty"`
 }
 
-// NewCache creates a new cache instance
-func NewCache(maxSize int) *Cache {
-	return &Cache{
-		data:    make(map[string]CacheEntry),
-		maxSize: maxSize,
-	}
+type openAIResponseFormat struct {
+	Type string `json:"type"`
 }
 
-// Get retrieves from cache
-func (c *Cache) Get(key string) (LLMResponse, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	
-	entry, exists := c.data[key]
-	if !exists {
-		return LLMResponse{}, false
+// openAIFormat returns the response_format for a request, nil when unset
+func openAIFormat(req LLMRequest) *openAIResponseFormat {
+	if req.ResponseFormat == "" {
+		return nil
 	}
-	
-	// Check if expired
-	if time.Since(entry.Timestamp) > entry.TTL {
-		return LLMResponse{}, false
-	}
-	
-	return entry.Response, true
+	return &openAIResponseFormat{Type: req.ResponseFormat}
 }
 
-// Set stores in cache
-func (c *Cache) Set(key string, response LLMResponse, ttl time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	
-	// Simple eviction if cache is full
-	if len(c.data) >= c.maxSize {
-		// Remove oldest entry
-		var oldestKey string
-		oldestTime := time.Now()
-		for k, v := range c.data {
-			if v.Timestamp.Before(oldestTime) {
-				oldestTime = v.Timestamp
-				oldestKey = k
-			}
-		}
-		delete(c.data, oldestKey)
-	}
-	
-	c.data[key] = CacheEntry{
-		Response:  response,
-		Timestamp: time.Now(),
-		TTL:       ttl,
-	}
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
-// RateLimiter for API rate limiting
-type RateLimiter struct {
-	mu       sync.Mutex
-	requests map[string][]time.Time
-	limit    int
-	window   time.Duration
+type openAIChatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message Message `json:"message"`
+	} `json:"choices"`
+	Usage openAIUsage `json:"usage"`
 }
 
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
-	return &RateLimiter{
-		requests: make(map[string][]time.Time),
-		limit:    limit,
-		window:   window,
-	}
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
-// Allow checks if request is allowed
-func (rl *RateLimiter) Allow(key string) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	
-	now := time.Now()
-	windowStart := now.Add(-rl.window)
-	
-	// Clean old requests
-	requests := rl.requests[key]
-	validRequests := []time.Time{}
-	for _, reqTime := range requests {
-		if reqTime.After(windowStart) {
-			validRequests = append(validRequests, reqTime)
-		}
+// openAIRequest returns the endpoint, auth headers and payload for an OpenAI call
+func (g *Gateway) openAIRequest(req LLMRequest) (string, map[string]string, openAIChatRequest, error) {
+	b, err := g.backend(OpenAI)
+	if err != nil {
+		return "", nil, openAIChatRequest{}, err
 	}
-	
-	// Check limit
-	if len(validRequests) >= rl.limit {
-		return false
+	if b.APIKey == "" {
+		return "", nil, openAIChatRequest{}, fmt.Errorf("no API key configured for openai backend %s", b.Name)
 	}
-	
-	// Add new request
-	validRequests = append(validRequests, now)
-	rl.requests[key] = validRequests
-	
-	return true
-}
-
-// Gateway is the main API gateway
-type Gateway struct {
-	cache       *Cache
-	rateLimiter *RateLimiter
-	metrics     *Metrics
-}
+	baseURL := b.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	url := baseURL + "/chat/completions"
+	headers := map[string]string{"Authorization": "Bearer " + b.APIKey}
 
-// Metrics tracks API usage
-type Metrics struct {
-	mu            sync.RWMutex
-	totalRequests int64
-	cacheHits     int64
-	cacheMisses   int64
-	errors        int64
-}
+	payload := openAIChatRequest{
+		Model:       req.Model,
+		Messages:    req.conversation(),
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
 
-// NewGateway creates a new gateway instance
-func NewGateway() *Gateway {
-	return &Gateway{
-		cache:       NewCache(1000),
-		rateLimiter: NewRateLimiter(100, time.Minute),
-		metrics:     &Metrics{},
+		TopP:           req.TopP,
+		Stop:           req.Stop,
+		ResponseFormat: openAIFormat(req),
+		N:              req.N,
+		Tools:          req.Tools,
+		ToolChoice:     req.ToolChoice,
 	}
+	return url, headers, payload, nil
 }
 
-// HandleLLMRequest processes incoming LLM requests
-func (g *Gateway) HandleLLMRequest(w http.ResponseWriter, r *http.Request) {
-	// CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "application/json")
-	
-	// Rate limiting
-	clientIP := r.RemoteAddr
-	if !g.rateLimiter.Allow(clientIP) {
-		http.Error(w, `{"error":"Rate limit exceeded"}`, http.StatusTooManyRequests)
-		g.metrics.RecordError()
-		return
+// azureOpenAIRequest returns the deployment endpoint, api-key header and
+// payload for an Azure OpenAI call. The URL has the form
+// {base_url}/openai/deployments/{deployment}/chat/completions?api-version=...
+func (g *Gateway) azureOpenAIRequest(req LLMRequest) (string, map[string]string, openAIChatRequest, error) {
+	b, err := g.backend(AzureOpenAI)
+	if err != nil {
+		return "", nil, openAIChatRequest{}, err
 	}
-	
-	// Parse request
-	var req LLMRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"error":"Invalid request"}`, http.StatusBadRequest)
-		g.metrics.RecordError()
-		return
+	if b.APIKey == "" || b.BaseURL == "" {
+		return "", nil, openAIChatRequest{}, fmt.Errorf("azure backend %s needs an API key and base URL", b.Name)
 	}
 	
-	// Generate cache key
-	cacheKey := fmt.Sprintf("%s:%s:%s", req.Provider, req.Model, req.Prompt)
-	
-	// Check cache
-	if cached, found := g.cache.Get(cacheKey); found {
-		g.metrics.RecordCacheHit()
-		cached.Cached = true
-		json.NewEncoder(w).Encode(cached)
-		return
+	pc := g.config.Providers[AzureOpenAI]
+	deployment := pc.Deployment
+	if deployment == "" {
+		deployment = req.Model
+	}
+	if deployment == "" {
+		return "", nil, openAIChatRequest{}, fmt.Errorf("azure: no deployment configured and no model requested")
+	}
+	apiVersion := pc.APIVersion
+	if apiVersion == "" {
+		apiVersion = defaultAzureAPIVersion
 	}
 	
-	g.metrics.RecordCacheMiss()
-	
-	// Process request
-	startTime := time.Now()
-	response, err := g.processLLMRequest(r.Context(), req)
-	responseTime := time.Since(startTime).Milliseconds()
+	endpoint := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+		strings.TrimSuffix(b.BaseURL, "/"), url.PathEscape(deployment), url.QueryEscape(apiVersion))
+	headers := map[string]string{"api-key": b.APIKey}
 	
+	payload := openAIChatRequest{
+		Model:       req.Model,
+		Messages:    req.conversation(),
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+		
+		TopP:           req.TopP,
+		Stop:           req.Stop,
+		ResponseFormat: openAIFormat(req),
+		N:              req.N,
+		Tools:          req.Tools,
+		ToolChoice:     req.ToolChoice,
+	}
+	return endpoint, headers, payload, nil
+}
+
+// callOpenAI calls the OpenAI chat completions API
+func (g *Gateway) callOpenAI(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	url, headers, payload, err := g.openAIRequest(req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusInternalServerError)
-		g.metrics.RecordError()
-		return
+		return LLMResponse{}, err
 	}
-	
-	response.ResponseTime = float64(responseTime)
-	
-	// Cache response
-	g.cache.Set(cacheKey, response, 1*time.Hour)
-	
-	// Send response
-	g.metrics.RecordRequest()
-	json.NewEncoder(w).Encode(response)
+	return g.postOpenAIChat(ctx, OpenAI, url, headers, payload)
 }
 
-// processLLMRequest handles the actual LLM API call
-func (g *Gateway) processLLMRequest(ctx context.Context, req LLMRequest) (LLMResponse, error) {
-	// This would call the actual LLM APIs
-	// For demo purposes, return simulated response
-	
-	switch req.Provider {
-	case OpenAI:
-		return g.callOpenAI(ctx, req)
-	case Anthropic:
-		return g.callAnthropic(ctx, req)
-	case Google:
-		return g.callGoogle(ctx, req)
-	case DeepSeek:
-		return g.callDeepSeek(ctx, req)
-	default:
-		return LLMResponse{}, fmt.Errorf("unsupported provider: %s", req.Provider)
+// callAzureOpenAI calls a chat completions deployment on Azure OpenAI
+func (g *Gateway) callAzureOpenAI(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	url, headers, payload, err := g.azureOpenAIRequest(req)
+	if err != nil {
+		return LLMResponse{}, err
 	}
+	return g.postOpenAIChat(ctx, AzureOpenAI, url, headers, payload)
 }
 
-// Provider-specific methods (simulated for demo)
-func (g *Gateway) callOpenAI(ctx context.Context, req LLMRequest) (LLMResponse, error) {
-	// Simulate API call
-	time.Sleep(500 * time.Millisecond)
-	
-	return LLMResponse{
-		Provider:   OpenAI,
-		Model:      req.Model,
-		Response:   fmt.Sprintf("OpenAI response to: %s", req.Prompt),
-		TokensUsed: len(req.Prompt) / 4,
+// postOpenAIChat sends a chat completions request to an OpenAI-compatible
+// endpoint and translates the reply
+func (g *Gateway) postOpenAIChat(ctx context.Context, provider ModelProvider, url string, headers map[string]string, payload openAIChatRequest) (LLMResponse, error) {
+	var result openAIChatResponse
+	if err := g.postJSON(ctx, provider, url, headers, payload, &result); err != nil {
+		return LLMResponse{}, err
+	}
+	if len(result.Choices) == 0 {
+		return LLMResponse{}, fmt.Errorf("%s returned no choices", provider)
+	}
+
+	model := result.Model
+	if model == "" {
+		model = payload.Model
+	}
+
+	response := LLMResponse{
+		Provider:   provider,
+		Model:      model,
+		Response:   result.Choices[0].Message.Content,
+		TokensUsed: result.Usage.TotalTokens,
 		Cached:     false,
-	}, nil
+		
+		PromptTokens:     result.Usage.PromptTokens,
+		CompletionTokens: result.Usage.CompletionTokens,
+		ToolCalls:        result.Choices[0].Message.ToolCalls,
+	}
+	if payload.N > 1 {
+		for _, choice := range result.Choices {
+			response.Responses = append(response.Responses, choice.Message.Content)
+		}
+	}
+	return response, nil
+}
+
+// simulateLatency waits like a real upstream call would, honouring ctx
+func simulateLatency(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// Remaining providers are simulated for demo
 func (g *Gateway) callAnthropic(ctx context.Context, req LLMRequest) (LLMResponse, error) {
-	time.Sleep(450 * time.Millisecond)
+	if err := simulateLatency(ctx, 450*time.Millisecond); err != nil {
+		return LLMResponse{}, err
+	}
 	
 	return LLMResponse{
 		Provider:   Anthropic,
 		Model:      req.Model,
-		Response:   fmt.Sprintf("Anthropic response to: %s", req.Prompt),
-		TokensUsed: len(req.Prompt) / 4,
+		Response:   fmt.Sprintf("Anthropic response to: %s", req.lastUserMessage()),
+		TokensUsed: g.estimateTokens(req.Model, req.lastUserMessage()),
 		Cached:     false,
 	}, nil
 }
 
 func (g *Gateway) callGoogle(ctx context.Context, req LLMRequest) (LLMResponse, error) {
-	time.Sleep(400 * time.Millisecond)
+	if err := simulateLatency(ctx, 400*time.Millisecond); err != nil {
+		return LLMResponse{}, err
+	}
 	
 	return LLMResponse{
 		Provider:   Google,
 		Model:      req.Model,
-		Response:   fmt.Sprintf("Google response to: %s", req.Prompt),
-		TokensUsed: len(req.Prompt) / 4,
+		Response:   fmt.Sprintf("Google response to: %s", req.lastUserMessage()),
+		TokensUsed: g.estimateTokens(req.Model, req.lastUserMessage()),
 		Cached:     false,
 	}, nil
 }
 
 func (g *Gateway) callDeepSeek(ctx context.Context, req LLMRequest) (LLMResponse, error) {
-	time.Sleep(350 * time.Millisecond)
+	if err := simulateLatency(ctx, 350*time.Millisecond); err != nil {
+		return LLMResponse{}, err
+	}
 	
 	return LLMResponse{
 		Provider:   DeepSeek,
 		Model:      req.Model,
-		Response:   fmt.Sprintf("DeepSeek response to: %s", req.Prompt),
-		TokensUsed: len(req.Prompt) / 4,
+		Response:   fmt.Sprintf("DeepSeek response to: %s", req.lastUserMessage()),
+		TokensUsed: g.estimateTokens(req.Model, req.lastUserMessage()),
 		Cached:     false,
 	}, nil
 }
 
-// Metrics methods
+// Metrics methods. A nil *Metrics discards everything, so a Gateway built
+// without metrics can still record them.
 func (m *Metrics) RecordRequest() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.totalRequests++
+	if m == nil {
+		return
+	}
+	m.totalRequests.Add(1)
+}
+
+// RecordQueueWait records how long a request waited in the rate limit queue
+func (m *Metrics) RecordQueueWait(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.queueWait.Observe(d)
 }
 
 func (m *Metrics) RecordCacheHit() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.cacheHits++
+	if m == nil {
+		return
+	}
+	m.cacheHits.Add(1)
 }
 
 func (m *Metrics) RecordCacheMiss() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.cacheMisses++
+	if m == nil {
+		return
+	}
+	m.cacheMisses.Add(1)
 }
 
 func (m *Metrics) RecordError() {
+	if m == nil {
+		return
+	}
+	m.errors.Add(1)
+}
+
+func (m *Metrics) RecordFailover() {
+	if m == nil {
+		return
+	}
+	m.failovers.Add(1)
+}
+
+// provider returns the breakdown for p, creating it on first use
+func (m *Metrics) provider(p ModelProvider) *providerMetrics {
+	m.mu.RLock()
+	pm, exists := m.providers[p]
+	m.mu.RUnlock()
+	if exists {
+		return pm
+	}
+	
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.errors++
+	if pm, exists = m.providers[p]; !exists {
+		pm = &providerMetrics{latency: NewHistogram(), ttft: NewHistogram()}
+		m.providers[p] = pm
+	}
+	return pm
+}
+
+// experimentVariant identifies a variant's counter in Metrics
+type experimentVariant struct {
+	experiment, variant string
+}
+
+// RecordExperimentVariant counts a request routed to an experiment variant
+func (m *Metrics) RecordExperimentVariant(experiment, variant string) {
+	if m == nil {
+		return
+	}
+	key := experimentVariant{experiment, variant}
+	m.mu.RLock()
+	n, exists := m.variants[key]
+	m.mu.RUnlock()
+	if !exists {
+		m.mu.Lock()
+		if n, exists = m.variants[key]; !exists {
+			n = new(atomic.Int64)
+			m.variants[key] = n
+		}
+		m.mu.Unlock()
+	}
+	n.Add(1)
+}
+
+func (m *Metrics) RecordRequestForProvider(p ModelProvider) {
+	if m == nil {
+		return
+	}
+	m.provider(p).requests.Add(1)
+}
+
+func (m *Metrics) RecordErrorForProvider(p ModelProvider) {
+	if m == nil {
+		return
+	}
+	m.provider(p).errors.Add(1)
+}
+
+// RecordSemanticHit counts a cache hit found by prompt similarity. It is
+// counted in addition to the cache hit itself.
+func (m *Metrics) RecordSemanticHit() {
+	if m == nil {
+		return
+	}
+	m.semanticHits.Add(1)
+}
+
+// RecordCoalesced counts a request answered by another request's upstream call
+func (m *Metrics) RecordCoalesced() {
+	if m == nil {
+		return
+	}
+	m.coalesced.Add(1)
+}
+
+// RecordClientCancelled counts a request abandoned by its client before the
+// response was ready. These are not errors.
+func (m *Metrics) RecordClientCancelled() {
+	if m == nil {
+		return
+	}
+	m.cancelled.Add(1)
+}
+
+// RecordModerationBlock counts a request the moderator refused to send
+// upstream
+func (m *Metrics) RecordModerationBlock() {
+	if m == nil {
+		return
+	}
+	m.moderated.Add(1)
+}
+
+// RecordOutputBlock counts a response the output filter kept from the client
+func (m *Metrics) RecordOutputBlock() {
+	if m == nil {
+		return
+	}
+	m.outputBlocked.Add(1)
+}
+
+// RecordStaleServe counts an expired cache entry served in place of an error
+func (m *Metrics) RecordStaleServe() {
+	if m == nil {
+		return
+	}
+	m.staleServed.Add(1)
+}
+
+// RecordShadowRequest counts a call mirrored to the shadow provider
+func (m *Metrics) RecordShadowRequest() {
+	if m == nil {
+		return
+	}
+	m.shadowRequests.Add(1)
+}
+
+// RecordShadowError counts a shadow call that failed
+func (m *Metrics) RecordShadowError() {
+	if m == nil {
+		return
+	}
+	m.shadowErrors.Add(1)
+}
+
+// RecordShadowSkipped counts a sampled request that wasn't mirrored because
+// the shadow calls were at their concurrency or budget limit
+func (m *Metrics) RecordShadowSkipped() {
+	if m == nil {
+		return
+	}
+	m.shadowSkipped.Add(1)
+}
+
+// RecordWriteFailure counts a response that couldn't be encoded or was cut
+// off while being written
+func (m *Metrics) RecordWriteFailure() {
+	if m == nil {
+		return
+	}
+	m.writeFailures.Add(1)
+}
+
+// RecordStreamStopped counts a stream the client stopped early
+func (m *Metrics) RecordStreamStopped() {
+	if m == nil {
+		return
+	}
+	m.stopped.Add(1)
+}
+
+// RecordTimeoutForProvider counts a provider timeout. Timeouts are tracked
+// apart from errors so slow providers can be told from failing ones.
+func (m *Metrics) RecordTimeoutForProvider(p ModelProvider) {
+	if m == nil {
+		return
+	}
+	m.timeouts.Add(1)
+	m.provider(p).timeouts.Add(1)
+}
+
+// RecordRateLimitedForProvider counts a 429 from a provider. The call may
+// still succeed on a retry or a fallback, so this is not an error count.
+func (m *Metrics) RecordRateLimitedForProvider(p ModelProvider) {
+	if m == nil {
+		return
+	}
+	m.provider(p).limited.Add(1)
+}
+
+// RecordLatency adds a successful upstream response time to the overall and
+// per-provider histograms
+func (m *Metrics) RecordLatency(p ModelProvider, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.provider(p).latency.Observe(d)
+	m.latency.Observe(d)
+}
+
+// RecordTimeToFirstToken adds how long a streamed response took to send its
+// first delta to the overall and per-provider histograms. The response's
+// total time is still recorded by RecordLatency.
+func (m *Metrics) RecordTimeToFirstToken(p ModelProvider, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.provider(p).ttft.Observe(d)
+	m.ttft.Observe(d)
+}
+
+// MetricsSnapshot is a copy of the counters taken by Metrics.Snapshot. Each
+// counter is read once, so figures derived from a snapshot, like the cache
+// hit rate, always agree with the counts they come from.
+type MetricsSnapshot struct {
+	TotalRequests int64
+	CacheHits     int64
+	CacheMisses   int64
+	Errors        int64
+	Failovers     int64
+	Timeouts      int64
+	Coalesced     int64
+	SemanticHits  int64
+	Cancelled     int64
+	Moderated     int64
+	OutputBlocked int64
+	StaleServed   int64
+	Stopped       int64
+	WriteFailures int64
+	Providers     map[ModelProvider]ProviderSnapshot
+	
+	// Experiments counts the requests routed to each variant, by experiment
+	// and variant name
+	Experiments map[string]map[string]int64
+	
+	ShadowRequests int64
+	ShadowErrors   int64
+	ShadowSkipped  int64
+}
+
+// ProviderSnapshot is the per-provider part of a MetricsSnapshot
+type ProviderSnapshot struct {
+	Requests    int64
+	Errors      int64
+	Timeouts    int64
+	RateLimited int64
+	
+	latency *Histogram
+	ttft    *Histogram
+}
+
+// Snapshot returns the current counters
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{
+		TotalRequests: m.totalRequests.Load(),
+		CacheHits:     m.cacheHits.Load(),
+		CacheMisses:   m.cacheMisses.Load(),
+		Errors:        m.errors.Load(),
+		Failovers:     m.failovers.Load(),
+		Timeouts:      m.timeouts.Load(),
+		Coalesced:     m.coalesced.Load(),
+		SemanticHits:  m.semanticHits.Load(),
+		Cancelled:     m.cancelled.Load(),
+		Moderated:     m.moderated.Load(),
+		OutputBlocked: m.outputBlocked.Load(),
+		StaleServed:   m.staleServed.Load(),
+		Stopped:       m.stopped.Load(),
+		WriteFailures: m.writeFailures.Load(),
+		
+		ShadowRequests: m.shadowRequests.Load(),
+		ShadowErrors:   m.shadowErrors.Load(),
+		ShadowSkipped:  m.shadowSkipped.Load(),
+	}
+	
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s.Providers = make(map[ModelProvider]ProviderSnapshot, len(m.providers))
+	for p, pm := range m.providers {
+		s.Providers[p] = ProviderSnapshot{
+			Requests:    pm.requests.Load(),
+			Errors:      pm.errors.Load(),
+			Timeouts:    pm.timeouts.Load(),
+			RateLimited: pm.limited.Load(),
+			latency:     pm.latency,
+			ttft:        pm.ttft,
+		}
+	}
+	s.Experiments = make(map[string]map[string]int64)
+	for key, n := range m.variants {
+		if s.Experiments[key.experiment] == nil {
+			s.Experiments[key.experiment] = make(map[string]int64)
+		}
+		s.Experiments[key.experiment][key.variant] = n.Load()
+	}
+	return s
+}
+
+// CacheHitRate returns cache hits as a percentage of cache lookups
+func (s MetricsSnapshot) CacheHitRate() float64 {
+	total := s.CacheHits + s.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(total) * 100
 }
 
 // HandleMetrics returns gateway metrics
 func (g *Gateway) HandleMetrics(w http.ResponseWriter, r *http.Request) {
-	g.metrics.mu.RLock()
-	defer g.metrics.mu.RUnlock()
+	m := g.metricsOrEmpty()
+	snap := m.Snapshot()
 	
 	w.Header().Set("Content-Type", "application/json")
 	
-	cacheHitRate := 0.0
-	total := g.metrics.cacheHits + g.metrics.cacheMisses
-	if total > 0 {
-		cacheHitRate = float64(g.metrics.cacheHits) / float64(total) * 100
+	providers := make(map[ModelProvider]interface{}, len(snap.Providers))
+	for p, pm := range snap.Providers {
+		providers[p] = map[string]interface{}{
+			"requests":     pm.Requests,
+			"errors":       pm.Errors,
+			"timeouts":     pm.Timeouts,
+			"rate_limited": pm.RateLimited,
+			"latency":      pm.latency.Stats(),
+			
+			"time_to_first_token": pm.ttft.Stats(),
+		}
+	}
+	
+	breakers := make(map[ModelProvider]string)
+	for p, state := range g.breakerStates() {
+		breakers[p] = state.String()
 	}
 	
 	metrics := map[string]interface{}{
-		"total_requests": g.metrics.totalRequests,
-		"cache_hits":     g.metrics.cacheHits,
-		"cache_misses":   g.metrics.cacheMisses,
-		"cache_hit_rate": fmt.Sprintf("%.2f%%", cacheHitRate),
-		"errors":         g.metrics.errors,
+		"total_requests":    snap.TotalRequests,
+		"cache_hits":        snap.CacheHits,
+		"cache_misses":      snap.CacheMisses,
+		"cache_hit_rate":    fmt.Sprintf("%.2f%%", snap.CacheHitRate()),
+		"errors":            snap.Errors,
+		"failovers":         snap.Failovers,
+		"timeouts":          snap.Timeouts,
+		"coalesced":         snap.Coalesced,
+		"semantic_hits":     snap.SemanticHits,
+		"client_cancelled":  snap.Cancelled,
+		"moderation_blocks": snap.Moderated,
+		"output_blocks":     snap.OutputBlocked,
+		"stale_served":      snap.StaleServed,
+		"streams_stopped":   snap.Stopped,
+		"write_failures":    snap.WriteFailures,
+		"latency":           m.latency.Stats(),
+		"providers":         providers,
+		
+		"time_to_first_token": m.ttft.Stats(),
+		"circuit_breakers": breakers,
+		"experiments":      snap.Experiments,
+		"backends":         g.backendCounts(),
+		"spend_usd":        g.spend.Snapshot(),
+		"upstream":         g.upstreamInFlight(),
+		"shadow": map[string]interface{}{
+			"requests":  snap.ShadowRequests,
+			"errors":    snap.ShadowErrors,
+			"skipped":   snap.ShadowSkipped,
+			"spend_usd": g.shadowSpend.Spend(""),
+		},
+		"rate_queue": map[string]interface{}{
+			"depth": g.rateQueueDepth(),
+			"wait":  m.queueWait.Stats(),
+		},
 	}
 	
-	json.NewEncoder(w).Encode(metrics)
+	if sized, ok := g.responseCache().(SizedCache); ok {
+		metrics["cache_bytes"] = sized.Bytes()
+	}
+	
+	g.writeJSON(w, r, http.StatusOK, metrics)
+}
+
+// HandleCache reports cache usage on GET and invalidates entries on DELETE,
+// either all of them or, with ?provider=, only those for one provider
+func (g *Gateway) HandleCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	
+	switch r.Method {
+	case http.MethodGet:
+		usage := map[string]int{
+			"size":     g.responseCache().Len(),
+			"max_size": g.config.CacheMaxSize,
+		}
+		if sized, ok := g.responseCache().(SizedCache); ok {
+			usage["bytes"] = sized.Bytes()
+			usage["max_bytes"] = sized.MaxBytes()
+		}
+		g.writeJSON(w, r, http.StatusOK, usage)
+	case http.MethodDelete:
+		provider := ModelProvider(r.URL.Query().Get("provider"))
+		if provider == "" {
+			removed := g.responseCache().Len()
+			g.responseCache().Clear()
+			g.writeJSON(w, r, http.StatusOK, map[string]int{"deleted": removed})
+			return
+		}
+		if _, ok := g.lookupProvider(provider); !ok {
+			g.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Unknown provider: "+string(provider))
+			return
+		}
+		// Cache keys start with the provider; see cacheKeyFor. Entries shared
+		// across providers can only be removed by clearing the whole cache.
+		removed := g.responseCache().DeleteByPrefix(string(provider) + ":")
+		g.writeJSON(w, r, http.StatusOK, map[string]int{"deleted": removed})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		g.writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+	}
 }
 
 // HandleHealth returns health status
 func (g *Gateway) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	g.writeJSON(w, r, http.StatusOK, map[string]string{
 		"status": "healthy",
 		"time":   time.Now().Format(time.RFC3339),
 	})
 }
 
-func main() {
-	gateway := NewGateway()
+// HandleReady is the readiness probe. It reports each provider from its
+// circuit breaker rather than calling out, and returns 503 once every
+// configured provider is down so load balancers stop routing here.
+func (g *Gateway) HandleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 	
-	// Setup routes
-	http.HandleFunc("/api/llm", gateway.HandleLLMRequest)
-	http.HandleFunc("/api/metrics", gateway.HandleMetrics)
-	http.HandleFunc("/health", gateway.HandleHealth)
+	providers := make(map[ModelProvider]string)
+	ready := false
+	for _, info := range g.providerInfo(AccessPolicy{}) {
+		if info.Healthy {
+			providers[info.Name] = "up"
+			ready = true
+		} else {
+			providers[info.Name] = "down"
+		}
+	}
 	
-	// Static file serving for frontend
-	fs := http.FileServer(http.Dir("./static"))
-	http.Handle("/", fs)
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	g.writeJSON(w, r, code, map[string]interface{}{
+		"status":    status,
+		"providers": providers,
+		"time":      time.Now().Format(time.RFC3339),
+	})
+}
+
+func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+	
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setupLogging(cfg); err != nil {
+		log.Fatal(err)
+	}
+	templates, err := LoadTemplates(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gateway := NewGateway(WithConfig(cfg), WithTemplates(templates))
+	if len(cfg.APIKeys) == 0 {
+		slog.Warn("no API keys configured, /api/llm is open to anyone")
+	}
 	
-	port := ":8080"
+	port := cfg.Port
+	public := &http.Server{Addr: port, Handler: gateway.Handler()}
+	servers := []*http.Server{public}
+	scheme := "http"
+	if cfg.TLS.enabled() {
+		scheme = "https"
+		redirect := cfg.TLS.setupTLS(public)
+		if cfg.TLS.RedirectPort != "" {
+			servers = append(servers, &http.Server{Addr: cfg.TLS.RedirectPort, Handler: redirect})
+		}
+	}
+	if cfg.AdminPort != "" {
+		servers = append(servers, &http.Server{Addr: cfg.AdminPort, Handler: gateway.AdminHandler()})
+	}
 	
 	fmt.Printf(`
 ╔═══════════════════════════════════════════════════════╗
 ║   🔥 AI Gateway - High-Performance LLM Router 🔥     ║
 ║                Built by Revy (˃ᆺ˂) 💜               ║
 ╠═══════════════════════════════════════════════════════╣
-║  Server started on http://localhost%s              ║
+║  Server started on %s://localhost%s              ║
 ║                                                       ║
 ║  Endpoints:                                           ║
 ║    POST   /api/llm     - LLM requests                ║
+║    POST   /api/llm/batch - Batched LLM requests      ║
+║    POST   /api/llm/estimate - Cost estimate (dry run)║
+║    POST   /api/llm/stop/{id} - Stop a stream         ║
+║    POST   /api/embeddings - Text embeddings          ║
+║    POST   /v1/chat/completions - OpenAI-compatible   ║
 ║    GET    /api/metrics - Gateway metrics             ║
+║    GET    /api/providers - Providers and models      ║
+║    GET    /api/cache   - Cache size (DELETE flushes) ║
+║    GET    /api/jobs/{id} - Async job status          ║
+║    GET    /metrics     - Prometheus metrics          ║
 ║    GET    /health      - Health check                ║
+║    GET    /ready       - Readiness check             ║
 ╚═══════════════════════════════════════════════════════╝
-`, port)
+`, scheme, port)
+	
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	
+	// Listen before warming the cache so startup isn't held up by it
+	serverErr := make(chan error, len(servers))
+	for _, server := range servers {
+		ln, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func(server *http.Server) {
+			if server == public && cfg.TLS.enabled() {
+				serverErr <- server.ServeTLS(ln, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+				return
+			}
+			serverErr <- server.Serve(ln)
+		}(server)
+	}
+	if cfg.AdminPort != "" {
+		slog.Info("serving metrics and cache admin endpoints on a separate port", "addr", cfg.AdminPort)
+	}
+	go gateway.Warm(ctx)
+	
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
 	
-	log.Fatal(http.ListenAndServe(port, nil))
+	// Stop accepting new connections and let in-flight LLM calls finish
+	slog.Info("shutting down", "in_flight", gateway.InFlight())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutdown", "addr", server.Addr, "err", err)
+		}
+	}
+	if err := gateway.DrainJobs(shutdownCtx); err != nil {
+		slog.Error("abandoning background jobs", "err", err)
+	}
+	if err := gateway.Close(); err != nil {
+		slog.Error("closing gateway", "err", err)
+	}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newOptionGateway builds a gateway with opts and closes it at cleanup
+func newOptionGateway(t *testing.T, opts ...Option) *Gateway {
+	t.Helper()
+	g := NewGateway(opts...)
+	t.Cleanup(func() { g.Close() })
+	return g
+}
+
+func TestNewGatewayDefaults(t *testing.T) {
+	g := newOptionGateway(t)
+	if _, ok := g.cache.(*MemoryCache); !ok {
+		t.Errorf("cache is %T, want *MemoryCache", g.cache)
+	}
+	if g.config.CacheMaxSize != 1000 {
+		t.Errorf("cache size %d, want 1000", g.config.CacheMaxSize)
+	}
+	if g.rateLimiter == nil || g.rateLimiter.limit != 100 || g.rateLimiter.window != time.Minute {
+		t.Errorf("rate limiter %+v, want 100 per minute", g.rateLimiter)
+	}
+}
+
+func TestWithCacheSize(t *testing.T) {
+	g := newOptionGateway(t, WithCacheSize(4))
+	for i := 0; i < 10; i++ {
+		g.cache.Set(strconv.Itoa(i), LLMResponse{Response: "cached"}, time.Hour)
+	}
+	if n := g.cache.(*MemoryCache).Len(); n != 4 {
+		t.Errorf("%d entries cached, want 4", n)
+	}
+}
+
+func TestWithCacheTTL(t *testing.T) {
+	g := newOptionGateway(t, WithCacheTTL(time.Second))
+	if ttl, ok := g.cacheTTL(LLMRequest{Provider: OpenAI, Prompt: "hi"}); !ok || ttl != time.Second {
+		t.Errorf("cache TTL %s (cached %v), want 1s", ttl, ok)
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	g := newOptionGateway(t, WithRateLimit(2, time.Hour))
+	for i := 0; i < 2; i++ {
+		if !g.rateLimiter.Allow("client") {
+			t.Fatalf("request %d refused", i+1)
+		}
+	}
+	if g.rateLimiter.Allow("client") {
+		t.Error("third request allowed, want the limit of 2 per hour")
+	}
+}
+
+// A limit of zero turns limiting off rather than panicking in NewRateLimiter
+func TestWithRateLimitZero(t *testing.T) {
+	for _, tt := range []struct {
+		limit  int
+		window time.Duration
+	}{{0, time.Minute}, {-1, time.Minute}, {10, 0}} {
+		g := newOptionGateway(t, WithRateLimit(tt.limit, tt.window))
+		if g.rateLimiter != nil {
+			t.Errorf("WithRateLimit(%d, %s) built a rate limiter", tt.limit, tt.window)
+		}
+	}
+}
+
+// WithProviders adds to the providers already configured rather than
+// replacing them
+func TestWithProviders(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Providers = map[ModelProvider]ProviderConfig{OpenAI: {APIKey: "from-config"}}
+	g := newOptionGateway(t, WithConfig(cfg), WithProviders(map[ModelProvider]ProviderConfig{
+		Anthropic: {APIKey: "from-option"},
+	}))
+	if got := g.config.Providers[OpenAI].APIKey; got != "from-config" {
+		t.Errorf("openai key %q, want from-config", got)
+	}
+	if got := g.config.Providers[Anthropic].APIKey; got != "from-option" {
+		t.Errorf("anthropic key %q, want from-option", got)
+	}
+}
+
+func TestWithoutCacheAndRateLimit(t *testing.T) {
+	g := newOptionGateway(t, WithoutCache(), WithoutRateLimit())
+	if _, ok := g.cache.(nopCache); !ok {
+		t.Errorf("cache is %T, want nopCache", g.cache)
+	}
+	if g.rateLimiter != nil {
+		t.Error("rate limiter built despite WithoutRateLimit")
+	}
+}
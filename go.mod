@@ -2,9 +2,11 @@ module github.com/randomaigirl/ai-toolkit
 
 go 1.21
 
+require golang.org/x/crypto v0.33.0
+
 require (
-	// No external dependencies needed for the basic version!
-	// The gateway uses only Go standard library
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
 )
 
 // Optional dependencies for production:
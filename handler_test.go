@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubProvider answers every upstream call with a fixed response and counts
+// the calls
+func stubProvider(calls *atomic.Int64) ProviderFunc {
+	return func(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+		calls.Add(1)
+		return LLMResponse{Provider: req.Provider, Model: req.Model, Response: "stubbed", TokensUsed: 7}, nil
+	}
+}
+
+// newTestServer serves a gateway built with opts
+func newTestServer(t *testing.T, opts ...Option) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(NewGateway(opts...).Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// postJSON posts body to path and returns the response, closing it at cleanup
+func postJSON(t *testing.T, srv *httptest.Server, path, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// decode reads a JSON response body into v
+func decode(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+}
+
+const testLLMRequest = `{"provider":"openai","model":"gpt-4o-mini","prompt":"hello"}`
+
+func TestHandlerRateLimit(t *testing.T) {
+	var calls atomic.Int64
+	srv := newTestServer(t, WithRateLimit(2, time.Minute), WithProviderFunc(stubProvider(&calls)))
+
+	for i := 0; i < 2; i++ {
+		if resp := postJSON(t, srv, "/api/llm", testLLMRequest); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+	resp := postJSON(t, srv, "/api/llm", testLLMRequest)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	var body ErrorResponse
+	decode(t, resp, &body)
+	if body.Code != CodeRateLimited {
+		t.Errorf("code %q, want %q", body.Code, CodeRateLimited)
+	}
+}
+
+func TestHandlerCacheHit(t *testing.T) {
+	var calls atomic.Int64
+	srv := newTestServer(t, WithoutRateLimit(), WithProviderFunc(stubProvider(&calls)))
+
+	var first, second LLMResponse
+	decode(t, postJSON(t, srv, "/api/llm", testLLMRequest), &first)
+	resp := postJSON(t, srv, "/api/llm", testLLMRequest)
+	decode(t, resp, &second)
+
+	if first.Cached {
+		t.Error("first response marked cached")
+	}
+	if !second.Cached || resp.Header.Get("X-Cache") != "HIT" {
+		t.Errorf("second response not served from the cache: cached=%v X-Cache=%q", second.Cached, resp.Header.Get("X-Cache"))
+	}
+	if second.Response != "stubbed" {
+		t.Errorf("cached response %q, want %q", second.Response, "stubbed")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("provider called %d times, want 1", n)
+	}
+}
+
+func TestHandlerInvalidJSON(t *testing.T) {
+	var calls atomic.Int64
+	srv := newTestServer(t, WithoutRateLimit(), WithProviderFunc(stubProvider(&calls)))
+
+	resp := postJSON(t, srv, "/api/llm", `{"provider":`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+	var body ErrorResponse
+	decode(t, resp, &body)
+	if body.Code != CodeInvalidRequest {
+		t.Errorf("code %q, want %q", body.Code, CodeInvalidRequest)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("provider called %d times for an invalid body", n)
+	}
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	var calls atomic.Int64
+	srv := newTestServer(t, WithoutRateLimit(), WithProviderFunc(stubProvider(&calls)))
+
+	postJSON(t, srv, "/api/llm", testLLMRequest)
+	postJSON(t, srv, "/api/llm", testLLMRequest)
+	postJSON(t, srv, "/api/llm", `not json`)
+
+	resp, err := http.Get(srv.URL + "/api/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var metrics map[string]any
+	decode(t, resp, &metrics)
+
+	// Cache hits aren't counted in total_requests, which covers the requests
+	// answered upstream
+	want := map[string]float64{"total_requests": 1, "cache_hits": 1, "cache_misses": 1, "errors": 1}
+	for key, v := range want {
+		if got, _ := metrics[key].(float64); got != v {
+			t.Errorf("%s = %v, want %v", key, metrics[key], v)
+		}
+	}
+	providers, _ := metrics["providers"].(map[string]any)
+	openai, _ := providers["openai"].(map[string]any)
+	if got, _ := openai["requests"].(float64); got != 1 {
+		t.Errorf("providers.openai.requests = %v, want 1", openai["requests"])
+	}
+}
+
+// FuzzHandleLLMRequest sends arbitrary bodies to /api/llm. Whatever the body,
+// the handler must not panic and must answer with a 2xx or a 4xx; a 5xx
+// would mean a bad request got past validation.
+func FuzzHandleLLMRequest(f *testing.F) {
+	for _, seed := range []string{
+		testLLMRequest,
+		`{"provider":"openai","messages":[{"role":"user","content":"hi"}],"max_tokens":5}`,
+		`{"provider":"mock","prompt":"hi","stream":true}`,
+		`{"provider":"openai","prompt":"hi","temperature":-1,"top_p":2}`,
+		`{"provider":"nope","prompt":""}`,
+		`{"template":"missing","variables":{"a":1}}`,
+		`{"prompt":"hi","n":1000000}`,
+		`[]`,
+		`null`,
+		``,
+		`{"provider":`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	var calls atomic.Int64
+	h := NewGateway(WithoutRateLimit(), WithProviderFunc(stubProvider(&calls))).Handler()
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, "/api/llm", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code >= 500 || rec.Code < 200 || (rec.Code >= 300 && rec.Code < 400) {
+			t.Fatalf("status %d for body %q: %s", rec.Code, body, rec.Body.String())
+		}
+	})
+}
+
+// /api/providers needs a key and lists only what the key's policy allows
+func TestHandlerProvidersUsesKeyPolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Providers = map[ModelProvider]ProviderConfig{OpenAI: {}, Anthropic: {}}
+	cfg.APIKeys = []APIKeyConfig{{Key: "k1", Label: "team", Access: &AccessPolicy{Providers: []ModelProvider{Anthropic}}}}
+	srv := newTestServer(t, WithConfig(cfg), WithoutRateLimit())
+
+	resp, err := http.Get(srv.URL + "/api/providers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous status %d, want 401", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/providers", nil)
+	req.Header.Set("X-API-Key", "k1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Providers []ProviderInfo `json:"providers"`
+	}
+	decode(t, resp, &body)
+	if len(body.Providers) != 1 || body.Providers[0].Name != Anthropic {
+		t.Errorf("providers %+v, want only anthropic", body.Providers)
+	}
+}
+
+func TestHandlerMethods(t *testing.T) {
+	var calls atomic.Int64
+	srv := newTestServer(t, WithoutRateLimit(), WithProviderFunc(stubProvider(&calls)))
+
+	tests := []struct {
+		method string
+		status int
+	}{
+		{http.MethodPost, http.StatusOK},
+		{http.MethodOptions, http.StatusNoContent},
+		{http.MethodGet, http.StatusMethodNotAllowed},
+		{http.MethodHead, http.StatusMethodNotAllowed},
+		{http.MethodPut, http.StatusMethodNotAllowed},
+		{http.MethodPatch, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, srv.URL+"/api/llm", strings.NewReader(testLLMRequest))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusMethodNotAllowed {
+				if allow := resp.Header.Get("Allow"); allow != "POST, OPTIONS" {
+					t.Errorf("Allow %q, want POST, OPTIONS", allow)
+				}
+			}
+		})
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("provider called %d times, want only for the POST", n)
+	}
+}
+
+// Provider errors often quote the upstream response; the error body must
+// still be valid JSON carrying the message intact
+func TestHandlerErrorWithQuotes(t *testing.T) {
+	const msg = `upstream said "bad request": {"detail":"C:\\path"}` + "\nline two"
+	srv := newTestServer(t, WithoutRateLimit(), WithProviderFunc(func(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+		return LLMResponse{}, errors.New(msg)
+	}))
+
+	resp := postJSON(t, srv, "/api/llm", testLLMRequest)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", resp.StatusCode)
+	}
+	var body ErrorResponse
+	decode(t, resp, &body)
+	if !strings.Contains(body.Message, msg) {
+		t.Errorf("message %q, want it to contain %q", body.Message, msg)
+	}
+}
+
+// Each failover is logged against the provider that just failed, not the
+// one the request started with
+func TestFailoverLogsFailedProvider(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	srv := newTestServer(t, WithoutRateLimit(), WithProviderFunc(func(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+		if req.Provider != Mock {
+			return LLMResponse{}, errors.New(string(req.Provider) + " is down")
+		}
+		return LLMResponse{Provider: req.Provider, Response: "stubbed"}, nil
+	}))
+
+	resp := postJSON(t, srv, "/api/llm", `{"provider":"openai","prompt":"hi","fallback_providers":["anthropic","mock"]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	for _, want := range []string{
+		"provider=openai fallback=anthropic",
+		"provider=anthropic fallback=mock",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("no failover logged with %q in:\n%s", want, logs.String())
+		}
+	}
+}
+
+// brokenWriter is a response whose client has gone away: every write fails
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+// Error bodies and streamed cache hits that can't be written are counted in
+// write_failures like any other response
+func TestWriteFailuresCounted(t *testing.T) {
+	var calls atomic.Int64
+	g := NewGateway(WithoutRateLimit(), WithProviderFunc(stubProvider(&calls)))
+	defer g.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/llm", nil)
+
+	g.writeError(brokenWriter{httptest.NewRecorder()}, r, http.StatusBadRequest, CodeInvalidRequest, "Invalid request")
+	g.writeOpenAIError(brokenWriter{httptest.NewRecorder()}, r, http.StatusBadRequest, "invalid_request_error", "Invalid request")
+
+	req := LLMRequest{Provider: OpenAI, Model: "gpt-4o-mini", Prompt: "hello", Stream: true}
+	g.responseCache().Set(cacheKeyFor(req, g.config.CacheKeys, g.config.CacheVersion), LLMResponse{Provider: OpenAI, Response: "cached"}, time.Hour)
+	g.handleStream(brokenWriter{httptest.NewRecorder()}, r, req, gatewayStream{})
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("stream went upstream %d times, want a cache hit", n)
+	}
+
+	if n := g.metrics.Snapshot().WriteFailures; n != 3 {
+		t.Errorf("%d write failures counted, want 3", n)
+	}
+}
+
+// A request refused by the rate limit must not be replayed to its retry: a
+// client that waits out Retry-After and resends with the same
+// Idempotency-Key gets served
+func TestHandlerIdempotentRetryAfterRateLimit(t *testing.T) {
+	const window = 200 * time.Millisecond
+	var calls atomic.Int64
+	srv := newTestServer(t, WithRateLimit(1, window), WithProviderFunc(stubProvider(&calls)))
+
+	post := func(key string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/llm", strings.NewReader(testLLMRequest))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := post("first"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request status %d, want 200", resp.StatusCode)
+	}
+	if resp := post("retried"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second request status %d, want 429", resp.StatusCode)
+	}
+	time.Sleep(window)
+
+	resp := post("retried")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("retry status %d, want 200", resp.StatusCode)
+	}
+	if resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Error("retry replayed the 429")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the histogram upper bounds in seconds
+var latencyBuckets = []float64{0.025, 0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5, 7.5, 10, 15, 30, 60}
+
+// Histogram is a fixed-bucket latency histogram. All fields are atomics so
+// Observe can be called concurrently without a lock.
+type Histogram struct {
+	buckets   []atomic.Int64 // one per latencyBuckets entry plus +Inf
+	count     atomic.Int64
+	sumMicros atomic.Int64
+	maxMicros atomic.Int64
+}
+
+// LatencyStats summarizes a histogram in milliseconds
+type LatencyStats struct {
+	Count int64   `json:"count"`
+	Avg   float64 `json:"avg_ms"`
+	Max   float64 `json:"max_ms"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+// NewHistogram creates an empty latency histogram
+func NewHistogram() *Histogram {
+	return &Histogram{
+		buckets: make([]atomic.Int64, len(latencyBuckets)+1),
+	}
+}
+
+// Observe records a single duration
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+
+	micros := d.Microseconds()
+	h.sumMicros.Add(micros)
+	for {
+		current := h.maxMicros.Load()
+		if micros <= current || h.maxMicros.CompareAndSwap(current, micros) {
+			break
+		}
+	}
+}
+
+// Quantile estimates the q-th quantile (0 < q <= 1) by interpolating linearly
+// within the bucket that contains it
+func (h *Histogram) Quantile(q float64) time.Duration {
+	total := h.count.Load()
+	if total == 0 {
+		return 0
+	}
+	maxSeconds := float64(h.maxMicros.Load()) / 1e6
+
+	rank := q * float64(total)
+	var cumulative int64
+	for i := range h.buckets {
+		n := h.buckets[i].Load()
+		if n == 0 || float64(cumulative+n) < rank {
+			cumulative += n
+			continue
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		upper := maxSeconds
+		if i < len(latencyBuckets) && latencyBuckets[i] < maxSeconds {
+			upper = latencyBuckets[i]
+		}
+		estimate := lower + (upper-lower)*(rank-float64(cumulative))/float64(n)
+		return time.Duration(estimate * float64(time.Second))
+	}
+	return time.Duration(maxSeconds * float64(time.Second))
+}
+
+// Stats returns count, average, max and p50/p95/p99 in milliseconds
+func (h *Histogram) Stats() LatencyStats {
+	stats := LatencyStats{
+		Count: h.count.Load(),
+		Max:   float64(h.maxMicros.Load()) / 1000,
+		P50:   float64(h.Quantile(0.50).Microseconds()) / 1000,
+		P95:   float64(h.Quantile(0.95).Microseconds()) / 1000,
+		P99:   float64(h.Quantile(0.99).Microseconds()) / 1000,
+	}
+	if stats.Count > 0 {
+		stats.Avg = float64(h.sumMicros.Load()) / float64(stats.Count) / 1000
+	}
+	return stats
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPClientConfig tunes the connection pool shared by every upstream call
+// and health check; job callbacks use a client of their own, see
+// newCallbackClient. Keeping idle connections open per host
+// saves a TCP and TLS handshake on each call to a busy provider. Zero fields
+// take the values from DefaultHTTPClientConfig.
+//
+// There is no overall timeout: provider calls are bounded by the provider's
+// Timeout, and a client-wide one would cut long streams short.
+// ResponseHeaderTimeout, when set, fails calls to a provider that accepts a
+// connection but never answers. Proxies are taken from HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY.
+type HTTPClientConfig struct {
+	MaxIdleConns        int `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	// MaxConnsPerHost caps all connections to a host, idle or not; 0 is
+	// unlimited
+	MaxConnsPerHost int `json:"max_conns_per_host,omitempty"`
+
+	IdleConnTimeout       Duration `json:"idle_conn_timeout,omitempty"`
+	DialTimeout           Duration `json:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout,omitempty"`
+}
+
+// DefaultHTTPClientConfig keeps enough idle connections for a few busy
+// providers, well above net/http's default of two per host
+func DefaultHTTPClientConfig() HTTPClientConfig {
+	return HTTPClientConfig{
+		MaxIdleConns:        256,
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     Duration(90 * time.Second),
+		DialTimeout:         Duration(10 * time.Second),
+		TLSHandshakeTimeout: Duration(10 * time.Second),
+	}
+}
+
+// newHTTPClient builds the shared upstream client from cfg
+func newHTTPClient(cfg HTTPClientConfig) *http.Client {
+	def := DefaultHTTPClientConfig()
+	if cfg.MaxIdleConns <= 0 {
+		cfg.MaxIdleConns = def.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost <= 0 {
+		cfg.MaxIdleConnsPerHost = def.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout <= 0 {
+		cfg.IdleConnTimeout = def.IdleConnTimeout
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = def.DialTimeout
+	}
+	if cfg.TLSHandshakeTimeout <= 0 {
+		cfg.TLSHandshakeTimeout = def.TLSHandshakeTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(cfg.DialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          cfg.MaxIdleConns,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       cfg.MaxConnsPerHost,
+			IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout),
+			TLSHandshakeTimeout:   time.Duration(cfg.TLSHandshakeTimeout),
+			ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout),
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKeyLength bounds client-supplied Idempotency-Key values
+const maxIdempotencyKeyLength = 255
+
+// errIdempotencyMismatch is returned when a key is reused with a different body
+var errIdempotencyMismatch = errors.New("Idempotency-Key was already used with a different request")
+
+// IdempotencyStore remembers the responses to requests sent with an
+// Idempotency-Key header, so a client retrying after a network error gets
+// the original response instead of a second, separately billed call. Unlike
+// the response cache it is keyed on the client's token, not the prompt.
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+	ttl     time.Duration
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// idempotentEntry is one remembered response. done is closed once the first
+// request with the key has finished; the other fields are set before that.
+type idempotentEntry struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+
+	// discarded is set when the response wasn't kept, so requests that
+	// waited for it run again instead of replaying it
+	discarded bool
+}
+
+// NewIdempotencyStore creates a store that keeps responses for ttl and drops
+// expired ones every sweepInterval in a background goroutine. Call Close to
+// stop it.
+func NewIdempotencyStore(ttl, sweepInterval time.Duration) *IdempotencyStore {
+	s := &IdempotencyStore{
+		entries: make(map[string]*idempotentEntry),
+		ttl:     ttl,
+		stop:    make(chan struct{}),
+	}
+	go s.sweeper(sweepInterval)
+	return s
+}
+
+func (s *IdempotencyStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, e := range s.entries {
+				if s.finished(e) && now.After(e.expires) {
+					delete(s.entries, key)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the sweeper goroutine. It is safe to call more than once.
+func (s *IdempotencyStore) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+func (s *IdempotencyStore) finished(e *idempotentEntry) bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// begin looks up key. owner is true when the caller is the first to use it
+// and must call finish; otherwise the returned entry is, or will be once
+// done is closed, the response to replay.
+func (s *IdempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (e *idempotentEntry, owner bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok && (!s.finished(e) || time.Now().Before(e.expires)) {
+		if e.fingerprint != fingerprint {
+			return nil, false, errIdempotencyMismatch
+		}
+		return e, false, nil
+	}
+	e = &idempotentEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[key] = e
+	return e, true, nil
+}
+
+// finish records the response for key and releases anyone waiting on it.
+// Only successful responses are kept. Errors, whether the gateway's own
+// such as a 429 or a provider's, and abandoned requests are dropped, so a
+// retry, including one already waiting, runs again rather than replaying a
+// refusal that may no longer apply.
+func (s *IdempotencyStore) finish(key string, e *idempotentEntry, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The body is kept uncompressed; a replay is encoded for its own client
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+
+	e.status, e.header, e.body = status, header, body
+	e.expires = time.Now().Add(s.ttl)
+	if status < 200 || status >= 300 {
+		e.discarded = true
+		delete(s.entries, key)
+	}
+	close(e.done)
+}
+
+// Idempotent makes POSTs carrying an Idempotency-Key header safe to retry:
+// the first request with a key is handled as usual and its response is
+// replayed, with an Idempotent-Replayed header, to any later request from the
+// same API key to the same endpoint with the same key and body. A repeat
+// arriving while the first is still running waits for it, and is handled
+// itself if that one ends in a response that isn't kept.
+func (g *Gateway) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost || g.idempotency == nil {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			g.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Idempotency-Key is too long")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			g.invalidBody(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := APIKeyLabel(r.Context()) + "\x00" + r.URL.Path + "\x00" + key
+		fingerprint := sha256.Sum256(body)
+		for {
+			e, owner, err := g.idempotency.begin(scope, fingerprint)
+			if err != nil {
+				g.writeError(w, r, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
+				return
+			}
+			if owner {
+				rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+				next(rec, r)
+				g.idempotency.finish(scope, e, rec.status, w.Header().Clone(), rec.body.Bytes())
+				return
+			}
+
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				g.clientCancelled(w, r.Context())
+				return
+			}
+			if e.discarded {
+				continue
+			}
+			for k, v := range e.header {
+				if w.Header().Get(k) == "" {
+					w.Header()[k] = v
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+	}
+}
+
+// idempotencyRecorder passes a response through while keeping a copy
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (w *idempotencyRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyRecorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses flowing through the recorder
+func (w *idempotencyRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
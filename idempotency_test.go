@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idempotentRequest builds a POST carrying an Idempotency-Key
+func idempotentRequest(key string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/llm", strings.NewReader(`{"prompt":"hi"}`))
+	r.Header.Set("Idempotency-Key", key)
+	return r
+}
+
+// A request waiting on one that fails must run itself rather than replay
+// the failure
+func TestIdempotentWaiterRunsAfterServerError(t *testing.T) {
+	g := NewGateway(WithoutRateLimit())
+	defer g.idempotency.Close()
+
+	var calls atomic.Int64
+	release := make(chan struct{})
+	h := g.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	first := httptest.NewRecorder()
+	firstDone := make(chan struct{})
+	go func() {
+		h(first, idempotentRequest("k1"))
+		close(firstDone)
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	second := httptest.NewRecorder()
+	secondDone := make(chan struct{})
+	go func() {
+		h(second, idempotentRequest("k1"))
+		close(secondDone)
+	}()
+	// Give the second request time to start waiting on the first
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	<-firstDone
+	<-secondDone
+
+	if first.Code != http.StatusServiceUnavailable {
+		t.Errorf("first status %d, want 503", first.Code)
+	}
+	if second.Code != http.StatusOK || second.Body.String() != "ok" {
+		t.Errorf("second got %d %q, want its own 200", second.Code, second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("second request replayed a discarded response")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("handler ran %d times, want 2", n)
+	}
+}
+
+// A response first sent gzipped must replay as plain text to a client that
+// doesn't accept gzip
+func TestIdempotentReplayIsNotLabelledGzip(t *testing.T) {
+	g := NewGateway(WithoutRateLimit())
+	defer g.idempotency.Close()
+
+	body := strings.Repeat("a", 4*gzipMinSize)
+	h := Gzip(g.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	}))
+
+	first := idempotentRequest("k2")
+	first.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h(rec, first)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("first response not gzipped")
+	}
+
+	rec = httptest.NewRecorder()
+	h(rec, idempotentRequest("k2"))
+	if rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("second response not replayed")
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("replay labelled Content-Encoding %q", enc)
+	}
+	if rec.Body.String() != body {
+		t.Errorf("replay body of %d bytes, want the original %d", rec.Body.Len(), len(body))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPFilterConfig restricts which client addresses may reach the gateway.
+// Entries are CIDR ranges like "10.0.0.0/8" or single addresses. Deny wins
+// over Allow, and with Allow set only the addresses in it get through.
+//
+// The lists are checked against ClientIP, so forwarding headers only count
+// when they come from Config.TrustedProxies and a client can't get past the
+// lists by sending its own X-Forwarded-For.
+type IPFilterConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// ipFilter is an IPFilterConfig with its ranges parsed
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+
+	// denyAll is set when the config couldn't be parsed, so a broken list
+	// fails closed
+	denyAll bool
+}
+
+// newIPFilter parses c, returning nil when it restricts nothing
+func newIPFilter(c IPFilterConfig) (*ipFilter, error) {
+	if len(c.Allow) == 0 && len(c.Deny) == 0 {
+		return nil, nil
+	}
+	allow, err := parsePrefixes("ip_filter.allow", c.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePrefixes("ip_filter.deny", c.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+// parsePrefixes parses a list of CIDR ranges and single addresses
+func parsePrefixes(field string, entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if strings.Contains(e, "/") {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", field, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether any of prefixes holds addr
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the client behind r may use the gateway
+func (f *ipFilter) allowed(r *http.Request) bool {
+	if f.denyAll {
+		return false
+	}
+	addr, ok := clientAddr(r)
+	if !ok {
+		return false
+	}
+	if containsAddr(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsAddr(f.allow, addr)
+}
+
+// IPFilter rejects clients outside Config.IPFilter with 403, before any
+// other handling including rate limiting
+func (g *Gateway) IPFilter(next http.Handler) http.Handler {
+	if g.ipFilter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.ipFilter.allowed(r) {
+			slog.Debug("client address not allowed", "client_ip", ClientIP(r), "remote_addr", r.RemoteAddr)
+			g.writeError(w, r, http.StatusForbidden, CodeForbidden, "Forbidden")
+			g.metrics.RecordError()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
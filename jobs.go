@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobPending   = "pending"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// callbackAttempts is how many times a job's callback is tried before giving up
+const callbackAttempts = 3
+
+// Job is a request being processed in the background on behalf of a client
+// that asked to be called back rather than wait
+type Job struct {
+	ID        string       `json:"id"`
+	Status    string       `json:"status"`
+	Response  *LLMResponse `json:"response,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+
+	// CallbackError is set when the result couldn't be delivered; the job
+	// can still be polled
+	CallbackError string `json:"callback_error,omitempty"`
+
+	callbackURL string
+	apiKey      string
+	expires     time.Time
+}
+
+// JobStore tracks background jobs until they expire. Jobs are kept for the
+// TTL after they finish so clients can still poll for the result.
+type JobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+	ttl  time.Duration
+
+	// running counts the jobs still working or delivering their callback;
+	// abort is closed when Drain gives up waiting for them
+	running   sync.WaitGroup
+	abort     chan struct{}
+	abortOnce sync.Once
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewJobStore creates a job store that drops expired jobs every sweepInterval
+// in a background goroutine. Call Close to stop it.
+func NewJobStore(ttl, sweepInterval time.Duration) *JobStore {
+	s := &JobStore{
+		jobs:  make(map[string]*Job),
+		ttl:   ttl,
+		abort: make(chan struct{}),
+		stop:  make(chan struct{}),
+	}
+	go s.sweeper(sweepInterval)
+	return s
+}
+
+func (s *JobStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for id, job := range s.jobs {
+				if job.Status != JobPending && now.After(job.expires) {
+					delete(s.jobs, id)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the sweeper goroutine. It is safe to call more than once.
+func (s *JobStore) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+// Drain waits for running jobs to finish and deliver their callbacks. When
+// ctx ends first the remaining jobs are abandoned, cancelling their calls
+// and callback retries, and ctx's error is returned.
+func (s *JobStore) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.abortOnce.Do(func() { close(s.abort) })
+		return ctx.Err()
+	}
+}
+
+// create registers a new pending job
+func (s *JobStore) create(callbackURL, apiKey string) Job {
+	now := time.Now()
+	job := &Job{
+		ID:          "job-" + newRequestID(),
+		Status:      JobPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		callbackURL: callbackURL,
+		apiKey:      apiKey,
+	}
+	s.mu.Lock()
+	s.jobs[job.ID] = job
+	s.mu.Unlock()
+	return *job
+}
+
+// finish records the outcome of a job and starts its TTL
+func (s *JobStore) finish(id string, response LLMResponse, err error) Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.jobs[id]
+	job.UpdatedAt = time.Now()
+	job.expires = job.UpdatedAt.Add(s.ttl)
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = JobSucceeded
+		job.Response = &response
+	}
+	return *job
+}
+
+// setCallbackError notes that a job's result couldn't be delivered
+func (s *JobStore) setCallbackError(id string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		job.CallbackError = err.Error()
+	}
+}
+
+// get returns a copy of a job, if it exists and hasn't expired
+func (s *JobStore) get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok || (job.Status != JobPending && time.Now().After(job.expires)) {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// startJob accepts req for background processing and returns the job. The
+// job keeps the request's values, such as the API key label, but not its
+// cancellation, since the client is not waiting. Unless the request set a
+// priority it runs at low priority.
+func (g *Gateway) startJob(r *http.Request, req LLMRequest) Job {
+	if req.Priority == "" {
+		req.Priority = PriorityLow
+	}
+	job := g.jobs.create(req.CallbackURL, APIKeyLabel(r.Context()))
+	// Abandoned only when a shutdown stops waiting for it
+	base, abandon := context.WithCancel(context.WithoutCancel(r.Context()))
+	go func() {
+		select {
+		case <-g.jobs.abort:
+			abandon()
+		case <-base.Done():
+		}
+	}()
+
+	g.inFlight.Add(1)
+	g.jobs.running.Add(1)
+	go func() {
+		defer g.inFlight.Add(-1)
+		defer g.jobs.running.Done()
+		defer abandon()
+
+		ctx, cancel := g.withRequestTimeout(base, req)
+		response, err := g.completeLLMRequest(ctx, req)
+		cancel()
+		if err != nil {
+			g.metrics.RecordError()
+		}
+
+		done := g.jobs.finish(job.ID, response, err)
+		if err := g.deliverCallback(base, done); err != nil {
+			slog.Warn("job callback failed", "job", done.ID, "err", err)
+			g.jobs.setCallbackError(done.ID, err)
+		}
+	}()
+	return job
+}
+
+// DrainJobs waits for background jobs to finish and deliver their
+// callbacks, abandoning them when ctx ends first. Call it on shutdown once
+// the servers have stopped taking requests.
+func (g *Gateway) DrainJobs(ctx context.Context) error {
+	if g.jobs == nil {
+		return nil
+	}
+	return g.jobs.Drain(ctx)
+}
+
+// deliverCallback POSTs a finished job to its callback URL, retrying with
+// backoff when the receiver fails or can't be reached. It gives up once ctx
+// ends.
+func (g *Gateway) deliverCallback(ctx context.Context, job Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	client := g.callbackClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < callbackAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return fmt.Errorf("%w (last attempt: %v)", ctx.Err(), lastErr)
+			}
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		httpReq, err := http.NewRequestWithContext(reqCtx, http.MethodPost, job.callbackURL, bytes.NewReader(body))
+		if err != nil {
+			cancel()
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set("X-Job-ID", job.ID)
+
+		resp, err := client.Do(httpReq)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				cancel()
+				return nil
+			}
+			err = fmt.Errorf("callback returned %s", resp.Status)
+		}
+		cancel()
+		lastErr = err
+	}
+	return lastErr
+}
+
+// HandleJob serves GET /api/jobs/{id} so clients can poll a job instead of,
+// or as well as, waiting for its callback. Jobs are only visible to the API
+// key that created them.
+func (g *Gateway) HandleJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		g.writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	id, ok := pathParam(r, "/api/jobs/")
+	if !ok {
+		g.writeError(w, r, http.StatusNotFound, CodeNotFound, "Job not found")
+		return
+	}
+	job, ok := g.jobs.get(id)
+	if !ok || job.apiKey != APIKeyLabel(r.Context()) {
+		g.writeError(w, r, http.StatusNotFound, CodeNotFound, "Job not found")
+		return
+	}
+	g.writeJSON(w, r, http.StatusOK, job)
+}
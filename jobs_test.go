@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallbackURLRejectsInternalTargets(t *testing.T) {
+	var calls atomic.Int64
+	srv := newTestServer(t, WithoutRateLimit(), WithProviderFunc(stubProvider(&calls)))
+
+	for _, target := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.1.2.3/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/hook",
+		"http://[::ffff:192.168.0.1]/hook",
+		"ftp://example.com/hook",
+	} {
+		resp := postJSON(t, srv, "/api/llm", `{"provider":"openai","prompt":"hi","callback_url":"`+target+`"}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", target, resp.StatusCode)
+		}
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("provider called %d times", n)
+	}
+}
+
+// Names are only resolved when the callback is made, so the dialled address
+// is checked too
+func TestCallbackClientRefusesInternalAddresses(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+
+	_, err := newCallbackClient(HTTPClientConfig{}, false).Post(hook.URL, "application/json", nil)
+	if !errors.Is(err, errCallbackTarget) {
+		t.Errorf("err = %v, want %v", err, errCallbackTarget)
+	}
+
+	resp, err := newCallbackClient(HTTPClientConfig{}, true).Post(hook.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("with private targets allowed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// newJobGateway builds a gateway whose callbacks may reach the loopback
+// address of test servers
+func newJobGateway(t *testing.T) *Gateway {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.CallbackAllowPrivate = true
+	var calls atomic.Int64
+	g := NewGateway(WithConfig(cfg), WithoutRateLimit(), WithProviderFunc(stubProvider(&calls)))
+	t.Cleanup(func() { g.Close() })
+	return g
+}
+
+// startTestJob submits a request with a callback to hookURL and returns the
+// job's ID
+func startTestJob(t *testing.T, g *Gateway, hookURL string) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/llm", nil)
+	return g.startJob(r, LLMRequest{Provider: OpenAI, Prompt: "hi", CallbackURL: hookURL}).ID
+}
+
+func TestDrainJobsWaitsForCallbacks(t *testing.T) {
+	var delivered atomic.Int64
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		delivered.Add(1)
+	}))
+	defer hook.Close()
+
+	g := newJobGateway(t)
+	startTestJob(t, g, hook.URL)
+	if err := g.DrainJobs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := delivered.Load(); n != 1 {
+		t.Errorf("%d callbacks delivered before Drain returned, want 1", n)
+	}
+}
+
+// A shutdown deadline must cut the callback retries short rather than wait
+// out their backoff
+func TestDrainJobsAbandonsRetries(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer hook.Close()
+
+	g := newJobGateway(t)
+	id := startTestJob(t, g, hook.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := g.DrainJobs(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want a deadline", err)
+	}
+
+	// The abandoned job records why its callback failed well within the
+	// first backoff
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		job, _ := g.jobs.get(id)
+		if job.CallbackError != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callback retries still running after the drain gave up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// EvictionPolicy picks which entry a full MemoryCache shard drops
+type EvictionPolicy string
+
+const (
+	// EvictLRU drops the least recently used entry
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU drops the least frequently used entry, the least recently
+	// used of those when several tie. It suits traffic where a few prompts
+	// come back again and again, though they may go quiet for a while.
+	EvictLFU EvictionPolicy = "lfu"
+)
+
+// validate checks a policy from the config; empty means LRU
+func (p EvictionPolicy) validate() error {
+	switch p {
+	case "", EvictLRU, EvictLFU:
+		return nil
+	}
+	return fmt.Errorf("unknown cache eviction policy %q, want lru or lfu", p)
+}
+
+// lfuIndex orders a shard's entries by how often they have been read. The
+// entries are bucketed by hit count, most recently used first within a
+// bucket, so adding, reading and evicting are all O(1). The caller holds the
+// shard's lock.
+type lfuIndex struct {
+	// buckets holds the shard's order elements by hit count
+	buckets map[int]*list.List
+	minHits int
+}
+
+func newLFUIndex() *lfuIndex {
+	return &lfuIndex{buckets: make(map[int]*list.List)}
+}
+
+// add indexes a new entry as read hits times
+func (x *lfuIndex) add(elem *list.Element, hits int) {
+	item := elem.Value.(*cacheItem)
+	item.hits = hits
+	item.lfuElem = x.bucket(hits).PushFront(elem)
+	if hits < x.minHits || len(x.buckets) == 1 {
+		x.minHits = hits
+	}
+}
+
+// touch counts a read of an entry
+func (x *lfuIndex) touch(elem *list.Element) {
+	item := elem.Value.(*cacheItem)
+	x.remove(elem)
+	if item.hits == x.minHits && x.buckets[item.hits] == nil {
+		x.minHits++
+	}
+	item.hits++
+	item.lfuElem = x.bucket(item.hits).PushFront(elem)
+}
+
+// remove drops an entry from the index. minHits may be left pointing at an
+// empty bucket; victim finds the next one.
+func (x *lfuIndex) remove(elem *list.Element) {
+	item := elem.Value.(*cacheItem)
+	b := x.buckets[item.hits]
+	b.Remove(item.lfuElem)
+	if b.Len() == 0 {
+		delete(x.buckets, item.hits)
+	}
+}
+
+// victim returns the entry to evict, or nil when there are none
+func (x *lfuIndex) victim() *list.Element {
+	b := x.buckets[x.minHits]
+	if b == nil {
+		if len(x.buckets) == 0 {
+			return nil
+		}
+		first := true
+		for hits := range x.buckets {
+			if first || hits < x.minHits {
+				x.minHits, first = hits, false
+			}
+		}
+		b = x.buckets[x.minHits]
+	}
+	return b.Back().Value.(*list.Element)
+}
+
+// bucket returns the list for a hit count, creating it if needed
+func (x *lfuIndex) bucket(hits int) *list.List {
+	b, ok := x.buckets[hits]
+	if !ok {
+		b = list.New()
+		x.buckets[hits] = b
+	}
+	return b
+}
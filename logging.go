@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// parseLogLevel maps a configured level name to a slog.Level; "" is info
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", name)
+	}
+}
+
+// setupLogging points the default slog logger at stderr, dropping records
+// below the configured level. The log package writes through it too, at info.
+func setupLogging(cfg Config) error {
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
+// AccessLog writes a line per request to out in the Apache common log format
+// followed by the time taken in seconds, e.g.
+//
+//	127.0.0.1 - - [16/Oct/2026:09:30:00 +0000] "POST /api/llm HTTP/1.1" 200 312 0.482
+func AccessLog(next http.Handler, out io.Writer) http.Handler {
+	logger := log.New(out, "", 0)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		host := ClientIP(r)
+		size := "-"
+		if rec.bytes > 0 {
+			size = fmt.Sprint(rec.bytes)
+		}
+		logger.Printf("%s - - [%s] \"%s %s %s\" %d %s %.3f",
+			host, start.Format("02/Jan/2006:15:04:05 -0700"), r.Method, r.URL.RequestURI(), r.Proto,
+			rec.status, size, time.Since(start).Seconds())
+	})
+}
+
+// accessRecorder notes the status and body size of a response for AccessLog
+type accessRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *accessRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessRecorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streamed responses flowing through the recorder
+func (w *accessRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
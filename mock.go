@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MockConfig scripts the Mock provider so caching, retries, failover and
+// timeouts can be exercised deterministically. The provider config sets the
+// defaults and a request's mock field overrides any field it sets.
+type MockConfig struct {
+	// Latency is how long the call takes; it honours the request context,
+	// so it can trigger provider and request timeouts
+	Latency Duration `json:"latency,omitempty"`
+
+	// Response is the text returned; by default the last user message is echoed
+	Response string `json:"response,omitempty"`
+
+	// Tokens overrides the reported token count
+	Tokens int `json:"tokens,omitempty"`
+
+	// Error makes the call fail. With StatusCode it fails as an UpstreamError,
+	// so e.g. 503 is retried and trips the circuit breaker while 400 is not.
+	Error      string `json:"error,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+
+	// RetryAfter is reported with StatusCode as the provider's Retry-After
+	RetryAfter Duration `json:"retry_after,omitempty"`
+}
+
+// merge overlays the fields set in o onto c
+func (c MockConfig) merge(o *MockConfig) MockConfig {
+	if o == nil {
+		return c
+	}
+	if o.Latency != 0 {
+		c.Latency = o.Latency
+	}
+	if o.Response != "" {
+		c.Response = o.Response
+	}
+	if o.Tokens != 0 {
+		c.Tokens = o.Tokens
+	}
+	if o.Error != "" {
+		c.Error = o.Error
+	}
+	if o.StatusCode != 0 {
+		c.StatusCode = o.StatusCode
+	}
+	if o.RetryAfter != 0 {
+		c.RetryAfter = o.RetryAfter
+	}
+	return c
+}
+
+// callMock answers as scripted by the provider config and the request
+func (g *Gateway) callMock(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	mock := g.config.Providers[Mock].Mock.merge(req.Mock)
+
+	if err := simulateLatency(ctx, time.Duration(mock.Latency)); err != nil {
+		return LLMResponse{}, err
+	}
+
+	if mock.StatusCode != 0 && mock.StatusCode != 200 {
+		body := mock.Error
+		if body == "" {
+			body = fmt.Sprintf("mock status %d", mock.StatusCode)
+		}
+		return LLMResponse{}, &UpstreamError{Provider: Mock, StatusCode: mock.StatusCode, Body: body, RetryAfter: time.Duration(mock.RetryAfter)}
+	}
+	if mock.Error != "" {
+		return LLMResponse{}, errors.New(mock.Error)
+	}
+
+	text := mock.Response
+	if text == "" {
+		text = "Mock response to: " + req.lastUserMessage()
+	}
+	// Without scripted Tokens the usage is estimated like for any provider
+	// that doesn't report it
+	return LLMResponse{
+		Provider:   Mock,
+		Model:      req.Model,
+		Response:   text,
+		TokensUsed: mock.Tokens,
+	}, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Moderator decides whether a prompt may be sent upstream. Moderate returns
+// a non-empty reason when the text is blocked; an error means the check
+// itself failed.
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (reason string, err error)
+}
+
+// ModerationConfig enables the moderation pre-filter. Provider is
+// "blocklist", which matches Blocklist locally, or "openai", which uses the
+// OpenAI moderations endpoint with the openai provider's credentials.
+type ModerationConfig struct {
+	Provider  string   `json:"provider,omitempty"`
+	Blocklist []string `json:"blocklist,omitempty"`
+}
+
+// validate rejects an unknown moderation provider
+func (cfg ModerationConfig) validate() error {
+	switch cfg.Provider {
+	case "", "blocklist", "openai":
+		return nil
+	default:
+		return fmt.Errorf("unknown moderation provider %q", cfg.Provider)
+	}
+}
+
+// newModerator builds the Moderator described by cfg, or returns nil when
+// moderation is off
+func (g *Gateway) newModerator(cfg ModerationConfig) Moderator {
+	switch cfg.Provider {
+	case "blocklist":
+		return NewBlocklistModerator(cfg.Blocklist)
+	case "openai":
+		return openAIModerator{g: g}
+	default:
+		return nil
+	}
+}
+
+// BlocklistModerator blocks text containing any of its terms as whole words,
+// ignoring case
+type BlocklistModerator struct {
+	pattern *regexp.Regexp
+}
+
+// NewBlocklistModerator returns a BlocklistModerator for terms
+func NewBlocklistModerator(terms []string) *BlocklistModerator {
+	quoted := make([]string, 0, len(terms))
+	for _, t := range terms {
+		if t = strings.TrimSpace(t); t != "" {
+			quoted = append(quoted, regexp.QuoteMeta(t))
+		}
+	}
+	if len(quoted) == 0 {
+		return &BlocklistModerator{}
+	}
+	return &BlocklistModerator{pattern: regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)}
+}
+
+func (m *BlocklistModerator) Moderate(ctx context.Context, text string) (string, error) {
+	if m.pattern == nil {
+		return "", nil
+	}
+	if term := m.pattern.FindString(text); term != "" {
+		return "contains the blocked term " + strings.ToLower(term), nil
+	}
+	return "", nil
+}
+
+// openAIModerator calls the OpenAI /moderations endpoint
+type openAIModerator struct {
+	g *Gateway
+}
+
+type openAIModerationResponse struct {
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+func (m openAIModerator) Moderate(ctx context.Context, text string) (string, error) {
+	b, err := m.g.backend(OpenAI)
+	if err != nil {
+		return "", err
+	}
+	baseURL := b.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+
+	var result openAIModerationResponse
+	headers := map[string]string{"Authorization": "Bearer " + b.APIKey}
+	payload := map[string]string{"input": text}
+	if err := m.g.postJSON(ctx, OpenAI, baseURL+"/moderations", headers, payload, &result); err != nil {
+		return "", err
+	}
+	for _, r := range result.Results {
+		if !r.Flagged {
+			continue
+		}
+		var categories []string
+		for c, flagged := range r.Categories {
+			if flagged {
+				categories = append(categories, c)
+			}
+		}
+		if len(categories) == 0 {
+			return "flagged", nil
+		}
+		sort.Strings(categories)
+		return "flagged for " + strings.Join(categories, ", "), nil
+	}
+	return "", nil
+}
+
+// moderate runs what the client wrote through the moderator, if one is
+// configured, and counts the requests it blocks. The configured system prompt
+// and assistant turns aren't checked.
+func (g *Gateway) moderate(ctx context.Context, req LLMRequest) (string, error) {
+	if g.moderator == nil {
+		return "", nil
+	}
+	req.system = ""
+	var turns []string
+	for _, m := range req.conversation() {
+		if m.Role != "assistant" {
+			turns = append(turns, m.Content)
+		}
+	}
+	reason, err := g.moderator.Moderate(ctx, strings.Join(turns, "\n\n"))
+	if err != nil {
+		return "", fmt.Errorf("moderation: %w", err)
+	}
+	if reason != "" {
+		g.metrics.RecordModerationBlock()
+	}
+	return reason, nil
+}
+
+// moderationBlocked writes the 422 returned for a request the moderator
+// blocked
+func (g *Gateway) moderationBlocked(w http.ResponseWriter, r *http.Request, reason string) {
+	g.writeErrorResponse(w, r, http.StatusUnprocessableEntity, ErrorResponse{
+		Code:    CodeContentBlocked,
+		Message: "Content blocked by moderation",
+		Reason:  reason,
+	})
+}
+
+// OutputFilter checks a response before it is returned and cached. It
+// returns the text to send, which may be redacted, or a non-empty reason to
+// block the response altogether.
+type OutputFilter interface {
+	FilterOutput(ctx context.Context, text string) (filtered, reason string, err error)
+}
+
+// OutputModerationConfig enables the output filter, independently of
+// Config.Moderation. Provider and Blocklist block responses like they block
+// prompts; Redact masks email addresses, card numbers and RedactPatterns in
+// the responses that get through.
+type OutputModerationConfig struct {
+	ModerationConfig
+	Redact         bool     `json:"redact,omitempty"`
+	RedactPatterns []string `json:"redact_patterns,omitempty"`
+}
+
+// validate rejects an unknown moderation provider or a bad redact pattern
+func (cfg OutputModerationConfig) validate() error {
+	if err := cfg.ModerationConfig.validate(); err != nil {
+		return err
+	}
+	_, err := NewPatternRedactor(cfg.RedactPatterns...)
+	return err
+}
+
+// newOutputFilter builds the OutputFilter described by cfg, or returns nil
+// when output moderation is off
+func (g *Gateway) newOutputFilter(cfg OutputModerationConfig) (OutputFilter, error) {
+	f := moderatedOutput{moderator: g.newModerator(cfg.ModerationConfig)}
+	if cfg.Redact {
+		r, err := NewPatternRedactor(cfg.RedactPatterns...)
+		if err != nil {
+			return nil, err
+		}
+		f.redactor = r
+	}
+	if f.moderator == nil && f.redactor == nil {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// moderatedOutput blocks what its moderator flags and redacts the rest
+type moderatedOutput struct {
+	moderator Moderator
+	redactor  Redactor
+}
+
+func (f moderatedOutput) FilterOutput(ctx context.Context, text string) (string, string, error) {
+	if f.moderator != nil {
+		reason, err := f.moderator.Moderate(ctx, text)
+		if err != nil || reason != "" {
+			return "", reason, err
+		}
+	}
+	if f.redactor != nil {
+		text = f.redactor.Redact(text)
+	}
+	return text, "", nil
+}
+
+// OutputBlockedError is returned in place of a response the output filter
+// blocked, so its text never reaches the client or the cache
+type OutputBlockedError struct {
+	Reason string
+}
+
+func (e *OutputBlockedError) Error() string {
+	return "response blocked by output moderation: " + e.Reason
+}
+
+// filterOutput runs every completion in response through the output filter,
+// if one is configured, replacing them with the filtered text
+func (g *Gateway) filterOutput(ctx context.Context, response *LLMResponse) error {
+	if g.outputFilter == nil {
+		return nil
+	}
+	filter := func(text string) (string, error) {
+		filtered, reason, err := g.outputFilter.FilterOutput(ctx, text)
+		if err != nil {
+			return "", fmt.Errorf("output moderation: %w", err)
+		}
+		if reason != "" {
+			g.metrics.RecordOutputBlock()
+			return "", &OutputBlockedError{Reason: reason}
+		}
+		return filtered, nil
+	}
+
+	if len(response.Responses) == 0 {
+		text, err := filter(response.Response)
+		response.Response = text
+		return err
+	}
+	for i, r := range response.Responses {
+		text, err := filter(r)
+		if err != nil {
+			return err
+		}
+		response.Responses[i] = text
+	}
+	response.Response = response.Responses[0]
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultOllamaBaseURL is where a local Ollama server listens by default
+const defaultOllamaBaseURL = "http://localhost:11434"
+
+// Ollama /api/generate wire format
+type ollamaGenerateRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	System  string         `json:"system,omitempty"`
+	Stream  bool           `json:"stream"`
+	Format  string         `json:"format,omitempty"`
+	Options *ollamaOptions `json:"options,omitempty"`
+}
+
+type ollamaOptions struct {
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// ollamaGenerateResponse is the whole reply, or one line of a streamed reply
+type ollamaGenerateResponse struct {
+	Model           string `json:"model"`
+	Response        string `json:"response"`
+	Done            bool   `json:"done"`
+	Error           string `json:"error"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+}
+
+// flattenConversation renders a conversation as a single prompt for APIs
+// that take one, such as Ollama's /api/generate. System messages are returned
+// separately; a lone user message is returned as is.
+func flattenConversation(msgs []Message) (prompt, system string) {
+	var systems []string
+	var turns []Message
+	for _, m := range msgs {
+		if m.Role == "system" {
+			systems = append(systems, m.Content)
+		} else {
+			turns = append(turns, m)
+		}
+	}
+	system = strings.Join(systems, "\n\n")
+
+	if len(turns) == 1 && turns[0].Role == "user" {
+		return turns[0].Content, system
+	}
+	var b strings.Builder
+	for _, m := range turns {
+		role := "User"
+		if m.Role == "assistant" {
+			role = "Assistant"
+		}
+		fmt.Fprintf(&b, "%s: %s\n\n", role, m.Content)
+	}
+	b.WriteString("Assistant:")
+	return b.String(), system
+}
+
+// ollamaRequest returns the endpoint and payload for an Ollama call. Ollama
+// needs no API key.
+func (g *Gateway) ollamaRequest(req LLMRequest, stream bool) (string, ollamaGenerateRequest, error) {
+	b, err := g.backend(Ollama)
+	if err != nil {
+		return "", ollamaGenerateRequest{}, err
+	}
+	baseURL := b.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOllamaBaseURL
+	}
+
+	prompt, system := flattenConversation(req.conversation())
+	payload := ollamaGenerateRequest{
+		Model:  req.Model,
+		Prompt: prompt,
+		System: system,
+		Stream: stream,
+	}
+	if req.ResponseFormat == ResponseFormatJSON {
+		payload.Format = "json"
+	}
+	if req.MaxTokens > 0 || req.Temperature != nil || req.TopP != nil || len(req.Stop) > 0 {
+		payload.Options = &ollamaOptions{
+			NumPredict:  req.MaxTokens,
+			Temperature: req.Temperature,
+			TopP:        req.TopP,
+			Stop:        req.Stop,
+		}
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/api/generate", payload, nil
+}
+
+// ollamaResponse converts a finished Ollama reply
+func ollamaResponse(model, text string, result ollamaGenerateResponse) LLMResponse {
+	if result.Model != "" {
+		model = result.Model
+	}
+	return LLMResponse{
+		Provider:   Ollama,
+		Model:      model,
+		Response:   text,
+		TokensUsed: result.PromptEvalCount + result.EvalCount,
+
+		PromptTokens:     result.PromptEvalCount,
+		CompletionTokens: result.EvalCount,
+	}
+}
+
+// callOllama calls a local Ollama server's /api/generate
+func (g *Gateway) callOllama(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	url, payload, err := g.ollamaRequest(req, false)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+
+	var result ollamaGenerateResponse
+	if err := g.postJSON(ctx, Ollama, url, nil, payload, &result); err != nil {
+		return LLMResponse{}, err
+	}
+	if result.Error != "" {
+		return LLMResponse{}, fmt.Errorf("ollama: %s", result.Error)
+	}
+	return ollamaResponse(req.Model, result.Response, result), nil
+}
+
+// streamOllama calls /api/generate with streaming on; Ollama replies with one
+// JSON object per line, the last of which has done set and the token counts
+func (g *Gateway) streamOllama(ctx context.Context, req LLMRequest, emit func(string) error) (LLMResponse, error) {
+	url, payload, err := g.ollamaRequest(req, true)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+
+	resp, err := g.sendUpstream(ctx, Ollama, url, nil, payload)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var chunk ollamaGenerateResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return LLMResponse{}, fmt.Errorf("decoding ollama stream: %w", err)
+		}
+		if chunk.Error != "" {
+			return LLMResponse{}, fmt.Errorf("ollama: %s", chunk.Error)
+		}
+		if chunk.Response != "" {
+			text.WriteString(chunk.Response)
+			if err := emit(chunk.Response); err != nil {
+				return LLMResponse{}, err
+			}
+		}
+		if chunk.Done {
+			return ollamaResponse(req.Model, text.String(), chunk), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return LLMResponse{}, fmt.Errorf("reading ollama stream: %w", err)
+	}
+	return LLMResponse{}, fmt.Errorf("ollama stream ended before completion")
+}
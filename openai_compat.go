@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ChatMessage is a single message in an OpenAI-style conversation
+type ChatMessage struct {
+	Role       string     `json:"role,omitempty"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// ChatCompletionRequest is the OpenAI /v1/chat/completions request body.
+// Provider is a gateway extension; when empty it is inferred from Model.
+type ChatCompletionRequest struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	MaxTokens   int           `json:"max_tokens,omitempty"`
+	Temperature *float64      `json:"temperature,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+	Provider    ModelProvider `json:"provider,omitempty"`
+	TopP        *float64      `json:"top_p,omitempty"`
+	Stop        stopList      `json:"stop,omitempty"`
+	N           int           `json:"n,omitempty"`
+
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+	Tools          []Tool                `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage       `json:"tool_choice,omitempty"`
+}
+
+// stopList is the OpenAI stop parameter, which may be a single string or an
+// array of them
+type stopList []string
+
+func (s *stopList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = stopList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*s = many
+	return nil
+}
+
+// ChatCompletionResponse is the OpenAI chat.completion response body
+type ChatCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   *ChatCompletionUsage   `json:"usage,omitempty"`
+}
+
+type ChatCompletionChoice struct {
+	Index        int          `json:"index"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	Delta        *ChatMessage `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type ChatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// newCompletionID returns a random OpenAI-style completion ID
+func newCompletionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "chatcmpl-" + hex.EncodeToString(b)
+}
+
+// providerForModel infers the provider from a model name, defaulting to OpenAI
+func providerForModel(model string) ModelProvider {
+	m := strings.ToLower(model)
+	switch {
+	case strings.HasPrefix(m, "claude"):
+		return Anthropic
+	case strings.HasPrefix(m, "gemini"):
+		return Google
+	case strings.HasPrefix(m, "deepseek"):
+		return DeepSeek
+	default:
+		return OpenAI
+	}
+}
+
+// toLLMRequest translates the OpenAI schema into the gateway's request. The
+// provider is inferred from the model when only the model is given.
+func (c ChatCompletionRequest) toLLMRequest() LLMRequest {
+	provider := c.Provider
+	if provider == "" && c.Model != "" {
+		provider = providerForModel(c.Model)
+	}
+
+	messages := make([]Message, len(c.Messages))
+	for i, m := range c.Messages {
+		messages[i] = Message{Role: m.Role, Content: m.Content, ToolCalls: m.ToolCalls, ToolCallID: m.ToolCallID}
+	}
+
+	req := LLMRequest{
+		Messages:    messages,
+		Model:       c.Model,
+		Provider:    provider,
+		MaxTokens:   c.MaxTokens,
+		Temperature: c.Temperature,
+		Stream:      c.Stream,
+		TopP:        c.TopP,
+		Stop:        c.Stop,
+		N:           c.N,
+		Tools:       c.Tools,
+		ToolChoice:  c.ToolChoice,
+	}
+	if c.ResponseFormat != nil {
+		req.ResponseFormat = c.ResponseFormat.Type
+	}
+	return req
+}
+
+// writeOpenAIError writes an error in the shape OpenAI clients expect
+func (g *Gateway) writeOpenAIError(w http.ResponseWriter, r *http.Request, status int, errType, message string) {
+	g.writeJSON(w, r, status, map[string]interface{}{
+		"error": map[string]string{
+			"message": message,
+			"type":    errType,
+		},
+	})
+}
+
+// HandleChatCompletions serves the OpenAI-compatible /v1/chat/completions
+// endpoint so existing OpenAI SDKs can use the gateway by changing the base URL
+func (g *Gateway) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	g.inFlight.Add(1)
+	defer g.inFlight.Add(-1)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		g.writeOpenAIError(w, r, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+
+	if !g.allowRequest(w, r) {
+		g.writeOpenAIError(w, r, http.StatusTooManyRequests, "rate_limit_error", "Rate limit exceeded")
+		g.metrics.RecordError()
+		return
+	}
+
+	var chatReq ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&chatReq); err != nil {
+		if bodyTooLarge(err) {
+			g.writeOpenAIError(w, r, http.StatusRequestEntityTooLarge, "invalid_request_error", "Request body too large")
+			g.metrics.RecordError()
+			return
+		}
+		g.writeOpenAIError(w, r, http.StatusBadRequest, "invalid_request_error", "Invalid request body")
+		g.metrics.RecordError()
+		return
+	}
+	if len(chatReq.Messages) == 0 {
+		g.writeOpenAIError(w, r, http.StatusBadRequest, "invalid_request_error", "messages must not be empty")
+		g.metrics.RecordError()
+		return
+	}
+
+	req := chatReq.toLLMRequest()
+	req.NoCache = noCacheRequested(r)
+	g.applyDefaults(&req)
+	if req.Provider == "" {
+		req.Provider = providerForModel(req.Model)
+	}
+	g.routeExperiment(w, r, &req)
+	if err := timeoutHeader(r, &req); err != nil {
+		g.writeOpenAIError(w, r, http.StatusBadRequest, "invalid_request_error", err.Error())
+		g.metrics.RecordError()
+		return
+	}
+	if invalid := g.validate(req); invalid != nil {
+		g.writeOpenAIError(w, r, http.StatusBadRequest, "invalid_request_error", invalid.Error())
+		g.metrics.RecordError()
+		return
+	}
+
+	if err := g.checkAccess(r.Context(), req); err != nil {
+		g.writeOpenAIError(w, r, http.StatusForbidden, "permission_error", err.Error())
+		g.metrics.RecordError()
+		return
+	}
+
+	if g.overBudget(r.Context()) {
+		g.writeOpenAIError(w, r, http.StatusPaymentRequired, "insufficient_quota", "Monthly budget exceeded")
+		g.metrics.RecordError()
+		return
+	}
+
+	if reason, err := g.moderate(r.Context(), req); err != nil {
+		g.writeOpenAIError(w, r, http.StatusBadGateway, "api_error", err.Error())
+		g.metrics.RecordError()
+		return
+	} else if reason != "" {
+		g.writeOpenAIError(w, r, http.StatusUnprocessableEntity, "content_policy_violation", "Content blocked by moderation: "+reason)
+		return
+	}
+
+	ctx, cancel := g.withRequestTimeout(r.Context(), req)
+	defer cancel()
+
+	if req.Stream {
+		g.handleStream(w, r.WithContext(ctx), req, &openAIStream{
+			id:      newCompletionID(),
+			created: time.Now().Unix(),
+			model:   req.Model,
+		})
+		return
+	}
+
+	response, err := g.completeLLMRequest(ctx, req)
+	if err != nil {
+		if g.clientCancelled(w, ctx) {
+			return
+		}
+		switch status, _ := errorStatus(ctx, err); status {
+		case http.StatusGatewayTimeout:
+			g.writeOpenAIError(w, r, http.StatusGatewayTimeout, "timeout", err.Error())
+			g.metrics.RecordError()
+			return
+		case http.StatusUnprocessableEntity:
+			g.writeOpenAIError(w, r, http.StatusUnprocessableEntity, "content_policy_violation", err.Error())
+			g.metrics.RecordError()
+			return
+		}
+		g.writeOpenAIError(w, r, http.StatusBadGateway, "api_error", err.Error())
+		g.metrics.RecordError()
+		return
+	}
+
+	if response.Stale {
+		w.Header().Set("X-Cache-Stale", "true")
+	}
+	stop := "stop"
+	g.writeJSON(w, r, http.StatusOK, ChatCompletionResponse{
+		ID:      newCompletionID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   response.Model,
+		Choices: completionChoices(response, &stop),
+		Usage: &ChatCompletionUsage{
+			PromptTokens:     response.PromptTokens,
+			CompletionTokens: response.CompletionTokens,
+			TotalTokens:      response.TokensUsed,
+		},
+	})
+}
+
+// completionChoices returns a choice for each completion in response. Tool
+// calls belong to the first, which finishes with "tool_calls" when there
+// are any.
+func completionChoices(response LLMResponse, finishReason *string) []ChatCompletionChoice {
+	completions := response.Responses
+	if len(completions) == 0 {
+		completions = []string{response.Response}
+	}
+	choices := make([]ChatCompletionChoice, len(completions))
+	for i, text := range completions {
+		choices[i] = ChatCompletionChoice{
+			Index:        i,
+			Message:      &ChatMessage{Role: "assistant", Content: text},
+			FinishReason: finishReason,
+		}
+	}
+	if len(response.ToolCalls) > 0 {
+		toolCalls := "tool_calls"
+		choices[0].Message.ToolCalls = response.ToolCalls
+		choices[0].FinishReason = &toolCalls
+	}
+	return choices
+}
+
+// openAIStream encodes a stream as chat.completion.chunk events followed by
+// the [DONE] sentinel
+type openAIStream struct {
+	id       string
+	created  int64
+	model    string
+	sentRole bool
+}
+
+func (s *openAIStream) chunk(delta *ChatMessage, finishReason *string) ChatCompletionResponse {
+	return ChatCompletionResponse{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: s.created,
+		Model:   s.model,
+		Choices: []ChatCompletionChoice{{Delta: delta, FinishReason: finishReason}},
+	}
+}
+
+func (s *openAIStream) writeDelta(w io.Writer, delta string) error {
+	msg := &ChatMessage{Content: delta}
+	if !s.sentRole {
+		msg.Role = "assistant"
+		s.sentRole = true
+	}
+	return writeEvent(w, "", s.chunk(msg, nil))
+}
+
+func (s *openAIStream) writeDone(w io.Writer, response LLMResponse) error {
+	stop := "stop"
+	final := s.chunk(&ChatMessage{}, &stop)
+	final.Usage = &ChatCompletionUsage{
+		PromptTokens:     response.PromptTokens,
+		CompletionTokens: response.CompletionTokens,
+		TotalTokens:      response.TokensUsed,
+	}
+	if err := writeEvent(w, "", final); err != nil {
+		return err
+	}
+	_, err := fmt.Fprint(w, "data: [DONE]\n\n")
+	return err
+}
+
+func (s *openAIStream) writeError(w io.Writer, err error) error {
+	return writeEvent(w, "", map[string]interface{}{
+		"error": map[string]string{"message": err.Error(), "type": "api_error"},
+	})
+}
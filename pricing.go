@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModelPrice is the cost of a model in USD per million tokens
+type ModelPrice struct {
+	InputPerMillion  float64 `json:"input_per_million"`
+	OutputPerMillion float64 `json:"output_per_million"`
+}
+
+// defaultPricing covers common models; Config.Pricing entries override it
+var defaultPricing = map[string]ModelPrice{
+	"gpt-4o":            {InputPerMillion: 2.50, OutputPerMillion: 10.00},
+	"gpt-4o-mini":       {InputPerMillion: 0.15, OutputPerMillion: 0.60},
+	"gpt-4":             {InputPerMillion: 30.00, OutputPerMillion: 60.00},
+	"claude-sonnet-4-5": {InputPerMillion: 3.00, OutputPerMillion: 15.00},
+	"gemini-2.0-flash":  {InputPerMillion: 0.10, OutputPerMillion: 0.40},
+	"deepseek-chat":     {InputPerMillion: 0.27, OutputPerMillion: 1.10},
+
+	// Embedding models only bill their input
+	"text-embedding-3-small": {InputPerMillion: 0.02},
+	"text-embedding-3-large": {InputPerMillion: 0.13},
+	"text-embedding-ada-002": {InputPerMillion: 0.10},
+}
+
+// priceFor returns the price for a model, matching the longest configured
+// prefix so dated variants like gpt-4o-2024-08-06 use the gpt-4o price
+func (g *Gateway) priceFor(model string) (ModelPrice, bool) {
+	if price, ok := g.pricing[model]; ok {
+		return price, true
+	}
+
+	var best string
+	for name := range g.pricing {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return g.pricing[best], true
+}
+
+// estimateCost prices a response. When the provider did not split usage into
+// prompt and completion tokens, every token is charged at the output rate so
+// budgets err on the side of stopping early.
+func (g *Gateway) estimateCost(response LLMResponse) float64 {
+	price, ok := g.priceFor(response.Model)
+	if !ok {
+		return 0
+	}
+	if response.PromptTokens == 0 && response.CompletionTokens == 0 {
+		return float64(response.TokensUsed) * price.OutputPerMillion / 1e6
+	}
+	return (float64(response.PromptTokens)*price.InputPerMillion +
+		float64(response.CompletionTokens)*price.OutputPerMillion) / 1e6
+}
+
+// SpendTracker accumulates estimated spend per API key for the current
+// calendar month (UTC), starting over when the month changes
+type SpendTracker struct {
+	mu    sync.Mutex
+	month string
+	spend map[string]float64
+}
+
+// NewSpendTracker creates an empty tracker
+func NewSpendTracker() *SpendTracker {
+	return &SpendTracker{spend: make(map[string]float64)}
+}
+
+// rollover resets the totals at the start of a new month; the caller must hold s.mu
+func (s *SpendTracker) rollover() {
+	month := time.Now().UTC().Format("2006-01")
+	if month != s.month {
+		s.month = month
+		s.spend = make(map[string]float64)
+	}
+}
+
+// Add records cost against a key. A nil tracker records nothing.
+func (s *SpendTracker) Add(key string, cost float64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover()
+	s.spend[key] += cost
+}
+
+// Spend returns the key's spend so far this month
+func (s *SpendTracker) Spend(key string) float64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover()
+	return s.spend[key]
+}
+
+// Snapshot returns a copy of this month's spend per key
+func (s *SpendTracker) Snapshot() map[string]float64 {
+	if s == nil {
+		return map[string]float64{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover()
+
+	snapshot := make(map[string]float64, len(s.spend))
+	for k, v := range s.spend {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+// overBudget reports whether the authenticated key has used up its monthly budget
+func (g *Gateway) overBudget(ctx context.Context) bool {
+	label := APIKeyLabel(ctx)
+	budget, ok := g.budgets[label]
+	return ok && budget > 0 && g.spend.Spend(label) >= budget
+}
+
+// recordSpend charges a fresh upstream response to the authenticated key
+func (g *Gateway) recordSpend(ctx context.Context, response LLMResponse) {
+	if cost := response.EstimatedCost; cost > 0 {
+		g.spend.Add(APIKeyLabel(ctx), cost)
+	}
+}
+
+// budgetExceeded writes the 402 returned once a key's budget is used up
+func (g *Gateway) budgetExceeded(w http.ResponseWriter, r *http.Request) {
+	g.writeError(w, r, http.StatusPaymentRequired, CodeBudgetExceeded, "Monthly budget exceeded")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// HandlePrometheusMetrics returns gateway metrics in the Prometheus text
+// exposition format. The JSON /api/metrics endpoint remains for existing clients.
+func (g *Gateway) HandlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	m := g.metricsOrEmpty()
+	snap := m.Snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeCounter(w, "gateway_requests_total", "Total successful LLM requests.", snap.TotalRequests)
+	writeCounter(w, "gateway_cache_hits_total", "Total cache hits.", snap.CacheHits)
+	writeCounter(w, "gateway_cache_misses_total", "Total cache misses.", snap.CacheMisses)
+	writeCounter(w, "gateway_errors_total", "Total failed requests.", snap.Errors)
+	writeCounter(w, "gateway_failovers_total", "Total failovers to a fallback provider.", snap.Failovers)
+	writeCounter(w, "gateway_semantic_cache_hits_total", "Total cache hits found by prompt similarity.", snap.SemanticHits)
+	writeCounter(w, "gateway_coalesced_requests_total", "Total requests that shared an in-flight upstream call.", snap.Coalesced)
+	writeCounter(w, "gateway_client_cancelled_total", "Total requests abandoned by the client.", snap.Cancelled)
+	writeCounter(w, "gateway_moderation_blocks_total", "Total requests blocked by moderation.", snap.Moderated)
+	writeCounter(w, "gateway_output_blocks_total", "Total responses blocked by output moderation.", snap.OutputBlocked)
+	writeCounter(w, "gateway_streams_stopped_total", "Total streams stopped early by the client.", snap.Stopped)
+	writeCounter(w, "gateway_shadow_requests_total", "Total calls mirrored to the shadow provider.", snap.ShadowRequests)
+	writeCounter(w, "gateway_shadow_errors_total", "Total shadow calls that failed.", snap.ShadowErrors)
+	writeCounter(w, "gateway_shadow_skipped_total", "Total sampled requests not mirrored because of the shadow limits.", snap.ShadowSkipped)
+	writeCounter(w, "gateway_response_write_failures_total", "Total responses that could not be encoded or were cut off while written.", snap.WriteFailures)
+	writeCounter(w, "gateway_stale_served_total", "Total expired cache entries served because every provider failed.", snap.StaleServed)
+	writeCounter(w, "gateway_provider_timeouts_total", "Total provider calls that exceeded their timeout.", snap.Timeouts)
+
+	// Only the provider is used as a label; model names come from clients and
+	// would make the series cardinality unbounded
+	providers := make([]string, 0, len(snap.Providers))
+	for p := range snap.Providers {
+		providers = append(providers, string(p))
+	}
+	sort.Strings(providers)
+
+	fmt.Fprintln(w, "# HELP gateway_provider_requests_total Successful requests per provider.")
+	fmt.Fprintln(w, "# TYPE gateway_provider_requests_total counter")
+	for _, p := range providers {
+		fmt.Fprintf(w, "gateway_provider_requests_total{provider=%q} %d\n", p, snap.Providers[ModelProvider(p)].Requests)
+	}
+	fmt.Fprintln(w, "# HELP gateway_provider_errors_total Failed upstream calls per provider.")
+	fmt.Fprintln(w, "# TYPE gateway_provider_errors_total counter")
+	for _, p := range providers {
+		fmt.Fprintf(w, "gateway_provider_errors_total{provider=%q} %d\n", p, snap.Providers[ModelProvider(p)].Errors)
+	}
+	fmt.Fprintln(w, "# HELP gateway_provider_rate_limited_total Upstream 429 responses per provider.")
+	fmt.Fprintln(w, "# TYPE gateway_provider_rate_limited_total counter")
+	for _, p := range providers {
+		fmt.Fprintf(w, "gateway_provider_rate_limited_total{provider=%q} %d\n", p, snap.Providers[ModelProvider(p)].RateLimited)
+	}
+
+	experiments := make([]string, 0, len(snap.Experiments))
+	for e := range snap.Experiments {
+		experiments = append(experiments, e)
+	}
+	sort.Strings(experiments)
+
+	fmt.Fprintln(w, "# HELP gateway_experiment_requests_total Requests routed to each experiment variant.")
+	fmt.Fprintln(w, "# TYPE gateway_experiment_requests_total counter")
+	for _, e := range experiments {
+		variants := make([]string, 0, len(snap.Experiments[e]))
+		for v := range snap.Experiments[e] {
+			variants = append(variants, v)
+		}
+		sort.Strings(variants)
+		for _, v := range variants {
+			fmt.Fprintf(w, "gateway_experiment_requests_total{experiment=%q,variant=%q} %d\n", e, v, snap.Experiments[e][v])
+		}
+	}
+
+	breakers := g.breakerStates()
+	breakerProviders := make([]string, 0, len(breakers))
+	for p := range breakers {
+		breakerProviders = append(breakerProviders, string(p))
+	}
+	sort.Strings(breakerProviders)
+
+	fmt.Fprintln(w, "# HELP gateway_circuit_breaker_state Circuit breaker state per provider (0=closed, 1=open, 2=half-open).")
+	fmt.Fprintln(w, "# TYPE gateway_circuit_breaker_state gauge")
+	for _, p := range breakerProviders {
+		fmt.Fprintf(w, "gateway_circuit_breaker_state{provider=%q} %d\n", p, breakers[ModelProvider(p)])
+	}
+
+	slotProviders := make([]string, 0, len(g.slots))
+	for p := range g.slots {
+		slotProviders = append(slotProviders, string(p))
+	}
+	sort.Strings(slotProviders)
+
+	fmt.Fprintln(w, "# HELP gateway_upstream_in_flight Upstream calls currently running per provider.")
+	fmt.Fprintln(w, "# TYPE gateway_upstream_in_flight gauge")
+	for _, p := range slotProviders {
+		fmt.Fprintf(w, "gateway_upstream_in_flight{provider=%q} %d\n", p, g.slots[ModelProvider(p)].active.Load())
+	}
+	fmt.Fprintln(w, "# HELP gateway_upstream_waiting Calls queued for a free upstream slot per provider and priority.")
+	fmt.Fprintln(w, "# TYPE gateway_upstream_waiting gauge")
+	for _, p := range slotProviders {
+		waiting := g.slots[ModelProvider(p)].waiting()
+		for _, priority := range priorities {
+			fmt.Fprintf(w, "gateway_upstream_waiting{provider=%q,priority=%q} %d\n", p, priority, waiting[priority])
+		}
+	}
+
+	if sized, ok := g.responseCache().(SizedCache); ok {
+		fmt.Fprintln(w, "# HELP gateway_cache_bytes Approximate size of the cached responses.")
+		fmt.Fprintln(w, "# TYPE gateway_cache_bytes gauge")
+		fmt.Fprintf(w, "gateway_cache_bytes %d\n", sized.Bytes())
+	}
+
+	fmt.Fprintln(w, "# HELP gateway_rate_queue_depth Requests waiting for the rate limit.")
+	fmt.Fprintln(w, "# TYPE gateway_rate_queue_depth gauge")
+	fmt.Fprintf(w, "gateway_rate_queue_depth %d\n", g.rateQueueDepth())
+
+	fmt.Fprintln(w, "# HELP gateway_rate_queue_wait_seconds Time requests spent waiting for the rate limit.")
+	fmt.Fprintln(w, "# TYPE gateway_rate_queue_wait_seconds histogram")
+	var queued int64
+	for i, le := range latencyBuckets {
+		queued += m.queueWait.buckets[i].Load()
+		fmt.Fprintf(w, "gateway_rate_queue_wait_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(le, 'f', -1, 64), queued)
+	}
+	queued += m.queueWait.buckets[len(latencyBuckets)].Load()
+	fmt.Fprintf(w, "gateway_rate_queue_wait_seconds_bucket{le=\"+Inf\"} %d\n", queued)
+	fmt.Fprintf(w, "gateway_rate_queue_wait_seconds_sum %g\n", float64(m.queueWait.sumMicros.Load())/1e6)
+	fmt.Fprintf(w, "gateway_rate_queue_wait_seconds_count %d\n", m.queueWait.count.Load())
+
+	writeProviderHistogram(w, "gateway_request_duration_seconds", "Upstream response latency.", providers,
+		func(p ModelProvider) *Histogram { return snap.Providers[p].latency })
+	writeProviderHistogram(w, "gateway_time_to_first_token_seconds", "Time until a streamed response sent its first token.", providers,
+		func(p ModelProvider) *Histogram { return snap.Providers[p].ttft })
+}
+
+// writeProviderHistogram writes a histogram labelled by provider, taking each
+// provider's histogram from get
+func writeProviderHistogram(w io.Writer, name, help string, providers []string, get func(ModelProvider) *Histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, p := range providers {
+		h := get(ModelProvider(p))
+		var cumulative int64
+		for i, le := range latencyBuckets {
+			cumulative += h.buckets[i].Load()
+			fmt.Fprintf(w, "%s_bucket{provider=%q,le=%q} %d\n",
+				name, p, strconv.FormatFloat(le, 'f', -1, 64), cumulative)
+		}
+		cumulative += h.buckets[len(latencyBuckets)].Load()
+		fmt.Fprintf(w, "%s_bucket{provider=%q,le=\"+Inf\"} %d\n", name, p, cumulative)
+		fmt.Fprintf(w, "%s_sum{provider=%q} %g\n", name, p, float64(h.sumMicros.Load())/1e6)
+		fmt.Fprintf(w, "%s_count{provider=%q} %d\n", name, p, h.count.Load())
+	}
+}
+
+// writeCounter writes a single unlabelled counter with its HELP and TYPE lines
+func writeCounter(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
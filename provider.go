@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthCheckTimeout bounds a single provider health check
+const healthCheckTimeout = 5 * time.Second
+
+// Provider answers LLM requests on behalf of one provider name. The built-in
+// providers implement it, and custom ones can be added with RegisterProvider.
+// Failover, retries, circuit breakers and concurrency limits are applied by
+// the gateway around Call, keyed by Name.
+type Provider interface {
+	Name() ModelProvider
+	Call(ctx context.Context, req LLMRequest) (LLMResponse, error)
+
+	// HealthCheck reports why the provider can't take requests, or nil.
+	// It is only run on demand, see HandleProviders, so it may call out.
+	HealthCheck(ctx context.Context) error
+}
+
+// funcProvider adapts a ProviderFunc to Provider
+type funcProvider struct {
+	name ModelProvider
+	call ProviderFunc
+}
+
+// NewFuncProvider returns a Provider named name that answers with call and
+// always reports healthy
+func NewFuncProvider(name ModelProvider, call ProviderFunc) Provider {
+	return funcProvider{name: name, call: call}
+}
+
+func (p funcProvider) Name() ModelProvider { return p.name }
+
+func (p funcProvider) Call(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	return p.call(ctx, req)
+}
+
+func (p funcProvider) HealthCheck(ctx context.Context) error { return nil }
+
+// openAIProvider calls the OpenAI API
+type openAIProvider struct{ g *Gateway }
+
+func (p openAIProvider) Name() ModelProvider { return OpenAI }
+
+func (p openAIProvider) Call(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	return p.g.callOpenAI(ctx, req)
+}
+
+// HealthCheck lists the models, which needs a valid key but costs nothing
+func (p openAIProvider) HealthCheck(ctx context.Context) error {
+	b, err := p.g.configuredBackend(OpenAI)
+	if err != nil {
+		return err
+	}
+	if b.APIKey == "" {
+		return fmt.Errorf("no API key configured for openai backend %s", b.Name)
+	}
+	baseURL := b.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	return p.g.probe(ctx, OpenAI, baseURL+"/models", map[string]string{"Authorization": "Bearer " + b.APIKey})
+}
+
+// azureProvider calls chat completions deployments on Azure OpenAI
+type azureProvider struct{ g *Gateway }
+
+func (p azureProvider) Name() ModelProvider { return AzureOpenAI }
+
+func (p azureProvider) Call(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	return p.g.callAzureOpenAI(ctx, req)
+}
+
+// HealthCheck only checks the configuration, since deployments are per model
+func (p azureProvider) HealthCheck(ctx context.Context) error {
+	b, err := p.g.configuredBackend(AzureOpenAI)
+	if err != nil {
+		return err
+	}
+	if b.APIKey == "" || b.BaseURL == "" {
+		return fmt.Errorf("azure backend %s needs an API key and a base URL", b.Name)
+	}
+	return nil
+}
+
+// ollamaProvider calls a local Ollama server
+type ollamaProvider struct{ g *Gateway }
+
+func (p ollamaProvider) Name() ModelProvider { return Ollama }
+
+func (p ollamaProvider) Call(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	return p.g.callOllama(ctx, req)
+}
+
+// HealthCheck lists the local models, which succeeds whenever the server is up
+func (p ollamaProvider) HealthCheck(ctx context.Context) error {
+	b, err := p.g.configuredBackend(Ollama)
+	if err != nil {
+		return err
+	}
+	baseURL := b.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOllamaBaseURL
+	}
+	return p.g.probe(ctx, Ollama, strings.TrimSuffix(baseURL, "/")+"/api/tags", nil)
+}
+
+// bedrockProvider calls models through the Bedrock runtime
+type bedrockProvider struct{ g *Gateway }
+
+func (p bedrockProvider) Name() ModelProvider { return Bedrock }
+
+func (p bedrockProvider) Call(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	return p.g.callBedrock(ctx, req)
+}
+
+// HealthCheck only checks the configuration; the runtime API has nothing to
+// call that doesn't invoke a model
+func (p bedrockProvider) HealthCheck(ctx context.Context) error {
+	pc := p.g.config.Providers[Bedrock]
+	if pc.Region == "" || pc.AWS.AccessKeyID == "" || pc.AWS.SecretAccessKey == "" {
+		return fmt.Errorf("bedrock: region and AWS credentials must be configured")
+	}
+	return nil
+}
+
+// builtinProviders returns the supported providers by name. The simulated
+// ones are answered locally, so they have no upstream to check.
+func (g *Gateway) builtinProviders() map[ModelProvider]Provider {
+	return map[ModelProvider]Provider{
+		OpenAI:      openAIProvider{g},
+		AzureOpenAI: azureProvider{g},
+		Ollama:      ollamaProvider{g},
+		Bedrock:     bedrockProvider{g},
+		Mock:        funcProvider{Mock, g.callMock},
+		Anthropic:   funcProvider{Anthropic, g.callAnthropic},
+		Google:      funcProvider{Google, g.callGoogle},
+		DeepSeek:    funcProvider{DeepSeek, g.callDeepSeek},
+	}
+}
+
+// RegisterProvider makes requests for p.Name() go to p, adding a custom
+// provider or replacing a built-in one. Register providers before the
+// gateway starts serving; the registry isn't safe to change while requests
+// are handled.
+func (g *Gateway) RegisterProvider(p Provider) {
+	if g.registry == nil {
+		g.registry = g.builtinProviders()
+	}
+	g.registry[p.Name()] = p
+}
+
+// lookupProvider returns the provider registered under name. A Gateway built
+// without NewGateway has only the built-in providers.
+func (g *Gateway) lookupProvider(name ModelProvider) (Provider, bool) {
+	registry := g.registry
+	if registry == nil {
+		registry = g.builtinProviders()
+	}
+	p, ok := registry[name]
+	return p, ok
+}
+
+// configuredBackend returns the first backend configured for p, without
+// counting it as picked for a request
+func (g *Gateway) configuredBackend(p ModelProvider) (*Backend, error) {
+	pool, exists := g.backends[p]
+	if !exists || len(pool.backends) == 0 {
+		return nil, fmt.Errorf("no backend configured for %s", p)
+	}
+	return pool.backends[0], nil
+}
+
+// probe GETs url and reports a failure to connect or a non-2xx status
+func (g *Gateway) probe(ctx context.Context, provider ModelProvider, url string, headers map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		httpReq.Header.Set(k, v)
+	}
+	client := g.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("%s unreachable: %w", provider, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s health check returned %s", provider, resp.Status)
+	}
+	return nil
+}
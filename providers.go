@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ModelConfig describes a model offered through a provider. MaxTokens is the
+// max_tokens requests for the model get when they set none; ContextWindow
+// overrides the context window table for it, see checkTokenLimit.
+type ModelConfig struct {
+	Name          string `json:"name"`
+	MaxTokens     int    `json:"max_tokens,omitempty"`
+	ContextWindow int    `json:"context_window,omitempty"`
+}
+
+// modelConfig returns the config provider p lists for model, if any
+func (g *Gateway) modelConfig(p ModelProvider, model string) (ModelConfig, bool) {
+	for _, m := range g.config.Providers[p].Models {
+		if m.Name == model {
+			return m, true
+		}
+	}
+	return ModelConfig{}, false
+}
+
+// defaultModels are listed for providers whose config names no models
+var defaultModels = map[ModelProvider][]ModelConfig{
+	OpenAI:    {{Name: "gpt-4o"}, {Name: "gpt-4o-mini"}},
+	Anthropic: {{Name: "claude-sonnet-4-5"}},
+	Google:    {{Name: "gemini-2.0-flash"}},
+	DeepSeek:  {{Name: "deepseek-chat"}},
+	Ollama:    {{Name: "llama3.2"}},
+	Bedrock:   {{Name: "anthropic.claude-3-5-sonnet-20240620-v1:0"}, {Name: "amazon.titan-text-express-v1"}},
+}
+
+// ProviderInfo is one entry in the /api/providers listing
+type ProviderInfo struct {
+	Name    ModelProvider `json:"name"`
+	Healthy bool          `json:"healthy"`
+	Circuit string        `json:"circuit"`
+	Models  []ModelConfig `json:"models"`
+
+	// Error is why the provider failed its health check, when one was run
+	Error string `json:"error,omitempty"`
+}
+
+// providerInfo lists the configured providers and models that policy allows,
+// in name order. A provider is healthy unless its circuit breaker is open.
+func (g *Gateway) providerInfo(policy AccessPolicy) []ProviderInfo {
+	states := g.breakerStates()
+
+	infos := make([]ProviderInfo, 0, len(g.config.Providers))
+	for p, pc := range g.config.Providers {
+		if !policy.allowsProvider(p) {
+			continue
+		}
+		configured := pc.Models
+		if len(configured) == 0 {
+			configured = defaultModels[p]
+		}
+		models := make([]ModelConfig, 0, len(configured))
+		for _, m := range configured {
+			if policy.allowsModel(m.Name) {
+				models = append(models, m)
+			}
+		}
+		state := states[p]
+		infos = append(infos, ProviderInfo{
+			Name:    p,
+			Healthy: state != BreakerOpen,
+			Circuit: state.String(),
+			Models:  models,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// checkHealth runs every listed provider's HealthCheck concurrently, marking
+// those that fail as unhealthy
+func (g *Gateway) checkHealth(ctx context.Context, infos []ProviderInfo) {
+	var wg sync.WaitGroup
+	for i := range infos {
+		p, ok := g.lookupProvider(infos[i].Name)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(info *ProviderInfo, p Provider) {
+			defer wg.Done()
+			if err := p.HealthCheck(ctx); err != nil {
+				info.Healthy = false
+				info.Error = err.Error()
+			}
+		}(&infos[i], p)
+	}
+	wg.Wait()
+}
+
+// HandleProviders lists the providers and models the caller may use, for
+// clients to populate a picker. With ?check=true each provider's
+// HealthCheck is run as well, which may call out to it.
+func (g *Gateway) HandleProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	infos := g.providerInfo(g.accessPolicy(r.Context()))
+	if r.URL.Query().Get("check") == "true" {
+		g.checkHealth(r.Context(), infos)
+	}
+	g.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"providers": infos,
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// errQueueFull is returned by Wait when the key already has a full queue
+var errQueueFull = errors.New("rate limit queue is full")
+
+// RateLimiter for API rate limiting. Each key gets a token bucket holding up
+// to limit tokens that refills continuously at limit per window, so memory is
+// O(1) per key and Allow does not allocate for keys it has already seen.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	limit   int
+	window  time.Duration
+	rate    float64 // tokens per second
+	queued  int     // requests currently waiting in Wait, across all keys
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	waiting int
+}
+
+// NewRateLimiter creates a new rate limiter. It panics unless limit and
+// window are positive, as a bucket that never refills has no reset time.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	if limit <= 0 || window <= 0 {
+		panic(fmt.Sprintf("rate limiter: limit and window must be positive, got %d per %s", limit, window))
+	}
+	return &RateLimiter{
+		buckets: make(map[string]*bucket),
+		limit:   limit,
+		window:  window,
+		rate:    float64(limit) / window.Seconds(),
+	}
+}
+
+// NewRateLimiterWithSweeper creates a rate limiter that also drops idle keys
+// every sweepInterval in a background goroutine. Call Close to stop it.
+func NewRateLimiterWithSweeper(limit int, window, sweepInterval time.Duration) *RateLimiter {
+	rl := NewRateLimiter(limit, window)
+	rl.stop = make(chan struct{})
+	go rl.sweeper(sweepInterval)
+	return rl
+}
+
+// sweeper periodically removes idle keys until Close is called
+func (rl *RateLimiter) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rl.sweep(time.Now())
+		case <-rl.stop:
+			return
+		}
+	}
+}
+
+// sweep removes keys untouched for a full window. Their buckets would have
+// refilled completely, so forgetting them does not change any decision.
+func (rl *RateLimiter) sweep(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for key, b := range rl.buckets {
+		if b.waiting == 0 && now.Sub(b.last) >= rl.window {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Close stops the sweeper goroutine, if one was started. It is safe to call
+// more than once.
+func (rl *RateLimiter) Close() error {
+	rl.closeOnce.Do(func() {
+		if rl.stop != nil {
+			close(rl.stop)
+		}
+	})
+	return nil
+}
+
+// Allow checks if request is allowed
+func (rl *RateLimiter) Allow(key string) bool {
+	allowed, _, _ := rl.AllowWithInfo(key)
+	return allowed
+}
+
+// AllowWithInfo checks if request is allowed and also reports how many
+// requests remain for the key and when the next one frees up, which is the
+// moment the oldest counted request stops counting against the limit
+func (rl *RateLimiter) AllowWithInfo(key string) (bool, int, time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b := rl.refill(key, now)
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	// Tokens reserved by Wait can take the bucket below zero
+	remaining := max(int(math.Floor(b.tokens)), 0)
+	reset := now
+	if b.tokens < float64(rl.limit) {
+		missing := float64(remaining+1) - b.tokens
+		reset = now.Add(time.Duration(missing / rl.rate * float64(time.Second)))
+	}
+	return allowed, remaining, reset
+}
+
+// Wait takes a token for key, queueing behind at most maxQueue other waiting
+// requests for the same key when none is free. Each waiter reserves the next
+// token as it joins, so the queue drains in arrival order as the bucket
+// refills. It returns errQueueFull without waiting when the queue is full,
+// and ctx's error if ctx ends first, handing the reserved token back.
+func (rl *RateLimiter) Wait(ctx context.Context, key string, maxQueue int) error {
+	rl.mu.Lock()
+	b := rl.refill(key, time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		rl.mu.Unlock()
+		return nil
+	}
+	if b.waiting >= maxQueue {
+		rl.mu.Unlock()
+		return errQueueFull
+	}
+	delay := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	b.tokens--
+	b.waiting++
+	rl.queued++
+	rl.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b.waiting--
+	rl.queued--
+	if err != nil {
+		b.tokens = math.Min(b.tokens+1, float64(rl.limit))
+	}
+	return err
+}
+
+// Queued returns the number of requests currently waiting in Wait
+func (rl *RateLimiter) Queued() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.queued
+}
+
+// Limit returns the number of requests allowed per window
+func (rl *RateLimiter) Limit() int {
+	return rl.limit
+}
+
+// refill tops up the key's bucket for the time elapsed since it was last
+// touched; the caller must hold rl.mu
+func (rl *RateLimiter) refill(key string, now time.Time) *bucket {
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(rl.limit), last: now}
+		rl.buckets[key] = b
+		return b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > float64(rl.limit) {
+		b.tokens = float64(rl.limit)
+	}
+	b.last = now
+	return b
+}
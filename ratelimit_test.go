@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Tokens reserved by queued waiters must not show as negative remaining
+// requests, and the reset must wait for them to be served
+func TestAllowWithInfoAfterReservations(t *testing.T) {
+	rl := NewRateLimiter(1, time.Minute)
+	if err := rl.Wait(context.Background(), "k", 2); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		go rl.Wait(ctx, "k", 2)
+	}
+	for {
+		rl.mu.Lock()
+		waiting := rl.buckets["k"].waiting
+		rl.mu.Unlock()
+		if waiting == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	allowed, remaining, reset := rl.AllowWithInfo("k")
+	if allowed {
+		t.Error("allowed while waiters hold the next tokens")
+	}
+	if remaining != 0 {
+		t.Errorf("remaining = %d, want 0", remaining)
+	}
+	if d := time.Until(reset); d < 2*time.Minute {
+		t.Errorf("reset in %s, want after both waiters are served", d)
+	}
+}
+
+func TestNewRateLimiterRejectsZeroLimit(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for a zero limit")
+		}
+	}()
+	NewRateLimiter(0, time.Minute)
+}
+
+func TestLoadConfigRejectsZeroRateLimit(t *testing.T) {
+	t.Setenv("GATEWAY_RATE_LIMIT", "0")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("LoadConfig accepted a zero rate limit")
+	}
+}
+
+// A hot key runs Allow over and over on one bucket, which must not allocate
+func BenchmarkRateLimiterAllowHotKey(b *testing.B) {
+	rl := NewRateLimiter(1_000_000_000, time.Second)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rl.Allow("hot")
+	}
+}
+
+// Idle keys are dropped once a full window has passed, so the map doesn't
+// grow with every client ever seen
+func TestRateLimiterSweeperDropsIdleKeys(t *testing.T) {
+	const window = 200 * time.Millisecond
+	rl := NewRateLimiterWithSweeper(10, window, window)
+	defer rl.Close()
+
+	for i := 0; i < 10000; i++ {
+		rl.Allow("client-" + strconv.Itoa(i))
+	}
+	size := func() int {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return len(rl.buckets)
+	}
+	if n := size(); n < 10000 {
+		t.Fatalf("%d keys tracked right after use, want 10000", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for size() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d keys still tracked long after the window", size())
+		}
+		time.Sleep(window / 2)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisOptions configures a RedisCache
+type RedisOptions struct {
+	Addr     string
+	Password string
+	DB       int
+	PoolSize int
+	Timeout  time.Duration
+
+	// StaleFor keeps a second copy of each entry this long past its TTL,
+	// under the key with staleKeySuffix appended, for GetStale
+	StaleFor time.Duration
+
+	// MaxEntryBytes skips responses whose encoding is larger; 0 is no limit.
+	// Bound the total with Redis' own maxmemory.
+	MaxEntryBytes int
+}
+
+// staleKeySuffix marks the long-lived copies kept for GetStale. It is a
+// suffix so DeleteByPrefix removes them along with their entries.
+const staleKeySuffix = "\x00stale"
+
+// RedisCache stores responses in Redis so several gateway instances can share
+// one cache. It speaks RESP directly over a small connection pool to keep the
+// gateway free of external dependencies.
+type RedisCache struct {
+	opts RedisOptions
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// errRedisNil is returned for a nil bulk reply, i.e. a missing key
+var errRedisNil = errors.New("redis: nil")
+
+// NewRedisCache creates a Redis-backed cache. Connections are dialed lazily.
+func NewRedisCache(opts RedisOptions) *RedisCache {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	return &RedisCache{
+		opts: opts,
+		pool: make(chan *redisConn, opts.PoolSize),
+	}
+}
+
+// Get retrieves from Redis. Any error, including a corrupt entry, is a miss.
+func (c *RedisCache) Get(key string) (LLMResponse, bool) {
+	return c.getEntry(key)
+}
+
+// GetStale retrieves the copy of an entry kept for StaleFor past its TTL
+func (c *RedisCache) GetStale(key string) (LLMResponse, bool) {
+	if c.opts.StaleFor <= 0 {
+		return LLMResponse{}, false
+	}
+	return c.getEntry(key + staleKeySuffix)
+}
+
+func (c *RedisCache) getEntry(key string) (LLMResponse, bool) {
+	reply, err := c.do("GET", key)
+	if err != nil {
+		if err != errRedisNil {
+			slog.Error("redis cache get", "err", err)
+		}
+		return LLMResponse{}, false
+	}
+
+	data, ok := reply.([]byte)
+	if !ok {
+		return LLMResponse{}, false
+	}
+
+	var response LLMResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		slog.Error("redis cache get: decoding entry", "key", key, "err", err)
+		return LLMResponse{}, false
+	}
+	return response, true
+}
+
+// Set stores in Redis with the TTL mapped to EX (rounded up to a whole second)
+func (c *RedisCache) Set(key string, response LLMResponse, ttl time.Duration) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("redis cache set: encoding entry", "key", key, "err", err)
+		return
+	}
+	if c.opts.MaxEntryBytes > 0 && len(data) > c.opts.MaxEntryBytes {
+		slog.Debug("response too large to cache", "key", key, "bytes", len(data))
+		return
+	}
+
+	if _, err := c.do("SET", key, string(data), "EX", redisSeconds(ttl)); err != nil {
+		slog.Error("redis cache set", "err", err)
+	}
+	if c.opts.StaleFor > 0 {
+		if _, err := c.do("SET", key+staleKeySuffix, string(data), "EX", redisSeconds(ttl+c.opts.StaleFor)); err != nil {
+			slog.Error("redis cache set", "err", err)
+		}
+	}
+}
+
+// redisSeconds formats d for EX, rounded up to a whole second
+func redisSeconds(d time.Duration) string {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// Len reports the number of keys in the configured database, which counts
+// the stale copies too when StaleFor is set
+func (c *RedisCache) Len() int {
+	reply, err := c.do("DBSIZE")
+	if err != nil {
+		slog.Error("redis cache len", "err", err)
+		return 0
+	}
+	n, _ := reply.(int64)
+	return int(n)
+}
+
+// Clear flushes the configured database, so give the cache a DB of its own
+func (c *RedisCache) Clear() {
+	if _, err := c.do("FLUSHDB"); err != nil {
+		slog.Error("redis cache clear", "err", err)
+	}
+}
+
+// DeleteByPrefix walks the keyspace with SCAN and deletes matching keys a
+// batch at a time, so it never blocks Redis the way KEYS would
+func (c *RedisCache) DeleteByPrefix(prefix string) int {
+	pattern := redisGlobEscaper.Replace(prefix) + "*"
+	removed := 0
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", pattern, "COUNT", "500")
+		if err != nil {
+			slog.Error("redis cache delete", "err", err)
+			return removed
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			slog.Error("redis cache delete: unexpected SCAN reply")
+			return removed
+		}
+		next, _ := parts[0].([]byte)
+		keys, _ := parts[1].([]interface{})
+
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if b, ok := key.([]byte); ok {
+					args = append(args, string(b))
+				}
+			}
+			reply, err := c.do(args...)
+			if err != nil {
+				slog.Error("redis cache delete", "err", err)
+				return removed
+			}
+			n, _ := reply.(int64)
+			removed += int(n)
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return removed
+		}
+	}
+}
+
+// redisGlobEscaper quotes the characters SCAN MATCH treats as wildcards
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Close closes all pooled connections
+func (c *RedisCache) Close() error {
+	for {
+		select {
+		case rc := <-c.pool:
+			rc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do runs a single command on a pooled connection
+func (c *RedisCache) do(args ...string) (interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := rc.do(c.opts.Timeout, args...)
+	if err != nil && err != errRedisNil {
+		// The connection state is unknown after an I/O or protocol error
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			rc.conn.Close()
+			return nil, err
+		}
+	}
+	c.put(rc)
+	return reply, err
+}
+
+// get takes a connection from the pool or dials a new one
+func (c *RedisCache) get() (*redisConn, error) {
+	select {
+	case rc := <-c.pool:
+		return rc, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", c.opts.Addr, c.opts.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("redis: dial %s: %w", c.opts.Addr, err)
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if c.opts.Password != "" {
+		if _, err := rc.do(c.opts.Timeout, "AUTH", c.opts.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err := rc.do(c.opts.Timeout, "SELECT", strconv.Itoa(c.opts.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// put returns a healthy connection to the pool, closing it if the pool is full
+func (c *RedisCache) put(rc *redisConn) {
+	select {
+	case c.pool <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do writes a command as a RESP array of bulk strings and reads the reply
+func (rc *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(timeout))
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := rc.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return rc.readReply()
+}
+
+// readReply parses one RESP reply: simple strings and bulk strings become
+// []byte, integers int64, arrays []interface{}, and nil bulk replies errRedisNil
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return []byte(payload), nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := rc.readReply()
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how transient upstream failures are retried
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts per provider, including the first
+	BaseDelay   time.Duration // delay before the first retry, doubled each time
+	MaxDelay    time.Duration // upper bound on any single delay
+
+	// MaxRetryAfter is the longest Retry-After on a 429 that is waited out
+	// before retrying the same provider. A longer one, or one that would
+	// outlast the call's deadline, fails over to the next provider instead.
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryPolicy is used by NewGateway
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+
+	MaxRetryAfter: 10 * time.Second,
+}
+
+// permanentError marks a failure that must not be retried even if the
+// underlying error looks transient
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// backoff returns the jittered delay before the given retry (1-based). The
+// delay is drawn uniformly from the upper half of the exponential step.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay << (retry - 1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// rateLimited reports whether err is a 429 from the provider and how long it
+// asked to be left alone; zero when it gave no Retry-After
+func rateLimited(err error) (time.Duration, bool) {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) && upstream.StatusCode == http.StatusTooManyRequests {
+		return upstream.RetryAfter, true
+	}
+	return 0, false
+}
+
+// parseRetryAfter reads a Retry-After header, given either in seconds or as
+// an HTTP date. It returns zero when the header is missing, malformed or
+// already in the past.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// isRetryable reports whether err is a timeout or 5xx from the provider.
+// Client errors (4xx) and failures caused by the caller's own context are not.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var perm permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return upstream.StatusCode >= http.StatusInternalServerError
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// withRetry runs call until it succeeds, fails with a non-retryable error, or
+// the policy's attempts are used up. It never sleeps past the ctx deadline.
+//
+// A 429 is only retried when the provider says when to come back and that is
+// soon enough; hammering a rate-limited provider just extends the limit, so
+// otherwise the error is returned at once and the caller fails over.
+func (g *Gateway) withRetry(ctx context.Context, provider ModelProvider, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil {
+			return nil
+		}
+
+		retryAfter, limited := rateLimited(err)
+		if limited {
+			g.metrics.RecordRateLimitedForProvider(provider)
+		}
+		var perm permanentError
+		if attempt >= g.Retry.MaxAttempts || ctx.Err() != nil || errors.As(err, &perm) {
+			return err
+		}
+
+		var delay time.Duration
+		switch {
+		case limited:
+			if retryAfter <= 0 || retryAfter > g.Retry.MaxRetryAfter {
+				return err
+			}
+			delay = retryAfter
+		case isRetryable(ctx, err):
+			delay = g.Retry.backoff(attempt)
+		default:
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		slog.Info("provider attempt failed, retrying", "provider", provider, "attempt", attempt, "delay", delay, "err", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
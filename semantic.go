@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// defaultSemanticThreshold is the cosine similarity above which two prompts
+// are treated as the same question
+const defaultSemanticThreshold = 0.95
+
+// mockEmbeddingDims is the size of the vectors made up by the mock provider
+const mockEmbeddingDims = 256
+
+// SemanticCacheConfig enables matching paraphrased prompts against cached
+// ones. On an exact cache miss the prompt is embedded with Provider and the
+// response for the most similar cached prompt is served when its cosine
+// similarity reaches Threshold. Only the last user message is compared; the
+// rest of the request must match exactly.
+type SemanticCacheConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Provider computes the embeddings: openai, azure, ollama or mock.
+	// For azure, Model is the embedding deployment.
+	Provider ModelProvider `json:"provider"`
+	Model    string        `json:"model,omitempty"`
+
+	// Threshold defaults to defaultSemanticThreshold
+	Threshold float64 `json:"threshold,omitempty"`
+
+	// MaxEntries bounds the prompts kept for comparison; it defaults to the
+	// cache size
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+// semanticIndex holds prompt embeddings and the cache keys of their
+// responses. Lookups scan every entry, which stays cheap at cache sizes; the
+// oldest entry is replaced once the index is full.
+type semanticIndex struct {
+	mu        sync.RWMutex
+	entries   []semanticEntry
+	next      int
+	max       int
+	threshold float64
+}
+
+type semanticEntry struct {
+	scope string    // the request minus its prompt, see semanticScope
+	key   string    // exact cache key of the response
+	vec   []float32 // unit length
+}
+
+func newSemanticIndex(max int, threshold float64) *semanticIndex {
+	if threshold <= 0 {
+		threshold = defaultSemanticThreshold
+	}
+	return &semanticIndex{max: max, threshold: threshold}
+}
+
+// add records the embedding of a cached prompt
+func (ix *semanticIndex) add(scope, key string, vec []float32) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.max <= 0 {
+		return
+	}
+	e := semanticEntry{scope: scope, key: key, vec: vec}
+	if len(ix.entries) < ix.max {
+		ix.entries = append(ix.entries, e)
+		return
+	}
+	ix.entries[ix.next] = e
+	ix.next = (ix.next + 1) % ix.max
+}
+
+// nearest returns the cache key of the most similar prompt in scope, if it
+// reaches the threshold
+func (ix *semanticIndex) nearest(scope string, vec []float32) (string, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	best, bestKey := ix.threshold, ""
+	for _, e := range ix.entries {
+		if e.scope != scope || len(e.vec) != len(vec) {
+			continue
+		}
+		if sim := dot(e.vec, vec); sim >= best {
+			best, bestKey = sim, e.key
+		}
+	}
+	return bestKey, bestKey != ""
+}
+
+// semanticScope identifies everything about a request except its last user
+// message, so only prompts asked in the same context are compared
+func semanticScope(req LLMRequest, norm KeyNormalization, version string) string {
+	msgs := append([]Message(nil), req.conversation()...)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			msgs[i].Content = ""
+			break
+		}
+	}
+	req.Messages, req.Prompt, req.system = msgs, "", ""
+	return cacheKeyFor(req, norm, version)
+}
+
+// semanticLookup embeds the request's prompt and looks for a cached response
+// to a similar one. The embedding is returned for semanticStore even on a
+// miss; it is nil when the semantic cache is off or embedding failed, in
+// which case only exact matching applies.
+func (g *Gateway) semanticLookup(ctx context.Context, req LLMRequest) (LLMResponse, []float32, bool) {
+	if g.semantic == nil {
+		return LLMResponse{}, nil, false
+	}
+	vec, err := g.embed(ctx, req.lastUserMessage())
+	if err != nil {
+		slog.Warn("semantic cache: embedding failed, using exact matching", "err", err)
+		return LLMResponse{}, nil, false
+	}
+
+	scope := semanticScope(req, g.config.CacheKeys, g.config.CacheVersion)
+	key, ok := g.semantic.nearest(scope, vec)
+	if !ok {
+		return LLMResponse{}, vec, false
+	}
+	// The entry may have expired or been evicted since it was indexed
+	cached, found := g.responseCache().Get(key)
+	return cached, vec, found
+}
+
+// semanticStore indexes the prompt of a response just cached under key
+func (g *Gateway) semanticStore(req LLMRequest, key string, vec []float32) {
+	if g.semantic == nil || vec == nil {
+		return
+	}
+	g.semantic.add(semanticScope(req, g.config.CacheKeys, g.config.CacheVersion), key, vec)
+}
+
+// embed returns the unit-length embedding of text from the configured
+// embedding provider
+func (g *Gateway) embed(ctx context.Context, text string) ([]float32, error) {
+	sc := g.config.SemanticCache
+	result, err := g.createEmbeddings(ctx, sc.Provider, sc.Model, []string{g.config.CacheKeys.apply(text)})
+	if err != nil {
+		return nil, err
+	}
+	vec := result.Vectors[0]
+	if !normalize(vec) {
+		return nil, fmt.Errorf("%s returned an empty embedding", sc.Provider)
+	}
+	return vec, nil
+}
+
+// mockEmbedding hashes each word of text into a fixed number of dimensions,
+// so prompts sharing most of their words come out similar. It needs no
+// upstream and is meant for tests and demos.
+func mockEmbedding(text string) []float32 {
+	vec := make([]float32, mockEmbeddingDims)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		vec[h.Sum32()%mockEmbeddingDims]++
+	}
+	return vec
+}
+
+// normalize scales vec to unit length in place, reporting false for an
+// empty or all-zero vector
+func normalize(vec []float32) bool {
+	var sum float64
+	for _, v := range vec {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return false
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range vec {
+		vec[i] /= norm
+	}
+	return true
+}
+
+// dot returns the dot product of two vectors of equal length, which for unit
+// vectors is their cosine similarity
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
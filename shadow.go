@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// ShadowConfig mirrors a sample of requests to a second provider to compare
+// its answers with the ones clients get. Shadow calls run in the
+// background after the client's response is ready, so they never change it
+// or add to its latency, and each one is logged as a "shadow comparison"
+// with both latencies, token counts and costs and how similar the answers
+// were.
+//
+// Only fresh, non-streamed answers are mirrored. Shadow calls skip the
+// cache, retries and circuit breakers, and their cost is kept apart from
+// the API keys' spend. MaxConcurrent and MonthlyBudget bound what they can
+// use; when either is reached requests are not mirrored.
+type ShadowConfig struct {
+	Provider ModelProvider `json:"provider"`
+	// Model defaults to the request's model
+	Model string `json:"model,omitempty"`
+
+	// SampleRate is the fraction of requests mirrored, from 0 to 1
+	SampleRate float64 `json:"sample_rate"`
+
+	// MaxConcurrent caps the shadow calls running at once; 4 when zero
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// MonthlyBudget caps the estimated spend on shadow calls in USD; zero
+	// is no limit
+	MonthlyBudget float64 `json:"monthly_budget,omitempty"`
+	// Timeout bounds each shadow call; the provider's timeout when zero
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// Diff adds the lines that differ between the two answers to the log.
+	// The log then holds response text, so only turn it on where that's
+	// acceptable.
+	Diff bool `json:"diff,omitempty"`
+}
+
+// defaultShadowConcurrency is used when MaxConcurrent isn't set
+const defaultShadowConcurrency = 4
+
+// maxShadowDiffLines bounds the lines of each answer that are diffed, and
+// maxShadowDiffBytes the diff that is logged
+const (
+	maxShadowDiffLines = 200
+	maxShadowDiffBytes = 4096
+)
+
+// enabled reports whether any requests are mirrored
+func (c ShadowConfig) enabled() bool {
+	return c.Provider != "" && c.SampleRate > 0
+}
+
+// validate checks the shadow settings from the config
+func (c ShadowConfig) validate() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return errors.New("shadow: sample_rate must be between 0 and 1")
+	}
+	if c.SampleRate > 0 && c.Provider == "" {
+		return errors.New("shadow: provider must be set")
+	}
+	if c.MaxConcurrent < 0 || c.MonthlyBudget < 0 {
+		return errors.New("shadow: max_concurrent and monthly_budget can't be negative")
+	}
+	return nil
+}
+
+// shadow mirrors req to the shadow provider in the background, when it is
+// sampled and within the shadow limits, to compare with response
+func (g *Gateway) shadow(ctx context.Context, req LLMRequest, response LLMResponse) {
+	cfg := g.config.Shadow
+	if !cfg.enabled() || g.shadowSlots == nil || rand.Float64() >= cfg.SampleRate {
+		return
+	}
+
+	attempt := req
+	attempt.Provider = cfg.Provider
+	if cfg.Model != "" {
+		attempt.Model = cfg.Model
+	}
+	if attempt.Provider == response.Provider && attempt.Model == response.Model {
+		return
+	}
+	if attempt.usesTools() && !supportsTools(attempt.Provider) {
+		return
+	}
+	if cfg.MonthlyBudget > 0 && g.shadowSpend.Spend("") >= cfg.MonthlyBudget {
+		g.metrics.RecordShadowSkipped()
+		return
+	}
+	select {
+	case g.shadowSlots <- struct{}{}:
+	default:
+		g.metrics.RecordShadowSkipped()
+		return
+	}
+
+	// Keep the request ID and trace, but not the client's cancellation
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer func() { <-g.shadowSlots }()
+		g.shadowCall(ctx, attempt, response)
+	}()
+}
+
+// shadowCall makes a shadow call and logs how it compares with response
+func (g *Gateway) shadowCall(ctx context.Context, req LLMRequest, response LLMResponse) {
+	timeout := time.Duration(g.config.Shadow.Timeout)
+	if timeout <= 0 {
+		timeout = g.providerTimeout(req.Provider)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	shadow, err := g.callProvider(ctx, req)
+	elapsed := time.Since(start)
+	g.metrics.RecordShadowRequest()
+	if err != nil {
+		g.metrics.RecordShadowError()
+		slog.Warn("shadow call failed", "request_id", RequestIDFrom(ctx), "provider", req.Provider,
+			"model", req.Model, "err", err)
+		return
+	}
+	g.estimateUsage(req, &shadow)
+	cost := g.estimateCost(shadow)
+	g.shadowSpend.Add("", cost)
+
+	attrs := []any{
+		"request_id", RequestIDFrom(ctx),
+		"provider", response.Provider,
+		"model", response.Model,
+		"shadow_provider", req.Provider,
+		"shadow_model", shadow.Model,
+		"latency_ms", response.ResponseTime,
+		"shadow_latency_ms", elapsed.Milliseconds(),
+		"tokens", response.TokensUsed,
+		"shadow_tokens", shadow.TokensUsed,
+		"cost_usd", response.EstimatedCost,
+		"shadow_cost_usd", cost,
+		"identical", strings.TrimSpace(response.Response) == strings.TrimSpace(shadow.Response),
+		"similarity", wordSimilarity(response.Response, shadow.Response),
+	}
+	if g.config.Shadow.Diff {
+		attrs = append(attrs, "diff", lineDiff(response.Response, shadow.Response))
+	}
+	slog.Info("shadow comparison", attrs...)
+}
+
+// wordSimilarity is the Jaccard similarity of the sets of lowercased words
+// in a and b, rounded to two places: 1 for the same words, 0 for none in
+// common
+func wordSimilarity(a, b string) float64 {
+	words := func(s string) map[string]bool {
+		set := make(map[string]bool)
+		for _, w := range strings.Fields(strings.ToLower(s)) {
+			set[w] = true
+		}
+		return set
+	}
+	wa, wb := words(a), words(b)
+	if len(wa) == 0 && len(wb) == 0 {
+		return 1
+	}
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	return math.Round(float64(common)/float64(len(wa)+len(wb)-common)*100) / 100
+}
+
+// lineDiff lists the lines only in a, prefixed "- ", and only in b, prefixed
+// "+ ", in order, from a longest common subsequence of their lines. Long
+// answers are cut to maxShadowDiffLines lines and the diff to
+// maxShadowDiffBytes.
+func lineDiff(a, b string) string {
+	la, lb := strings.Split(a, "\n"), strings.Split(b, "\n")
+	if len(la) > maxShadowDiffLines {
+		la = la[:maxShadowDiffLines]
+	}
+	if len(lb) > maxShadowDiffLines {
+		lb = lb[:maxShadowDiffLines]
+	}
+
+	// lcs[i][j] is the common subsequence length of la[i:] and lb[j:]
+	lcs := make([][]int, len(la)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(lb)+1)
+	}
+	for i := len(la) - 1; i >= 0; i-- {
+		for j := len(lb) - 1; j >= 0; j-- {
+			if la[i] == lb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for (i < len(la) || j < len(lb)) && diff.Len() < maxShadowDiffBytes {
+		switch {
+		case i < len(la) && j < len(lb) && la[i] == lb[j]:
+			i, j = i+1, j+1
+		case i < len(la) && (j == len(lb) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff.WriteString("- " + la[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+ " + lb[j] + "\n")
+			j++
+		}
+	}
+	if diff.Len() > maxShadowDiffBytes {
+		return diff.String()[:maxShadowDiffBytes]
+	}
+	return diff.String()
+}
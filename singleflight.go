@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls for the same key so that only one
+// upstream request is made and every caller shares its result, protecting
+// providers from a stampede when a popular prompt misses the cache
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done     chan struct{}
+	response LLMResponse
+	err      error
+}
+
+// Do runs fn once per key at a time. Callers arriving while fn is running wait
+// for its result instead, unless their own ctx is cancelled first. shared
+// reports whether the result came from another caller's call.
+func (fg *flightGroup) Do(ctx context.Context, key string, fn func() (LLMResponse, error)) (response LLMResponse, err error, shared bool) {
+	fg.mu.Lock()
+	if fg.calls == nil {
+		fg.calls = make(map[string]*flightCall)
+	}
+	if call, exists := fg.calls[key]; exists {
+		fg.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.response, call.err, true
+		case <-ctx.Done():
+			return LLMResponse{}, ctx.Err(), true
+		}
+	}
+
+	call := &flightCall{done: make(chan struct{})}
+	fg.calls[key] = call
+	fg.mu.Unlock()
+
+	call.response, call.err = fn()
+
+	fg.mu.Lock()
+	delete(fg.calls, key)
+	fg.mu.Unlock()
+	close(call.done)
+
+	return call.response, call.err, false
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// staleResponse looks for an expired answer to serve in place of err, the
+// failure of every provider for req. It only applies when StaleIfError is
+// set, and not to requests that asked to bypass the cache, to clients that
+// went away or to answers the output filter blocked.
+func (g *Gateway) staleResponse(ctx context.Context, req LLMRequest, cacheKey string, err error) (LLMResponse, bool) {
+	if g.config.StaleIfError <= 0 || req.NoCache || clientGone(ctx) {
+		return LLMResponse{}, false
+	}
+	var blocked *OutputBlockedError
+	if errors.As(err, &blocked) {
+		return LLMResponse{}, false
+	}
+	cache, ok := g.responseCache().(StaleCache)
+	if !ok {
+		return LLMResponse{}, false
+	}
+	response, found := cache.GetStale(cacheKey)
+	if !found {
+		return LLMResponse{}, false
+	}
+
+	slog.Warn("serving stale cached response", "provider", req.Provider, "model", req.Model, "err", err)
+	g.metrics.RecordStaleServe()
+	response.Cached = true
+	response.Stale = true
+	return response, true
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamChunk is a partial response delivered as a server-sent event
+type StreamChunk struct {
+	Delta string `json:"delta"`
+}
+
+// openAIStreamChunk is a single chat.completion.chunk from the OpenAI stream
+type openAIStreamChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+// writeEvent writes v as a server-sent event, optionally with a named event type
+func writeEvent(w io.Writer, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+// streamFormat encodes the events of a stream for a particular API flavour
+type streamFormat interface {
+	writeDelta(w io.Writer, delta string) error
+	writeDone(w io.Writer, response LLMResponse) error
+	writeError(w io.Writer, err error) error
+}
+
+// gatewayStream is the native /api/llm format: deltas are sent as StreamChunk
+// events and the final LLMResponse as a "done" event
+type gatewayStream struct{}
+
+func (gatewayStream) writeDelta(w io.Writer, delta string) error {
+	return writeEvent(w, "", StreamChunk{Delta: delta})
+}
+
+func (gatewayStream) writeDone(w io.Writer, response LLMResponse) error {
+	return writeEvent(w, "done", response)
+}
+
+// writeError reports a failure after the stream has started as an
+// ErrorResponse, like errors sent before it
+func (gatewayStream) writeError(w io.Writer, err error) error {
+	code := CodeProviderError
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = CodeTimeout
+	}
+	return writeEvent(w, "error", ErrorResponse{Code: code, Message: err.Error()})
+}
+
+// handleStream serves a request as server-sent events, flushing each delta as
+// it arrives unless output moderation needs the whole text first. The
+// concatenated text is cached once the stream completes.
+func (g *Gateway) handleStream(w http.ResponseWriter, r *http.Request, req LLMRequest, format streamFormat) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		g.writeError(w, r, http.StatusInternalServerError, CodeInternal, "Streaming not supported")
+		g.metrics.RecordError()
+		return
+	}
+
+	// Let the client stop the stream early by its request ID
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	if id := RequestIDFrom(ctx); id != "" && g.streams.add(id, APIKeyLabel(ctx), cancel) {
+		defer g.streams.remove(id)
+	}
+	r = r.WithContext(ctx)
+
+	startStream := func() {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// Cache hits are replayed as a single chunk
+	cacheKey := cacheKeyFor(req, g.config.CacheKeys, g.config.CacheVersion)
+	ttl, cacheable := g.cacheTTL(req)
+	var embedding []float32
+	if cacheable && !req.NoCache {
+		cached, found := g.responseCache().Get(cacheKey)
+		if !found {
+			if cached, embedding, found = g.semanticLookup(r.Context(), req); found {
+				g.metrics.RecordSemanticHit()
+			}
+		}
+		if found {
+			g.metrics.RecordCacheHit()
+			cached.Cached = true
+			SpanFrom(r.Context()).SetAttr("gateway.cache_hit", true)
+			g.audit.Log(r.Context(), req, cached, nil)
+			startStream()
+			g.endStream(w, r, format, cached.Response, cached)
+			return
+		}
+	}
+
+	g.metrics.RecordCacheMiss()
+
+	// The output filter has to see the whole text before any of it is sent,
+	// so the response is held back and sent as a single chunk
+	buffered := g.outputFilter != nil
+	started := false
+	startTime := time.Now()
+	var firstToken time.Duration
+	var partial strings.Builder
+	response, err := g.streamLLMRequest(r.Context(), req, func(delta string) error {
+		partial.WriteString(delta)
+		if buffered {
+			return nil
+		}
+		if !started {
+			firstToken = time.Since(startTime)
+			startStream()
+			started = true
+		}
+		if err := format.writeDelta(w, delta); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	elapsed := time.Since(startTime)
+	responseTime := elapsed.Milliseconds()
+	if err == nil {
+		err = g.filterOutput(r.Context(), &response)
+	}
+
+	if err != nil && !started && cacheable {
+		if stale, ok := g.staleResponse(r.Context(), req, cacheKey, err); ok {
+			g.audit.Log(r.Context(), req, stale, nil)
+			w.Header().Set("X-Cache-Stale", "true")
+			startStream()
+			g.endStream(w, r, format, stale.Response, stale)
+			return
+		}
+	}
+
+	if err != nil && errors.Is(context.Cause(ctx), errStreamStopped) {
+		response = LLMResponse{
+			Provider:     req.Provider,
+			Model:        req.Model,
+			Response:     partial.String(),
+			ResponseTime: float64(responseTime),
+			Stopped:      true,
+		}
+		g.estimateUsage(req, &response)
+		response.EstimatedCost = g.estimateCost(response)
+		// The request context is cancelled, but the filter still has to run
+		err = g.filterOutput(context.WithoutCancel(ctx), &response)
+	}
+	if err == nil && response.Stopped {
+		g.audit.Log(r.Context(), req, response, nil)
+		g.recordSpend(r.Context(), response)
+		g.metrics.RecordStreamStopped()
+		var text string
+		if !started {
+			startStream()
+			text = response.Response
+		}
+		g.endStream(w, r, format, text, response)
+		return
+	}
+
+	g.audit.Log(r.Context(), req, response, err)
+	if err != nil {
+		if clientGone(r.Context()) {
+			// Once the stream has started the status is already sent
+			if started {
+				g.metrics.RecordClientCancelled()
+			} else {
+				g.clientCancelled(w, r.Context())
+			}
+			return
+		}
+		g.metrics.RecordError()
+		if !started {
+			status, code := errorStatus(r.Context(), err)
+			g.writeError(w, r, status, code, err.Error())
+			return
+		}
+		// Headers are already sent, so report the failure in-band
+		if err := format.writeError(w, err); err != nil {
+			g.streamWriteFailed(r, err)
+		}
+		flusher.Flush()
+		return
+	}
+
+	response.ResponseTime = float64(responseTime)
+	response.EstimatedCost = g.estimateCost(response)
+	g.recordSpend(r.Context(), response)
+
+	if cacheable {
+		g.responseCache().Set(cacheKey, response, ttl)
+		g.semanticStore(req, cacheKey, embedding)
+	}
+
+	g.metrics.RecordRequest()
+	g.metrics.RecordRequestForProvider(response.Provider)
+	g.metrics.RecordLatency(response.Provider, elapsed)
+	var text string
+	if started {
+		g.metrics.RecordTimeToFirstToken(response.Provider, firstToken)
+	} else {
+		startStream()
+		if buffered {
+			text = response.Response
+		}
+	}
+	g.endStream(w, r, format, text, response)
+}
+
+// endStream sends the events that close a stream, text as a single delta
+// unless it is empty and then the done event, and flushes them
+func (g *Gateway) endStream(w http.ResponseWriter, r *http.Request, format streamFormat, text string, response LLMResponse) {
+	var err error
+	if text != "" {
+		err = format.writeDelta(w, text)
+	}
+	if err == nil {
+		err = format.writeDone(w, response)
+	}
+	if err != nil {
+		g.streamWriteFailed(r, err)
+	}
+	w.(http.Flusher).Flush()
+}
+
+// streamWriteFailed logs and counts an event that couldn't be written, as
+// writeJSON does for other responses
+func (g *Gateway) streamWriteFailed(r *http.Request, err error) {
+	slog.Warn("writing stream", "request_id", RequestIDFrom(r.Context()), "path", r.URL.Path, "err", err)
+	g.metrics.RecordWriteFailure()
+}
+
+// streamLLMRequest dispatches a streaming call, invoking emit for each delta.
+// Failover only happens before the first delta has been sent to the client.
+func (g *Gateway) streamLLMRequest(ctx context.Context, req LLMRequest, emit func(string) error) (LLMResponse, error) {
+	priority := g.requestPriority(ctx, req)
+	// failed is the provider lastErr came from, which is not req.Provider
+	// once a fallback has failed too
+	var lastErr error
+	var failed ModelProvider
+	for i, provider := range g.providerChain(req) {
+		if i > 0 {
+			g.metrics.RecordFailover()
+			slog.Warn("provider failed, failing over", "request_id", RequestIDFrom(ctx), "provider", failed, "fallback", provider, "err", lastErr)
+		}
+
+		attempt := req
+		attempt.Provider = provider
+		warnIgnoredParams(provider, attempt)
+		emitted := false
+		var response LLMResponse
+		err := g.guardedCall(ctx, provider, priority, func(ctx context.Context) error {
+			ctx, span := g.tracer.Start(ctx, "gateway.provider_call", spanKindClient)
+			defer span.End()
+			span.SetAttr("gen_ai.system", string(provider))
+			span.SetAttr("gen_ai.request.model", attempt.Model)
+			span.SetAttr("gateway.stream", true)
+			var err error
+			response, err = g.streamProvider(ctx, attempt, func(delta string) error {
+				emitted = true
+				return emit(delta)
+			})
+			span.SetAttr("gen_ai.usage.total_tokens", response.TokensUsed)
+			span.RecordError(err)
+			// Retrying now would replay text the client already has
+			if err != nil && emitted {
+				return permanentError{err}
+			}
+			return err
+		})
+		if err == nil {
+			g.estimateUsage(attempt, &response)
+			return response, nil
+		}
+		if clientGone(ctx) {
+			return LLMResponse{}, err
+		}
+		g.recordProviderFailure(provider, err)
+		if emitted || ctx.Err() != nil {
+			return LLMResponse{}, err
+		}
+		lastErr, failed = err, provider
+	}
+	return LLMResponse{}, lastErr
+}
+
+// streamProvider streams a request from a single provider
+func (g *Gateway) streamProvider(ctx context.Context, req LLMRequest, emit func(string) error) (LLMResponse, error) {
+	switch req.Provider {
+	case OpenAI, AzureOpenAI:
+		return g.streamOpenAI(ctx, req, emit)
+	case Ollama:
+		return g.streamOllama(ctx, req, emit)
+	}
+
+	// Simulated providers produce the full text up front and replay it word by word
+	response, err := g.callProvider(ctx, req)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+	for _, word := range strings.SplitAfter(response.Response, " ") {
+		if err := ctx.Err(); err != nil {
+			return LLMResponse{}, err
+		}
+		if err := emit(word); err != nil {
+			return LLMResponse{}, err
+		}
+	}
+	return response, nil
+}
+
+// streamOpenAI calls the OpenAI or Azure OpenAI chat completions API with
+// stream enabled
+func (g *Gateway) streamOpenAI(ctx context.Context, req LLMRequest, emit func(string) error) (LLMResponse, error) {
+	build := g.openAIRequest
+	if req.Provider == AzureOpenAI {
+		build = g.azureOpenAIRequest
+	}
+	url, headers, payload, err := build(req)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+	payload.Stream = true
+	payload.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+
+	resp, err := g.sendUpstream(ctx, req.Provider, url, headers, payload)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	response := LLMResponse{Provider: req.Provider, Model: req.Model}
+	var text strings.Builder
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return LLMResponse{}, fmt.Errorf("decoding openai stream chunk: %w", err)
+		}
+		if chunk.Model != "" {
+			response.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			response.TokensUsed = chunk.Usage.TotalTokens
+			response.PromptTokens = chunk.Usage.PromptTokens
+			response.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			text.WriteString(choice.Delta.Content)
+			if err := emit(choice.Delta.Content); err != nil {
+				return LLMResponse{}, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return LLMResponse{}, fmt.Errorf("reading openai stream: %w", err)
+	}
+
+	response.Response = text.String()
+	return response, nil
+}
+
+// errStreamStopped is the cancellation cause of a stream stopped through
+// HandleStopStream
+var errStreamStopped = errors.New("stream stopped by client")
+
+// activeStreams tracks the streams in flight by request ID so they can be
+// stopped early. The zero value is ready to use.
+type activeStreams struct {
+	mu      sync.Mutex
+	streams map[string]activeStream
+}
+
+type activeStream struct {
+	apiKey string
+	cancel context.CancelCauseFunc
+}
+
+// add registers a stream. It reports false, leaving the stream unstoppable,
+// if another stream already uses the ID.
+func (s *activeStreams) add(id, apiKey string, cancel context.CancelCauseFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.streams[id]; exists {
+		return false
+	}
+	if s.streams == nil {
+		s.streams = make(map[string]activeStream)
+	}
+	s.streams[id] = activeStream{apiKey: apiKey, cancel: cancel}
+	return true
+}
+
+func (s *activeStreams) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// stop cancels the stream with the given ID if it belongs to apiKey
+func (s *activeStreams) stop(id, apiKey string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream, ok := s.streams[id]
+	if !ok || stream.apiKey != apiKey {
+		return false
+	}
+	stream.cancel(errStreamStopped)
+	return true
+}
+
+// HandleStopStream serves POST /api/llm/stop/{requestID}, which ends a
+// stream early and halts its upstream call. The stream's client gets the
+// text so far in a final event marked stopped. Send the stream with an
+// X-Request-ID header to know its ID up front; it is also in the response
+// headers. Streams are only visible to the API key that started them.
+func (g *Gateway) HandleStopStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		g.writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	id, ok := pathParam(r, "/api/llm/stop/")
+	if !ok || !g.streams.stop(id, APIKeyLabel(r.Context())) {
+		g.writeError(w, r, http.StatusNotFound, CodeNotFound, "No active stream with that request ID")
+		return
+	}
+	g.writeJSON(w, r, http.StatusOK, map[string]string{"stopped": id})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// templateExt is the extension of template files in Config.TemplateDir; the
+// rest of the file name is the template's name
+const templateExt = ".tmpl"
+
+// TemplateStore holds the named prompt templates clients can invoke with the
+// template field instead of sending a prompt. Versions are kept side by side
+// under different names, e.g. "summarize-v2".
+type TemplateStore struct {
+	templates map[string]*template.Template
+}
+
+// LoadTemplates parses the templates in cfg.Templates and the *.tmpl files
+// in cfg.TemplateDir. A file replaces an inline template of the same name.
+func LoadTemplates(cfg Config) (*TemplateStore, error) {
+	sources := make(map[string]string, len(cfg.Templates))
+	for name, text := range cfg.Templates {
+		sources[name] = text
+	}
+	if cfg.TemplateDir != "" {
+		paths, err := filepath.Glob(filepath.Join(cfg.TemplateDir, "*"+templateExt))
+		if err != nil {
+			return nil, fmt.Errorf("listing templates: %w", err)
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading template: %w", err)
+			}
+			sources[strings.TrimSuffix(filepath.Base(path), templateExt)] = string(data)
+		}
+	}
+
+	s := &TemplateStore{templates: make(map[string]*template.Template, len(sources))}
+	for name, text := range sources {
+		// A variable the client leaves out is an error rather than "<no value>"
+		t, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template %s: %w", name, err)
+		}
+		s.templates[name] = t
+	}
+	return s, nil
+}
+
+// missingKey pulls the variable name out of text/template's error for a
+// missing map key
+var missingKey = regexp.MustCompile(`map has no entry for key "([^"]*)"`)
+
+// Render executes the named template with vars
+func (s *TemplateStore) Render(name string, vars map[string]interface{}) (string, error) {
+	var t *template.Template
+	if s != nil {
+		t = s.templates[name]
+	}
+	if t == nil {
+		return "", fmt.Errorf("unknown template %q", name)
+	}
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, vars); err != nil {
+		var execErr template.ExecError
+		if errors.As(err, &execErr) {
+			if m := missingKey.FindStringSubmatch(execErr.Error()); m != nil {
+				return "", fmt.Errorf("missing variable %q", m[1])
+			}
+		}
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// renderTemplate replaces a request's template and variables with the
+// rendered prompt. It runs before validation, so the prompt is checked like
+// any other.
+func (g *Gateway) renderTemplate(req *LLMRequest) *ValidationError {
+	if req.Template == "" {
+		if len(req.Variables) > 0 {
+			return &ValidationError{Field: "variables", Message: "require a template"}
+		}
+		return nil
+	}
+	if req.Prompt != "" || len(req.Messages) > 0 {
+		return &ValidationError{Field: "template", Message: "cannot be combined with prompt or messages"}
+	}
+
+	prompt, err := g.templates.Render(req.Template, req.Variables)
+	if err != nil {
+		return &ValidationError{Field: "template", Message: err.Error()}
+	}
+	req.Prompt = prompt
+	req.Template, req.Variables = "", nil
+	return nil
+}
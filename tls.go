@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig serves the public port over HTTPS, either with a certificate and
+// key from disk or with certificates obtained from Let's Encrypt for
+// AutocertHosts. The admin port, when set, stays plain HTTP since it is meant
+// to be reachable only internally.
+//
+// RedirectPort, e.g. ":80", starts a plain HTTP listener that redirects
+// everything to HTTPS. In autocert mode it also answers the ACME HTTP-01
+// challenges; without it certificates are obtained over TLS-ALPN-01 on the
+// public port, which must then be 443.
+type TLSConfig struct {
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	AutocertHosts []string `json:"autocert_hosts,omitempty"`
+	// AutocertEmail is given to Let's Encrypt for expiry notices
+	AutocertEmail string `json:"autocert_email,omitempty"`
+	// AutocertCacheDir keeps issued certificates across restarts, so they
+	// aren't requested again each time; "autocert" when empty
+	AutocertCacheDir string `json:"autocert_cache_dir,omitempty"`
+
+	RedirectPort string `json:"redirect_port,omitempty"`
+}
+
+// enabled reports whether the public port is served over HTTPS
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || len(c.AutocertHosts) > 0
+}
+
+// validate checks the TLS settings from the config
+func (c TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("tls: cert_file and key_file must be set together")
+	}
+	if c.CertFile != "" && len(c.AutocertHosts) > 0 {
+		return errors.New("tls: use either cert_file and key_file or autocert_hosts, not both")
+	}
+	if c.RedirectPort != "" && !c.enabled() {
+		return errors.New("tls: redirect_port needs a certificate or autocert_hosts")
+	}
+	return nil
+}
+
+// setupTLS prepares server to be served with ServeTLS and returns the handler
+// for the redirect listener
+func (c TLSConfig) setupTLS(server *http.Server) http.Handler {
+	redirect := redirectHTTPS(server.Addr)
+	if len(c.AutocertHosts) == 0 {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		return redirect
+	}
+
+	dir := c.AutocertCacheDir
+	if dir == "" {
+		dir = "autocert"
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.AutocertHosts...),
+		Cache:      autocert.DirCache(dir),
+		Email:      c.AutocertEmail,
+	}
+	server.TLSConfig = m.TLSConfig()
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+	return m.HTTPHandler(redirect)
+}
+
+// redirectHTTPS sends every request to the same URL over HTTPS on the port
+// of addr
+func redirectHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bpeEncoding is a loaded byte-pair encoding: the rank of every token, where
+// a lower rank means the pair was merged earlier in training
+type bpeEncoding struct {
+	ranks map[string]int
+}
+
+// tokenizer counts tokens with the BPE rank files in dir, named after their
+// encoding, e.g. cl100k_base.tiktoken, in the format OpenAI publishes them.
+// Each gateway has its own, built from Config.TokenizerDir. With no dir,
+// or for models whose encoding isn't found there, counts are estimated.
+type tokenizer struct {
+	dir string
+
+	// loaded caches encodings, including failures, by name
+	mu     sync.Mutex
+	loaded map[string]*encodingEntry
+}
+
+func newTokenizer(dir string) *tokenizer {
+	return &tokenizer{dir: dir, loaded: make(map[string]*encodingEntry)}
+}
+
+type encodingEntry struct {
+	once sync.Once
+	enc  *bpeEncoding
+	err  error
+}
+
+// encodingForModel returns the tiktoken encoding an OpenAI model uses, or ""
+// for models without a published BPE
+func encodingForModel(model string) string {
+	m := strings.ToLower(model)
+	switch {
+	case strings.HasPrefix(m, "gpt-4o"), strings.HasPrefix(m, "gpt-4.1"), strings.HasPrefix(m, "o1"),
+		strings.HasPrefix(m, "o3"), strings.HasPrefix(m, "o4"):
+		return "o200k_base"
+	case strings.HasPrefix(m, "gpt-4"), strings.HasPrefix(m, "gpt-3.5"), strings.HasPrefix(m, "text-embedding"):
+		return "cl100k_base"
+	default:
+		return ""
+	}
+}
+
+// loadEncoding returns the named encoding, reading it from t.dir the first
+// time it is asked for
+func (t *tokenizer) loadEncoding(name string) (*bpeEncoding, error) {
+	t.mu.Lock()
+	entry, ok := t.loaded[name]
+	if !ok {
+		entry = &encodingEntry{}
+		t.loaded[name] = entry
+	}
+	t.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.enc, entry.err = readEncoding(filepath.Join(t.dir, name+".tiktoken"))
+	})
+	return entry.enc, entry.err
+}
+
+// readEncoding parses a .tiktoken file: one base64 token and its rank per line
+func readEncoding(path string) (*bpeEncoding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading encoding: %w", err)
+	}
+	defer f.Close()
+
+	enc := &bpeEncoding{ranks: make(map[string]int)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		token, rank, ok := bytes.Cut(line, []byte(" "))
+		if !ok {
+			return nil, fmt.Errorf("%s: malformed line %q", path, line)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(string(token))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		n, err := strconv.Atoi(string(rank))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		enc.ranks[string(decoded)] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return enc, nil
+}
+
+// maxMergePiece is the longest piece, in bytes, count merges exactly.
+// Merging is quadratic in the piece's length and a letter run has no length
+// limit, so a long run of text without spaces is estimated instead of
+// tying up a CPU; real words are far shorter.
+const maxMergePiece = 256
+
+// count returns the number of tokens text encodes to
+func (e *bpeEncoding) count(text string) int {
+	n := 0
+	for _, piece := range splitPieces(text) {
+		if _, ok := e.ranks[piece]; ok {
+			n++
+			continue
+		}
+		if len(piece) > maxMergePiece {
+			n += approximateTokens(piece)
+			continue
+		}
+		n += e.mergeCount([]byte(piece))
+	}
+	return n
+}
+
+// mergeCount applies byte-pair merges to piece, always merging the adjacent
+// pair with the lowest rank first, and returns the number of parts left
+func (e *bpeEncoding) mergeCount(piece []byte) int {
+	// bounds[i] is where part i starts; parts run to the next boundary
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+
+	for len(bounds) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i+2 < len(bounds); i++ {
+			rank, ok := e.ranks[string(piece[bounds[i]:bounds[i+2]])]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+	return len(bounds) - 1
+}
+
+// splitPieces splits text the way cl100k_base does before merging: letter
+// runs with at most one leading non-letter, numbers of up to three digits,
+// punctuation runs with an optional leading space, English contractions, and
+// whitespace, where a run of spaces leaves its last space to the word after
+// it. o200k_base splits slightly differently, so counts for it can be off by
+// a token here and there.
+func splitPieces(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		n := nextPiece(text)
+		pieces = append(pieces, text[:n])
+		text = text[n:]
+	}
+	return pieces
+}
+
+// nextPiece returns the byte length of the piece at the start of s
+func nextPiece(s string) int {
+	r, size := utf8.DecodeRuneInString(s)
+
+	// 's 't 're 've 'm 'll 'd, in any case
+	if r == '\'' {
+		for _, suffix := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if len(s) > len(suffix) && strings.EqualFold(s[1:1+len(suffix)], suffix) {
+				return 1 + len(suffix)
+			}
+		}
+	}
+
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	if unicode.IsLetter(r) {
+		return size + spanOf(s[size:], unicode.IsLetter, -1)
+	}
+	if r != '\r' && r != '\n' && !unicode.IsNumber(r) {
+		if next, _ := utf8.DecodeRuneInString(s[size:]); unicode.IsLetter(next) {
+			return size + spanOf(s[size:], unicode.IsLetter, -1)
+		}
+	}
+
+	// \p{N}{1,3}
+	if unicode.IsNumber(r) {
+		return spanOf(s, unicode.IsNumber, 3)
+	}
+
+	// ' ?[^\s\p{L}\p{N}]+[\r\n]*'
+	isSymbol := func(r rune) bool {
+		return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}
+	start := 0
+	if r == ' ' {
+		start = size
+	}
+	if n := spanOf(s[start:], isSymbol, -1); n > 0 {
+		n += start
+		return n + spanOf(s[n:], func(r rune) bool { return r == '\r' || r == '\n' }, -1)
+	}
+
+	// Whitespace: \s*[\r\n]+, then \s+(?!\S), then \s+
+	ws := spanOf(s, unicode.IsSpace, -1)
+	if i := strings.LastIndexAny(s[:ws], "\r\n"); i >= 0 {
+		return i + 1
+	}
+	if ws < len(s) {
+		// Leave the last space to prefix the word that follows
+		_, last := utf8.DecodeLastRuneInString(s[:ws])
+		if ws > last {
+			return ws - last
+		}
+	}
+	return ws
+}
+
+// spanOf returns the byte length of the longest prefix of s whose runes all
+// satisfy f, stopping after max runes unless max is negative
+func spanOf(s string, f func(rune) bool, max int) int {
+	n, runes := 0, 0
+	for n < len(s) && runes != max {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !f(r) {
+			break
+		}
+		n += size
+		runes++
+	}
+	return n
+}
+
+// approximateTokens estimates a token count without a tokenizer. Each piece
+// is weighed by its script: a Latin word is usually one token with a few more
+// for long words, CJK characters are about one token each, and other scripts
+// such as Cyrillic fall in between at about two characters a token.
+func approximateTokens(text string) int {
+	n := 0
+	for _, piece := range splitPieces(text) {
+		var latin, wide, other int
+		for _, r := range piece {
+			switch {
+			case r < utf8.RuneSelf:
+				latin++
+			case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+				wide++
+			default:
+				other++
+			}
+		}
+		tokens := (latin+5)/6 + wide + (other+1)/2
+		if tokens == 0 && piece != "" {
+			tokens = 1
+		}
+		n += tokens
+	}
+	return n
+}
+
+// CountTokens returns the number of tokens model would read for text. OpenAI
+// models are counted exactly with their BPE when its rank file is in
+// Config.TokenizerDir; the error reports a rank file that couldn't be
+// loaded. Other models, whose tokenizers aren't published, and every model
+// when no directory is configured, get approximateTokens.
+func (g *Gateway) CountTokens(model, text string) (int, error) {
+	name := encodingForModel(model)
+	if name == "" || g.tokenizer == nil || g.tokenizer.dir == "" {
+		return approximateTokens(text), nil
+	}
+	enc, err := g.tokenizer.loadEncoding(name)
+	if err != nil {
+		return approximateTokens(text), err
+	}
+	return enc.count(text), nil
+}
+
+// estimateTokens is CountTokens for callers that can live with an estimate
+func (g *Gateway) estimateTokens(model, text string) int {
+	n, _ := g.CountTokens(model, text)
+	return n
+}
+
+// estimateUsage fills in the token counts of a response whose provider
+// didn't report usage
+func (g *Gateway) estimateUsage(req LLMRequest, response *LLMResponse) {
+	if response.TokensUsed > 0 {
+		return
+	}
+	completions := response.Responses
+	if len(completions) == 0 {
+		completions = []string{response.Response}
+	}
+	response.PromptTokens = g.promptTokens(req)
+	response.CompletionTokens = 0
+	for _, text := range completions {
+		response.CompletionTokens += g.estimateTokens(req.Model, text)
+	}
+	response.TokensUsed = response.PromptTokens + response.CompletionTokens
+}
+
+// promptTokens estimates the tokens in a request's conversation
+func (g *Gateway) promptTokens(req LLMRequest) int {
+	n := 0
+	for _, m := range req.conversation() {
+		n += g.estimateTokens(req.Model, m.Content)
+	}
+	return n
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEncoding merges runs of "a" in powers of two
+func testEncoding() *bpeEncoding {
+	return &bpeEncoding{ranks: map[string]int{"a": 0, "aa": 1, "aaaa": 2, "aaaaaaaa": 3}}
+}
+
+func TestBPECount(t *testing.T) {
+	enc := testEncoding()
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"a", 1},
+		{"aaaa", 1},
+		{"aaaaaaaaa", 2},
+		{"aaa aaa", 5}, // " aaa" has no merge for its space
+	}
+	for _, tt := range tests {
+		if got := enc.count(tt.text); got != tt.want {
+			t.Errorf("count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+// A piece too long to merge is estimated rather than merged
+func TestBPECountLongPiece(t *testing.T) {
+	word := strings.Repeat("a", maxMergePiece+1)
+	if got, want := testEncoding().count(word), approximateTokens(word); got != want {
+		t.Errorf("count of a %d byte word = %d, want the estimate %d", len(word), got, want)
+	}
+}
+
+// A megabyte without a space is a single piece, which must not take
+// quadratic time to count
+func BenchmarkBPECountLongWord(b *testing.B) {
+	enc := testEncoding()
+	word := strings.Repeat("a", 1<<20)
+	b.SetBytes(int64(len(word)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc.count(word)
+	}
+}
+
+// writeRankFile writes a cl100k_base rank file to dir that merges "hello"
+// and "hellohello" into single tokens
+func writeRankFile(t *testing.T, dir string) {
+	t.Helper()
+	var b strings.Builder
+	for rank, token := range []string{"h", "e", "l", "o", "he", "ll", "hell", "hello", "hellohello"} {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cl100k_base.tiktoken"), []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Each gateway counts with its own TokenizerDir, and one without a directory
+// estimates rather than reading rank files from the working directory
+func TestCountTokensPerGateway(t *testing.T) {
+	const text = "hellohellohello"
+	dir := t.TempDir()
+	writeRankFile(t, dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	cfg := DefaultConfig()
+	cfg.TokenizerDir = dir
+	exact := NewGateway(WithConfig(cfg), WithoutRateLimit())
+	defer exact.Close()
+	estimated := NewGateway(WithoutRateLimit())
+	defer estimated.Close()
+
+	if n, err := exact.CountTokens("gpt-4", text); err != nil || n != 2 {
+		t.Errorf("with rank files: %d tokens (err %v), want 2", n, err)
+	}
+	if n, err := estimated.CountTokens("gpt-4", text); err != nil || n != approximateTokens(text) {
+		t.Errorf("without a directory: %d tokens (err %v), want the estimate %d", n, err, approximateTokens(text))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Tool is a function the model may call instead of answering, in the
+// OpenAI format. Parameters is a JSON Schema object describing its
+// arguments.
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall is a call the model made to one of the request's tools.
+// Arguments is the JSON the model generated, which isn't guaranteed to be
+// valid. The result goes back in a "tool" message with the call's ID.
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// toolNamePattern is what OpenAI accepts as a function name
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// supportsTools reports whether a provider takes tools. The others reject
+// requests that use them rather than silently answering without them.
+func supportsTools(p ModelProvider) bool {
+	return p == OpenAI || p == AzureOpenAI
+}
+
+// usesTools reports whether req offers tools or carries the tool calls and
+// results of an earlier turn
+func (req LLMRequest) usesTools() bool {
+	if len(req.Tools) > 0 {
+		return true
+	}
+	for _, m := range req.Messages {
+		if m.Role == "tool" || len(m.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTools checks the tools, tool choice and tool messages of a request
+func (req LLMRequest) validateTools() *ValidationError {
+	names := make(map[string]bool, len(req.Tools))
+	for i, t := range req.Tools {
+		field := fmt.Sprintf("tools[%d]", i)
+		if t.Type != "function" {
+			return &ValidationError{Field: field + ".type", Message: `must be "function"`}
+		}
+		if !toolNamePattern.MatchString(t.Function.Name) {
+			return &ValidationError{Field: field + ".function.name", Message: "must be 1 to 64 letters, digits, underscores or dashes"}
+		}
+		if names[t.Function.Name] {
+			return &ValidationError{Field: field + ".function.name", Message: fmt.Sprintf("duplicate tool %q", t.Function.Name)}
+		}
+		names[t.Function.Name] = true
+		if len(t.Function.Parameters) > 0 && !json.Valid(t.Function.Parameters) {
+			return &ValidationError{Field: field + ".function.parameters", Message: "must be a JSON Schema object"}
+		}
+	}
+	if len(req.Tools) > 0 && req.Stream {
+		return &ValidationError{Field: "tools", Message: "cannot be combined with stream"}
+	}
+
+	if len(req.ToolChoice) > 0 {
+		if len(req.Tools) == 0 {
+			return &ValidationError{Field: "tool_choice", Message: "requires tools"}
+		}
+		var mode string
+		var named struct {
+			Type     string `json:"type"`
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		}
+		switch {
+		case json.Unmarshal(req.ToolChoice, &mode) == nil:
+			if mode != "none" && mode != "auto" && mode != "required" {
+				return &ValidationError{Field: "tool_choice", Message: `must be "none", "auto", "required" or a function`}
+			}
+		case json.Unmarshal(req.ToolChoice, &named) == nil && named.Type == "function":
+			if !names[named.Function.Name] {
+				return &ValidationError{Field: "tool_choice", Message: fmt.Sprintf("unknown tool %q", named.Function.Name)}
+			}
+		default:
+			return &ValidationError{Field: "tool_choice", Message: `must be "none", "auto", "required" or a function`}
+		}
+	}
+
+	for i, m := range req.Messages {
+		if m.Role == "tool" && m.ToolCallID == "" {
+			return &ValidationError{Field: fmt.Sprintf("messages[%d].tool_call_id", i), Message: "must be set on tool messages"}
+		}
+		if len(m.ToolCalls) > 0 && m.Role != "assistant" {
+			return &ValidationError{Field: fmt.Sprintf("messages[%d].tool_calls", i), Message: "only assistant messages make tool calls"}
+		}
+	}
+	return nil
+}
+
+// toolsKey returns the cache key part for a request's tools, empty when it
+// has none so existing entries stay valid
+func (req LLMRequest) toolsKey() string {
+	if len(req.Tools) == 0 {
+		return ""
+	}
+	tools, _ := json.Marshal(req.Tools)
+	return "tools=" + string(tools) + " tool_choice=" + string(req.ToolChoice)
+}
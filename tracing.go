@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracingConfig exports OpenTelemetry traces over OTLP/HTTP. Endpoint is the
+// collector's base URL, e.g. http://localhost:4318; spans are POSTed as JSON
+// to its /v1/traces path. Tracing is off when it is empty.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+const (
+	defaultTraceServiceName = "ai-gateway"
+
+	// traceBatchSize and traceFlushInterval bound how long finished spans
+	// wait before being exported; traceQueueSize how many may wait
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceQueueSize     = 4096
+)
+
+// Span kinds, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Tracer records spans and exports them in batches from a background
+// goroutine, so ending a span never waits on the collector. Spans are
+// dropped, with a warning, if the collector can't keep up. A nil *Tracer
+// records nothing, and its spans are nil, so call sites need no checks.
+//
+// The gateway speaks the OTLP/JSON and W3C Trace Context formats directly
+// instead of pulling in the OpenTelemetry SDK.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+
+	spans     chan *Span
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTracer starts a tracer exporting to cfg.Endpoint. It returns nil when
+// tracing is off. Call Close to flush the remaining spans.
+func NewTracer(cfg TracingConfig) *Tracer {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	service := cfg.ServiceName
+	if service == "" {
+		service = defaultTraceServiceName
+	}
+	t := &Tracer{
+		endpoint: strings.TrimRight(cfg.Endpoint, "/") + "/v1/traces",
+		headers:  cfg.Headers,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *Span, traceQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.exporter()
+	return t
+}
+
+// Close exports the spans still queued and stops the exporter. It is safe to
+// call more than once.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		<-t.done
+	})
+	return nil
+}
+
+// spanContext identifies a span within a trace
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// Span is one timed operation in a trace. Its methods do nothing on a nil
+// *Span.
+type Span struct {
+	tracer   *Tracer
+	ctx      spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []otlpKeyValue
+	err   string
+}
+
+type spanKey struct{}
+
+// remoteSpanKey holds the spanContext of a caller's traceparent header
+type remoteSpanKey struct{}
+
+// SpanFrom returns the span ctx is running in, if any
+func SpanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start begins a span as a child of the span in ctx, or of the caller's
+// traceparent, or else as the root of a new trace
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent := SpanFrom(ctx); parent != nil {
+		s.ctx.traceID, s.parentID = parent.ctx.traceID, parent.ctx.spanID
+	} else if remote, ok := ctx.Value(remoteSpanKey{}).(spanContext); ok {
+		s.ctx.traceID, s.parentID = remote.traceID, remote.spanID
+	} else {
+		rand.Read(s.ctx.traceID[:])
+	}
+	rand.Read(s.ctx.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// TraceID returns the span's trace ID in hex
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.ctx.traceID[:])
+}
+
+// SetAttr annotates the span. Strings, bools, ints and float64s are kept as
+// such; anything else is recorded as its fmt.Sprint form.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		n := strconv.Itoa(value)
+		v.IntValue = &n
+	case int64:
+		n := strconv.FormatInt(value, 10)
+		v.IntValue = &n
+	case float64:
+		v.DoubleValue = &value
+	default:
+		str := fmt.Sprint(value)
+		v.StringValue = &str
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: v})
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed with err, if it is non-nil
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+		slog.Warn("trace queue full, dropping span", "span", s.name)
+	}
+}
+
+// traceparent formats the span as a W3C traceparent header value
+func (s *Span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.ctx.traceID[:]) + "-" + hex.EncodeToString(s.ctx.spanID[:]) + "-01"
+}
+
+// parseTraceparent reads a W3C traceparent header value
+func parseTraceparent(v string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if sc.traceID == ([16]byte{}) || sc.spanID == ([8]byte{}) {
+		return sc, false
+	}
+	return sc, true
+}
+
+// injectTraceparent passes the trace in req's context on to an upstream
+// call, so the provider's spans, if it records any, join the trace
+func injectTraceparent(req *http.Request) {
+	if s := SpanFrom(req.Context()); s != nil {
+		req.Header.Set("traceparent", s.traceparent())
+	}
+}
+
+// Traced wraps a handler in a server span, continuing the trace from the
+// caller's traceparent header when there is one. It runs ahead of RequestID,
+// which then uses the trace ID as the request ID unless the client sent its
+// own, so the two can be matched up.
+func (g *Gateway) Traced(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if g.tracer == nil {
+			next(w, r)
+			return
+		}
+		ctx := r.Context()
+		if sc, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, remoteSpanKey{}, sc)
+		}
+		ctx, span := g.tracer.Start(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		defer span.End()
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx))
+		span.SetAttr("http.response.status_code", rec.status)
+		if id := w.Header().Get("X-Request-ID"); id != "" {
+			span.SetAttr("gateway.request_id", id)
+		}
+		if rec.status >= 500 {
+			span.RecordError(fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status)))
+		}
+	}
+}
+
+// exporter sends finished spans in batches until Close is called
+func (t *Tracer) exporter() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, traceBatchSize)
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stop:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			t.export(batch)
+			return
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+// export POSTs spans to the collector. Failures are logged and the spans
+// dropped; traces are best effort.
+func (t *Tracer) export(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		otlpSpans[i] = s.otlp()
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{{
+			Key:   "service.name",
+			Value: otlpAnyValue{StringValue: &t.service},
+		}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/randomaigirl/ai-toolkit"},
+			Spans: otlpSpans,
+		}},
+	}}})
+	if err != nil {
+		slog.Error("encoding trace spans", "err", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		slog.Error("exporting trace spans", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		slog.Warn("exporting trace spans", "spans", len(spans), "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("exporting trace spans", "spans", len(spans), "status", resp.StatusCode)
+	}
+}
+
+// otlp converts a finished span to its OTLP/JSON form
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.ctx.traceID[:]),
+		SpanID:            hex.EncodeToString(s.ctx.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != ([8]byte{}) {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		out.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return out
+}
+
+// The OTLP/JSON export request, trimmed to the fields the gateway sets
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// defaultWarmupConcurrency is how many warm-up requests run at once when
+// WarmupConfig.Concurrency is unset
+const defaultWarmupConcurrency = 2
+
+// WarmupConfig lists requests sent on startup so their answers are cached
+// before clients ask. Concurrency caps how many run at once, so a long list
+// doesn't stampede the providers.
+type WarmupConfig struct {
+	Requests    []LLMRequest `json:"requests,omitempty"`
+	Concurrency int          `json:"concurrency,omitempty"`
+}
+
+// errAlreadyCached marks a warm-up request whose answer is cached already
+var errAlreadyCached = errors.New("already cached")
+
+// Warm sends the configured warm-up requests, skipping any whose answer is
+// already cached, and logs the outcome. It runs at low priority and returns
+// early when ctx is cancelled. main calls it in the background once the
+// server is listening.
+func (g *Gateway) Warm(ctx context.Context) {
+	reqs := g.config.Warmup.Requests
+	if len(reqs) == 0 {
+		return
+	}
+	workers := g.config.Warmup.Concurrency
+	if workers <= 0 {
+		workers = defaultWarmupConcurrency
+	}
+	if workers > len(reqs) {
+		workers = len(reqs)
+	}
+
+	slog.Info("warming cache", "requests", len(reqs), "concurrency", workers)
+	start := time.Now()
+	var warmed, skipped, failed atomic.Int64
+	indexes := make(chan int)
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			for i := range indexes {
+				err := g.warmOne(ctx, reqs[i])
+				switch {
+				case err == nil:
+					warmed.Add(1)
+					slog.Debug("cache warm-up request done", "index", i)
+				case errors.Is(err, errAlreadyCached):
+					skipped.Add(1)
+				default:
+					failed.Add(1)
+					slog.Warn("cache warm-up request failed", "index", i, "err", err)
+				}
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := range reqs {
+		if ctx.Err() != nil {
+			break
+		}
+		indexes <- i
+	}
+	close(indexes)
+	for i := 0; i < workers; i++ {
+		<-done
+	}
+
+	slog.Info("cache warm-up finished", "warmed", warmed.Load(), "skipped", skipped.Load(),
+		"failed", failed.Load(), "duration", time.Since(start))
+}
+
+// warmOne sends a single warm-up request through the usual checks
+func (g *Gateway) warmOne(ctx context.Context, req LLMRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if req.Priority == "" {
+		req.Priority = PriorityLow
+	}
+	g.applyDefaults(&req)
+	invalid := g.renderTemplate(&req)
+	if invalid == nil {
+		invalid = g.validate(req)
+	}
+	if invalid != nil {
+		return invalid
+	}
+	if req.Stream || req.CallbackURL != "" {
+		return errors.New("stream and callback_url are not supported for warm-up")
+	}
+	if _, cacheable := g.cacheTTL(req); !cacheable {
+		return errors.New("request is not cacheable")
+	}
+	key := cacheKeyFor(req, g.config.CacheKeys, g.config.CacheVersion)
+	if _, found := g.responseCache().Get(key); found {
+		return errAlreadyCached
+	}
+
+	ctx, cancel := g.withRequestTimeout(ctx, req)
+	defer cancel()
+	_, err := g.completeLLMRequest(ctx, req)
+	return err
+}